@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2020, Kairo de Araujo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package _storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FileSystem is a Storage that keeps the files in a directory tree on disk.
+//
+// When Root is empty the $CAPATH environment variable is used (current
+// directory if not defined), resolved on every operation.
+type FileSystem struct {
+	Root string
+}
+
+// NewFileSystem returns a FileSystem Storage rooted in the given directory.
+func NewFileSystem(root string) *FileSystem {
+	return &FileSystem{Root: root}
+}
+
+// path resolves the file name in the Root directory. The directories are
+// created only by Put, reading a missing file does not touch the disk.
+func (f *FileSystem) path(name string) (string, error) {
+	if f.Root == "" {
+		caPath, err := caPath()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(caPath, name), nil
+	}
+
+	return filepath.Join(f.Root, name), nil
+}
+
+// Put writes data in the file name, creating the missing directories.
+//
+// The data is written to a temporary file renamed into place, the readers
+// never see a partially written file.
+func (f *FileSystem) Put(name string, data []byte, perm fs.FileMode) error {
+	fileName, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := MakeFolder(filepath.Dir(fileName)); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), fileName)
+}
+
+// Get reads the file name.
+func (f *FileSystem) Get(name string) ([]byte, error) {
+	fileName, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(fileName)
+}
+
+// List returns the directories inside the directory name.
+func (f *FileSystem) List(name string) ([]string, error) {
+	dirName, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+
+	return dirs, nil
+}
+
+// Delete removes the file or directory name.
+func (f *FileSystem) Delete(name string) error {
+	fileName, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(fileName)
+}
+
+// Exists returns if the file or directory name exists.
+func (f *FileSystem) Exists(name string) bool {
+	fileName, err := f.path(name)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(fileName)
+
+	return err == nil
+}
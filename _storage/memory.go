@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2020, Kairo de Araujo
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package _storage
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory is a Storage that keeps all the files in memory.
+//
+// It is useful for tests and for short-lived Certificate Authorities that
+// should never touch the disk.
+type Memory struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemory returns an empty Memory Storage.
+func NewMemory() *Memory {
+	return &Memory{files: map[string][]byte{}}
+}
+
+func memoryKey(name string) string {
+	key := filepath.ToSlash(filepath.Clean(name))
+	if key == "." || key == "/" {
+		return ""
+	}
+
+	return strings.TrimPrefix(key, "/")
+}
+
+// Put stores a copy of data as name. Permissions are ignored.
+func (m *Memory) Put(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[memoryKey(name)] = append([]byte{}, data...)
+
+	return nil
+}
+
+// Get returns a copy of the data stored as name.
+func (m *Memory) Get(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.files[memoryKey(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return append([]byte{}, data...), nil
+}
+
+// List returns the directories directly below name.
+func (m *Memory) List(name string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prefix := memoryKey(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	seen := map[string]bool{}
+	for key := range m.files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if dir, _, isDir := strings.Cut(rest, "/"); isDir {
+			seen[dir] = true
+		}
+	}
+
+	if len(seen) == 0 && prefix != "" && !m.exists(memoryKey(name)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var dirs []string
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs, nil
+}
+
+// Delete removes name and everything below it.
+func (m *Memory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := memoryKey(name)
+	for stored := range m.files {
+		if key == "" || stored == key || strings.HasPrefix(stored, key+"/") {
+			delete(m.files, stored)
+		}
+	}
+
+	return nil
+}
+
+// Exists returns if name is a stored file or a directory holding files.
+func (m *Memory) Exists(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.exists(memoryKey(name))
+}
+
+func (m *Memory) exists(key string) bool {
+	if key == "" {
+		return true
+	}
+
+	if _, ok := m.files[key]; ok {
+		return true
+	}
+
+	for stored := range m.files {
+		if strings.HasPrefix(stored, key+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -22,16 +22,15 @@
 package _storage
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/pem"
 	"errors"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
+
+	"github.com/kairoaraujo/goca/v2/internal/pkcs8"
 )
 
 // File name constants
@@ -40,84 +39,82 @@ const (
 	PublicPEMFile = "key.pub"
 )
 
-var ErrIncompleteCopy = errors.New("file copy was incomplete")
+// ArchiveFolder is the folder of a certificate keeping its previous
+// certificates by serial number: <CA>/certs/<CN>/archive/<serial>/
+const ArchiveFolder = "archive"
 
-func checkError(err error) error {
-	if err != nil {
-		return err
-	}
+// File permissions used when storing files
+const (
+	privateFileMode fs.FileMode = 0600
+	publicFileMode  fs.FileMode = 0644
+)
 
-	return nil
+// Storage is the backend where all the Certificate Authority files (keys,
+// CSRs, certificates, CRLs) are kept.
+//
+// Paths are relative to the storage root and follow the $CAPATH layout, for
+// example "<CA>/ca/key.pem" or "<CA>/certs/<Common Name>/<Common Name>.crt".
+// Missing parents are created by Put.
+type Storage interface {
+	// Put stores data in path with the given permissions.
+	Put(path string, data []byte, perm fs.FileMode) error
+	// Get returns the data stored in path. When path does not exist the
+	// error matches fs.ErrNotExist.
+	Get(path string) ([]byte, error)
+	// List returns the names of the directories directly below path.
+	List(path string) ([]string, error)
+	// Delete removes path and everything below it.
+	Delete(path string) error
+	// Exists returns if path (file or directory) exists.
+	Exists(path string) bool
 }
 
-func savePEMKey(fileName string, key *rsa.PrivateKey) {
-
-	outFile, err := os.Create(fileName)
-	checkError(err)
-	defer outFile.Close()
-
-	err = os.Chmod(fileName, 0600)
-	checkError(err)
-
-	var privateKey = &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}
-
-	err = pem.Encode(outFile, privateKey)
-	checkError(err)
+// Default returns the file system Storage rooted in $CAPATH.
+func Default() Storage {
+	return &FileSystem{}
 }
 
-func savePublicPEMKey(fileName string, pubkey rsa.PublicKey) {
-	asn1Bytes, err := asn1.Marshal(pubkey)
-	checkError(err)
+func encodePEM(blockType string, data []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+}
 
-	var pemkey = &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: asn1Bytes,
+func savePEMKey(s Storage, fileName string, key crypto.Signer, passphrase []byte) error {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
 	}
 
-	pemfile, err := os.Create(fileName)
-	checkError(err)
-	defer pemfile.Close()
+	if len(passphrase) == 0 {
+		return s.Put(fileName, encodePEM("PRIVATE KEY", keyBytes), privateFileMode)
+	}
 
-	err = pem.Encode(pemfile, pemkey)
-	checkError(err)
+	encryptedBytes, err := pkcs8.Encrypt(keyBytes, passphrase)
+	if err != nil {
+		return err
+	}
 
-	err = os.Chmod(fileName, 0600)
-	checkError(err)
+	return s.Put(fileName, encodePEM("ENCRYPTED PRIVATE KEY", encryptedBytes), privateFileMode)
 }
 
-func saveCSR(fileName string, csr []byte) {
-	var pemCSR = &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}
-	pemfile, err := os.Create(fileName)
-	checkError(err)
-	defer pemfile.Close()
-
-	err = pem.Encode(pemfile, pemCSR)
-	checkError(err)
+func savePublicPEMKey(s Storage, fileName string, pubkey crypto.PublicKey) error {
+	pubBytes, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		return err
+	}
 
+	return s.Put(fileName, encodePEM("PUBLIC KEY", pubBytes), publicFileMode)
 }
 
-func saveCert(fileName string, cert []byte) {
-	var pemCert = &pem.Block{Type: "CERTIFICATE", Bytes: cert}
-	pemfile, err := os.Create(fileName)
-	checkError(err)
-	defer pemfile.Close()
-
-	err = pem.Encode(pemfile, pemCert)
-	checkError(err)
-
+func saveCSR(s Storage, fileName string, csr []byte) error {
+	return s.Put(fileName, encodePEM("CERTIFICATE REQUEST", csr), publicFileMode)
 }
 
-func saveCRL(fileName string, crl []byte) {
-	var pemCRL = &pem.Block{Type: "X509 CRL", Bytes: crl}
-	pemfile, err := os.Create(fileName)
-	checkError(err)
-	defer pemfile.Close()
+func saveCert(s Storage, fileName string, cert []byte) error {
+	return s.Put(fileName, encodePEM("CERTIFICATE", cert), publicFileMode)
+}
 
-	err = pem.Encode(pemfile, pemCRL)
-	checkError(err)
+func saveCRL(s Storage, fileName string, crl []byte) error {
+	return s.Put(fileName, encodePEM("X509 CRL", crl), publicFileMode)
 }
 
 // File has the content to save a file
@@ -125,8 +122,9 @@ type File struct {
 	CA             string
 	CommonName     string
 	FileType       FileType
-	PrivateKeyData *rsa.PrivateKey
-	PublicKeyData  rsa.PublicKey
+	PrivateKeyData crypto.Signer
+	PublicKeyData  crypto.PublicKey
+	Passphrase     []byte // encrypts the PrivateKeyData when not empty
 	CSRData        []byte
 	CertData       []byte
 	CRLData        []byte
@@ -134,13 +132,8 @@ type File struct {
 }
 
 // CheckCertExists returns if a certificate exists or not
-func CheckCertExists(f File) bool {
-	caPath, _ := caPathInit()
-	if _, err := os.Stat(filepath.Join(caPath, f.CA, "certs", f.CommonName, f.CommonName+".crt")); os.IsNotExist(err) {
-		return false
-	}
-
-	return true
+func CheckCertExists(s Storage, f File) bool {
+	return s.Exists(filepath.Join(f.CA, "certs", f.CommonName, f.CommonName+".crt"))
 }
 
 // MakeFolder creates folder inside the CAPATH infrastructure.
@@ -155,7 +148,8 @@ func MakeFolder(folderPath ...string) error {
 
 }
 
-func caPathInit() (string, error) {
+// caPath resolves the $CAPATH directory without creating it.
+func caPath() (string, error) {
 	CAPATH := os.Getenv("CAPATH")
 
 	if CAPATH == ".//" && os.Getenv("GOCATEST") != "true" {
@@ -171,6 +165,15 @@ func caPathInit() (string, error) {
 		CAPATH = currentPath
 	}
 
+	return CAPATH, nil
+}
+
+func caPathInit() (string, error) {
+	CAPATH, err := caPath()
+	if err != nil {
+		return "", err
+	}
+
 	if _, err := os.Stat(CAPATH); os.IsNotExist(err) {
 
 		err := MakeFolder(CAPATH)
@@ -190,18 +193,9 @@ func CAPathIsReady() (string, error) {
 	return caPath, err
 }
 
-func CAStorage(commonName string) bool {
-	caPath, err := CAPathIsReady()
-	if err != nil {
-		return false
-	}
-
-	if _, err := os.Stat(filepath.Join(caPath, commonName)); os.IsNotExist(err) {
-		return false
-	}
-
-	return true
-
+// CAStorage returns if the Certificate Authority exists in the Storage
+func CAStorage(s Storage, commonName string) bool {
+	return s.Exists(commonName)
 }
 
 // CreationType represents if CA or Certificate owns the file
@@ -228,64 +222,48 @@ const (
 	FileTypeCRL
 )
 
-// SaveFile saves a File{}
-func SaveFile(f File) error {
+// SaveFile saves a File{} in the Storage
+func SaveFile(s Storage, f File) error {
 
 	var fileName string
 
-	caDir, err := caPathInit()
-	if err != nil {
-		return nil
-
-	}
-
-	fileName = caDir
-
 	// Creation type
 	switch f.CreationType {
 	case CreationTypeCA:
-		fileName = filepath.Join(fileName, f.CA, "ca")
+		fileName = filepath.Join(f.CA, "ca")
 
 	case CreationTypeCertificate:
-		fileName = filepath.Join(fileName, f.CA, "certs", f.CommonName)
-		if _, err := os.Stat(fileName); os.IsNotExist(err) {
-
-			err := MakeFolder(fileName)
-			if err != nil {
-				return err
-			}
-		}
+		fileName = filepath.Join(f.CA, "certs", f.CommonName)
 	}
 
 	// File Type
 	switch f.FileType {
 	case FileTypeKey:
-		savePEMKey(filepath.Join(fileName, PEMFile), f.PrivateKeyData)
-		savePublicPEMKey(filepath.Join(fileName, PublicPEMFile), f.PublicKeyData)
+		// the private key is not stored when it is kept outside (e.g. a HSM)
+		if f.PrivateKeyData != nil {
+			if err := savePEMKey(s, filepath.Join(fileName, PEMFile), f.PrivateKeyData, f.Passphrase); err != nil {
+				return err
+			}
+		}
+		return savePublicPEMKey(s, filepath.Join(fileName, PublicPEMFile), f.PublicKeyData)
 
 	case FileTypeCSR:
-		saveCSR(filepath.Join(fileName, f.CommonName+".csr"), f.CSRData)
+		return saveCSR(s, filepath.Join(fileName, f.CommonName+".csr"), f.CSRData)
 
 	case FileTypeCertificate:
-		saveCert(filepath.Join(fileName, f.CommonName+".crt"), f.CertData)
+		return saveCert(s, filepath.Join(fileName, f.CommonName+".crt"), f.CertData)
 
 	case FileTypeCRL:
-		saveCRL(filepath.Join(fileName, f.CommonName+".crl"), f.CRLData)
+		return saveCRL(s, filepath.Join(fileName, f.CommonName+".crl"), f.CRLData)
 	}
 
 	return nil
 
 }
 
-// LoadFile loads a file by file name from $CAPATH
-func LoadFile(filePath ...string) ([]byte, error) {
-	var fileName = filepath.Join(filePath...)
-	caPath, err := CAPathIsReady()
-	if err != nil {
-		return nil, err
-	}
-
-	fileData, err := ioutil.ReadFile(filepath.Join(caPath, fileName))
+// LoadFile loads a file by file name from the Storage
+func LoadFile(s Storage, filePath ...string) ([]byte, error) {
+	fileData, err := s.Get(filepath.Join(filePath...))
 	if err != nil {
 		return []byte{}, err
 	}
@@ -295,76 +273,37 @@ func LoadFile(filePath ...string) ([]byte, error) {
 }
 
 // CopyFile copies the specified src file to the given destination.
-// Both paths are relative to the $CAPATH hierarchy.
-func CopyFile(src, dest string) error {
-	caPath, err := CAPathIsReady()
-	if err != nil {
-		return err
-	}
-
-	srcPath := filepath.Join(caPath, src)
-	destPath := filepath.Join(caPath, dest)
-
-	in, err := os.Open(srcPath)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
-	inStat, err := in.Stat()
-	if err != nil {
-		return err
-	}
-
-	out, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE, inStat.Mode())
+// Both paths are relative to the Storage root.
+func CopyFile(s Storage, src, dest string) error {
+	data, err := s.Get(src)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	written, err := io.Copy(out, in)
-	if err != nil {
-		return err
-	}
-
-	if written != inStat.Size() {
-		return ErrIncompleteCopy
-	}
 
-	return nil
+	return s.Put(dest, data, publicFileMode)
 }
 
-func listDirs(paths ...string) []string {
-	var path = filepath.Join(paths...)
-	caPath, err := CAPathIsReady()
-	if err != nil {
-		return nil
-	}
-
-	var dirs []string
-
-	files, err := filepath.Glob(filepath.Join(caPath, path, "*"))
+func listDirs(s Storage, paths ...string) []string {
+	dirs, err := s.List(filepath.Join(paths...))
 	if err != nil {
 		return nil
 	}
 
-	for _, f := range files {
-		info, _ := os.Stat(f)
-		if info.IsDir() {
-			dirSplited := strings.Split(f, string(os.PathSeparator))
-			dirs = append(dirs, dirSplited[len(dirSplited)-1])
-		}
-	}
-
 	return dirs
 }
 
 // ListCertificates return a list of certificates folders
-func ListCertificates(CACommonName string) []string {
-	return listDirs(CACommonName, "certs")
+func ListCertificates(s Storage, CACommonName string) []string {
+	return listDirs(s, CACommonName, "certs")
+}
+
+// ListArchivedCertificates return a list of the archived certificates
+// folders (serial numbers) of a certificate
+func ListArchivedCertificates(s Storage, CACommonName, commonName string) []string {
+	return listDirs(s, CACommonName, "certs", commonName, ArchiveFolder)
 }
 
 // ListCAs return a list of certificates folders
-func ListCAs() []string {
-	return listDirs("")
+func ListCAs(s Storage) []string {
+	return listDirs(s, "")
 }
@@ -0,0 +1,207 @@
+package goca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit record outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// ErrAuditChain means that an audit log record was changed, removed or
+// inserted: its sequence, previous hash or hash does not match the chain.
+var ErrAuditChain = errors.New("the audit log hash chain is broken")
+
+// AuditRecord is an entry of the audit log of the Certificate Authority
+// operations.
+//
+// The records written by AuditFile are hash chained: Hash is the hex SHA-256
+// of PrevHash and the JSON record without Hash, PrevHash is the Hash of the
+// previous record (empty for the first one).
+type AuditRecord struct {
+	Sequence     uint64    `json:"seq"`                     // Position in the audit log, starting at 1
+	Time         time.Time `json:"time"`                    // Time of the operation
+	Actor        string    `json:"actor,omitempty"`         // Actor of the operation given by WithActor
+	Operation    Operation `json:"operation"`               // Operation of the Certificate Authority
+	CA           string    `json:"ca"`                      // Common name of the Certificate Authority
+	Subject      string    `json:"subject,omitempty"`       // Common name of the certificate
+	SerialNumber string    `json:"serial_number,omitempty"` // Serial number of the certificate
+	Outcome      string    `json:"outcome"`                 // AuditSuccess or AuditFailure
+	Error        string    `json:"error,omitempty"`         // Error of the failed operation
+	PrevHash     string    `json:"prev_hash"`               // Hash of the previous record
+	Hash         string    `json:"hash"`                    // Hash of the record
+}
+
+// NewAuditRecord returns the audit record of the event, not chained
+func NewAuditRecord(event Event) AuditRecord {
+	record := AuditRecord{
+		Time:         event.Time.UTC(),
+		Actor:        event.Actor,
+		Operation:    event.Operation,
+		CA:           event.CA,
+		Subject:      event.CommonName,
+		SerialNumber: event.SerialNumber,
+		Outcome:      AuditSuccess,
+	}
+	if event.Err != nil {
+		record.Outcome = AuditFailure
+		record.Error = event.Err.Error()
+	}
+
+	return record
+}
+
+// hash returns the hash of the record chained to PrevHash
+func (r AuditRecord) hash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(r.PrevHash), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditSink appends the audit records of the Certificate Authority
+// operations.
+type AuditSink interface {
+	Append(record AuditRecord) error
+}
+
+// AuditSinkFunc is a function used as AuditSink.
+type AuditSinkFunc func(record AuditRecord) error
+
+// Append calls f(record).
+func (f AuditSinkFunc) Append(record AuditRecord) error {
+	return f(record)
+}
+
+// WithAuditSink appends the records of all the Certificate Authority
+// operations (create, load-key, issue, sign, renew, revoke, release-hold, CRL
+// and export-key), successful or failed, to the sink. The errors of the sink
+// are given to onError, that can be nil. The option can be given more than
+// once.
+func WithAuditSink(sink AuditSink, onError func(error)) Option {
+	return WithObserver(func(event Event) {
+		if err := sink.Append(NewAuditRecord(event)); err != nil && onError != nil {
+			onError(fmt.Errorf("audit %s of %s: %w", event.Operation, event.CA, err))
+		}
+	})
+}
+
+// AuditFile is the AuditSink appending hash chained JSON lines records to a
+// file, safe for concurrent use. Only one AuditFile must write a file.
+type AuditFile struct {
+	mu       sync.Mutex
+	file     *os.File
+	sequence uint64
+	lastHash string
+}
+
+// OpenAuditFile opens or creates the audit log file. The records already in
+// the file are verified and the new records continue their chain, it fails
+// with ErrAuditChain when the file was tampered.
+func OpenAuditFile(path string) (*AuditFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := verifyAuditLog(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &AuditFile{file: file, sequence: last.Sequence, lastHash: last.Hash}, nil
+}
+
+// Append implements AuditSink, chaining the record to the previous one and
+// syncing the file.
+func (f *AuditFile) Append(record AuditRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	record.Sequence = f.sequence + 1
+	record.PrevHash = f.lastHash
+
+	hash, err := record.hash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	f.sequence = record.Sequence
+	f.lastHash = record.Hash
+
+	return nil
+}
+
+// Close closes the audit log file
+func (f *AuditFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// VerifyAuditLog verifies the hash chain of the JSON lines audit log written
+// by AuditFile and returns the number of records. A changed, removed or
+// inserted record fails with ErrAuditChain and its line number.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	last, err := verifyAuditLog(r)
+	return int(last.Sequence), err
+}
+
+// verifyAuditLog returns the last record of the verified audit log
+func verifyAuditLog(r io.Reader) (AuditRecord, error) {
+	var last AuditRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+
+		var record AuditRecord
+		if err := decoder.Decode(&record); err != nil {
+			return last, fmt.Errorf("line %d: %w: %v", line, ErrAuditChain, err)
+		}
+
+		hash, err := record.hash()
+		if err != nil {
+			return last, err
+		}
+		if record.Sequence != last.Sequence+1 || record.PrevHash != last.Hash || record.Hash != hash {
+			return last, fmt.Errorf("line %d: %w", line, ErrAuditChain)
+		}
+
+		last = record
+	}
+
+	return last, scanner.Err()
+}
@@ -20,17 +20,21 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-// Package cert provides RSA Key API management for crypto/x509 certificates.
+// Package cert provides API management for crypto/x509 certificates.
 //
 // This package makes easy to generate and certificates from files to be used
 // by GoLang applications.
 //
 // Generating Certificates (even by Signing), the files will be saved in the
-// $CAPATH by default.
+// given Storage, the $CAPATH by default.
 // For $CAPATH, please check out the GoCA documentation.
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -38,9 +42,12 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io/fs"
 	"math/big"
 	"net"
 	"path/filepath"
+	"strings"
 	"time"
 
 	storage "github.com/kairoaraujo/goca/v2/_storage"
@@ -54,8 +61,14 @@ const (
 	MaxValidCert int = 825
 	// DefaultValidCert is the default valid time: 397 days
 	DefaultValidCert int = 397
+	// MaxValidCA is the default maximum valid time of the CA certificates: 9125 days
+	MaxValidCA int = 9125
 	// Certificate file extension
 	certExtension string = ".crt"
+	// Certificate Revocation List file extension
+	crlExtension string = ".crl"
+	// CRL number file
+	crlNumberFile string = "crlnumber"
 )
 
 // ErrCertExists means that the certificate requested already exists
@@ -63,6 +76,18 @@ var ErrCertExists = errors.New("certificate already exists")
 
 var ErrParentCANotFound = errors.New("parent CA not found")
 
+// ErrInvalidCSR means that the data is not a valid PEM Certificate Signing Request
+var ErrInvalidCSR = errors.New("failed to decode PEM Certificate Signing Request")
+
+// ErrInvalidCert means that the data is not a valid PEM Certificate
+var ErrInvalidCert = errors.New("failed to decode PEM Certificate")
+
+// ErrInvalidCRL means that the data is not a valid PEM Certificate Revocation List
+var ErrInvalidCRL = errors.New("failed to decode PEM Certificate Revocation List")
+
+// ErrCSRSignature means that the Certificate Signing Request self-signature is invalid
+var ErrCSRSignature = errors.New("invalid Certificate Signing Request signature")
+
 func newSerialNumber() (serialNumber *big.Int) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, _ = rand.Int(rand.Reader, serialNumberLimit)
@@ -70,10 +95,34 @@ func newSerialNumber() (serialNumber *big.Int) {
 	return serialNumber
 }
 
+// SignatureAlgorithm returns the signature algorithm used by GoCA to sign
+// with the private key matching the public key pub.
+func SignatureAlgorithm(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512
+		default:
+			return x509.ECDSAWithSHA256
+		}
+
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+
+	return x509.UnknownSignatureAlgorithm
+}
+
 // CreateCSR creates a Certificate Signing Request returning certData with CSR.
 //
-// The CSR is also stored in $CAPATH with extension .csr
-func CreateCSR(CACommonName, commonName, country, province, locality, organization, organizationalUnit, emailAddresses string, dnsNames []string, ipAddresses []net.IP, priv *rsa.PrivateKey, creationType storage.CreationType) (csr []byte, err error) {
+// The CSR is also stored in the Storage s with extension .csr
+func CreateCSR(s storage.Storage, CACommonName, commonName, country, province, locality, organization, organizationalUnit, emailAddresses string, dnsNames []string, ipAddresses []net.IP, priv crypto.Signer, creationType storage.CreationType) (csr []byte, err error) {
 	var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
 
 	subject := pkix.Name{
@@ -92,11 +141,14 @@ func CreateCSR(CACommonName, commonName, country, province, locality, organizati
 	asn1Subj, _ := asn1.Marshal(rawSubj)
 	template := x509.CertificateRequest{
 		RawSubject:         asn1Subj,
-		EmailAddresses:     []string{emailAddresses},
-		SignatureAlgorithm: x509.SHA256WithRSA,
+		SignatureAlgorithm: SignatureAlgorithm(priv.Public()),
 		IPAddresses:        ipAddresses,
 	}
 
+	if emailAddresses != "" {
+		template.EmailAddresses = []string{emailAddresses}
+	}
+
 	dnsNames = append(dnsNames, commonName)
 	template.DNSNames = dnsNames
 
@@ -113,7 +165,7 @@ func CreateCSR(CACommonName, commonName, country, province, locality, organizati
 		CreationType: creationType,
 	}
 
-	err = storage.SaveFile(fileData)
+	err = storage.SaveFile(s, fileData)
 
 	if err != nil {
 		return csr, err
@@ -127,9 +179,11 @@ func CreateCSR(CACommonName, commonName, country, province, locality, organizati
 // Using ioutil.ReadFile() satisfyies the read file.
 func LoadCSR(csrString []byte) (*x509.CertificateRequest, error) {
 	block, _ := pem.Decode([]byte(string(csrString)))
-	csr, _ := x509.ParseCertificateRequest(block.Bytes)
+	if block == nil {
+		return nil, ErrInvalidCSR
+	}
 
-	return csr, nil
+	return x509.ParseCertificateRequest(block.Bytes)
 }
 
 // LoadCRL loads a Certificate Revocation List from a read file.
@@ -137,25 +191,29 @@ func LoadCSR(csrString []byte) (*x509.CertificateRequest, error) {
 // Using ioutil.ReadFile() satisfyies the read file.
 func LoadCRL(crlString []byte) (*x509.RevocationList, error) {
 	block, _ := pem.Decode([]byte(string(crlString)))
-	crl, _ := x509.ParseRevocationList(block.Bytes)
+	if block == nil {
+		return nil, ErrInvalidCRL
+	}
 
-	return crl, nil
+	return x509.ParseRevocationList(block.Bytes)
 }
 
 // LoadParentCACertificate loads parent CA's certificate and private key
 //
+// The passphrase is used when the parent CA private key is encrypted.
+//
 // TODO maybe make this more generic, something like LoadCACertificate that
 // returns the certificate and private/public key
-func LoadParentCACertificate(commonName string) (certificate *x509.Certificate, privateKey *rsa.PrivateKey, err error) {
-	caStorage := storage.CAStorage(commonName)
+func LoadParentCACertificate(s storage.Storage, commonName string, passphrase []byte) (certificate *x509.Certificate, privateKey crypto.Signer, err error) {
+	caStorage := storage.CAStorage(s, commonName)
 	if !caStorage {
 		return nil, nil, ErrParentCANotFound
 	}
 
 	var caDir = filepath.Join(commonName, "ca")
 
-	if keyString, loadErr := storage.LoadFile(filepath.Join(caDir, "key.pem")); loadErr == nil {
-		privateKey, err = key.LoadPrivateKey(keyString)
+	if keyString, loadErr := storage.LoadFile(s, filepath.Join(caDir, "key.pem")); loadErr == nil {
+		privateKey, err = key.LoadEncryptedPrivateKey(keyString, passphrase)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -163,19 +221,31 @@ func LoadParentCACertificate(commonName string) (certificate *x509.Certificate,
 		return nil, nil, loadErr
 	}
 
-	if certString, loadErr := storage.LoadFile(filepath.Join(caDir, commonName+certExtension)); loadErr == nil {
-		certificate, err = LoadCert(certString)
-		if err != nil {
-			return nil, nil, err
-		}
-	} else {
-		return nil, nil, loadErr
+	certificate, err = LoadCACertificate(s, commonName)
+	if err != nil {
+		return nil, nil, err
 	}
 	return certificate, privateKey, nil
 }
 
+// LoadCACertificate loads a CA's certificate
+func LoadCACertificate(s storage.Storage, commonName string) (certificate *x509.Certificate, err error) {
+	caStorage := storage.CAStorage(s, commonName)
+	if !caStorage {
+		return nil, ErrParentCANotFound
+	}
+
+	certString, err := storage.LoadFile(s, filepath.Join(commonName, "ca", commonName+certExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadCert(certString)
+}
+
 // CreateRootCert creates a Root CA Certificate (self-signed)
 func CreateRootCert(
+	s storage.Storage,
 	CACommonName,
 	commonName,
 	country,
@@ -187,11 +257,12 @@ func CreateRootCert(
 	valid int,
 	dnsNames []string,
 	ipAddresses []net.IP,
-	privateKey *rsa.PrivateKey,
-	publicKey *rsa.PublicKey,
+	privateKey crypto.Signer,
+	publicKey crypto.PublicKey,
 	creationType storage.CreationType,
 ) (cert []byte, err error) {
 	cert, err = CreateCACert(
+		s,
 		CACommonName,
 		commonName,
 		country,
@@ -207,7 +278,9 @@ func CreateRootCert(
 		nil, // parentPrivateKey
 		nil, // parentCertificate
 		publicKey,
-		creationType)
+		creationType,
+		nil, // parentPolicy
+	)
 	return cert, err
 }
 
@@ -215,8 +288,12 @@ func CreateRootCert(
 //
 // Root certificates are self-signed. When creating a root certificate, leave
 // parentPrivateKey and parentCertificate parameters as nil. When creating an
-// intermediate CA certificates, provide parentPrivateKey and parentCertificate
+// intermediate CA certificates, provide parentPrivateKey and parentCertificate.
+// The intermediate CA certificate NotAfter never exceeds the parentCertificate
+// NotAfter and it has the CRL Distribution Points, OCSP servers and CA Issuers
+// URLs of the parentPolicy (optional).
 func CreateCACert(
+	s storage.Storage,
 	CACommonName,
 	commonName,
 	country,
@@ -229,10 +306,11 @@ func CreateCACert(
 	dnsNames []string,
 	ipAddresses []net.IP,
 	privateKey,
-	parentPrivateKey *rsa.PrivateKey,
+	parentPrivateKey crypto.Signer,
 	parentCertificate *x509.Certificate,
-	publicKey *rsa.PublicKey,
+	publicKey crypto.PublicKey,
 	creationType storage.CreationType,
+	parentPolicy *Policy,
 ) (cert []byte, err error) {
 	if validDays == 0 {
 		validDays = DefaultValidCert
@@ -252,7 +330,6 @@ func CreateCACert(
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().AddDate(0, 0, validDays),
 		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 		IPAddresses:           ipAddresses,
@@ -267,7 +344,19 @@ func CreateCACert(
 	signingCertificate := caCert
 	if parentCertificate != nil {
 		signingCertificate = parentCertificate
+
+		// the intermediate CA never outlives the parent CA
+		if caCert.NotAfter.After(parentCertificate.NotAfter) {
+			caCert.NotAfter = parentCertificate.NotAfter
+		}
+
+		if parentPolicy != nil {
+			caCert.CRLDistributionPoints = parentPolicy.CRLDistributionPoints
+			caCert.OCSPServer = parentPolicy.OCSPServer
+			caCert.IssuingCertificateURL = parentPolicy.IssuingCertificateURL
+		}
 	}
+	caCert.SignatureAlgorithm = SignatureAlgorithm(signingPrivateKey.Public())
 	cert, err = x509.CreateCertificate(rand.Reader, caCert, signingCertificate, publicKey, signingPrivateKey)
 	if err != nil {
 		return nil, err
@@ -280,7 +369,7 @@ func CreateCACert(
 		CertData:     cert,
 		CreationType: creationType,
 	}
-	err = storage.SaveFile(fileData)
+	err = storage.SaveFile(s, fileData)
 	if err != nil {
 		return nil, err
 	}
@@ -295,7 +384,7 @@ func CreateCACert(
 			CreationType: storage.CreationTypeCertificate,
 			CertData:     cert,
 		}
-		err = storage.SaveFile(fileData)
+		err = storage.SaveFile(s, fileData)
 		if err != nil {
 			return nil, err
 		}
@@ -309,19 +398,40 @@ func CreateCACert(
 // Using ioutil.ReadFile() satisfyies the read file.
 func LoadCert(certString []byte) (*x509.Certificate, error) {
 	block, _ := pem.Decode([]byte(string(certString)))
-	cert, _ := x509.ParseCertificate(block.Bytes)
-	return cert, nil
+	if block == nil {
+		return nil, ErrInvalidCert
+	}
+
+	return x509.ParseCertificate(block.Bytes)
 }
 
 // CASignCSR signs an Certificate Signing Request and returns the Certificate as Go bytes.
 //
-// A file is also stored in $CAPATH/certs/<CSR Common Name>/<CSR Common Name>.crt
-func CASignCSR(CACommonName string, csr x509.CertificateRequest, caCert *x509.Certificate, privKey *rsa.PrivateKey, valid int, creationType storage.CreationType) (cert []byte, err error) {
-	if valid == 0 {
-		valid = DefaultValidCert
+// The CSR self-signature is verified before issuing. The CSR public key can be
+// of any algorithm supported by crypto/x509, the certificate is signed with
+// the signature algorithm matching the CA private key.
+//
+// The key usages, extended key usages, validity bounds, allowed Subject
+// Alternative Names and extensions come from the profile. A nil profile uses
+// the DefaultProfile. The validity is also bounded by the policy (nil uses the
+// DefaultPolicy), 0 uses the default validity. The certificate NotAfter never
+// exceeds the caCert NotAfter.
+//
+// A file is also stored in the Storage s as <CA>/certs/<CSR Common Name>/<CSR Common Name>.crt
+func CASignCSR(s storage.Storage, CACommonName string, csr x509.CertificateRequest, caCert *x509.Certificate, privKey crypto.Signer, validity time.Duration, creationType storage.CreationType, profile *Profile, policy *Policy) (cert []byte, err error) {
+	if profile == nil {
+		defaultProfile := BuiltinProfiles()[DefaultProfile]
+		profile = &defaultProfile
+	}
 
-	} else if valid > MaxValidCert || valid < MinValidCert {
-		return nil, errors.New("the certificate valid (min/max) is not between 1 - 825")
+	if policy == nil {
+		defaultPolicy := DefaultPolicy()
+		policy = &defaultPolicy
+	}
+
+	notBefore, notAfter, err := policy.Validity(*profile, validity, caCert)
+	if err != nil {
+		return nil, err
 	}
 
 	fileData := storage.File{
@@ -331,17 +441,16 @@ func CASignCSR(CACommonName string, csr x509.CertificateRequest, caCert *x509.Ce
 		CreationType: creationType,
 	}
 
-	if storage.CheckCertExists(fileData) {
+	if storage.CheckCertExists(s, fileData) {
 		return nil, ErrCertExists
 	}
 
-	if err != nil {
-		return nil, err
+	if err := csr.CheckSignature(); err != nil {
+		return nil, ErrCSRSignature
 	}
 
 	csrTemplate := x509.Certificate{
-		Signature:          csr.Signature,
-		SignatureAlgorithm: csr.SignatureAlgorithm,
+		SignatureAlgorithm: SignatureAlgorithm(privKey.Public()),
 
 		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
 		PublicKey:          csr.PublicKey,
@@ -349,14 +458,17 @@ func CASignCSR(CACommonName string, csr x509.CertificateRequest, caCert *x509.Ce
 		SerialNumber: newSerialNumber(),
 		Issuer:       caCert.Subject,
 		Subject:      csr.Subject,
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(0, 0, valid),
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		IPAddresses:  csr.IPAddresses,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
 	}
 
-	csrTemplate.DNSNames = csr.DNSNames
+	csrTemplate.OCSPServer = policy.OCSPServer
+	csrTemplate.IssuingCertificateURL = policy.IssuingCertificateURL
+	csrTemplate.CRLDistributionPoints = policy.CRLDistributionPoints
+
+	if err := profile.apply(&csrTemplate, csr); err != nil {
+		return nil, err
+	}
 
 	cert, err = x509.CreateCertificate(rand.Reader, &csrTemplate, caCert, csrTemplate.PublicKey, privKey)
 	if err != nil {
@@ -365,7 +477,7 @@ func CASignCSR(CACommonName string, csr x509.CertificateRequest, caCert *x509.Ce
 
 	fileData.CertData = cert
 
-	err = storage.SaveFile(fileData)
+	err = storage.SaveFile(s, fileData)
 
 	if err != nil {
 		return nil, err
@@ -376,14 +488,34 @@ func CASignCSR(CACommonName string, csr x509.CertificateRequest, caCert *x509.Ce
 }
 
 // RevokeCertificate is used to revoke a certificate (added to the revoked list)
-func RevokeCertificate(CACommonName string, certificateList []x509.RevocationListEntry, caCert *x509.Certificate, privKey *rsa.PrivateKey) (crl []byte, err error) {
+//
+// It creates the CRL with CreateCRL, valid for one day.
+func RevokeCertificate(s storage.Storage, CACommonName string, certificateList []x509.RevocationListEntry, caCert *x509.Certificate, privKey crypto.Signer) (crl []byte, err error) {
+	return CreateCRL(s, CACommonName, certificateList, caCert, privKey, Day)
+}
+
+// CreateCRL creates the Certificate Revocation List with the revoked
+// certificates, valid (NextUpdate) for validity.
+//
+// The certificateList entries can be created with RevocationEntry. The
+// extensions of entries from a parsed CRL are kept. The CRL number increases
+// monotonically and is kept in the Storage s as <CA>/ca/crlnumber.
+//
+// A file is also stored in the Storage s as <CA>/ca/<CA>.crl
+func CreateCRL(s storage.Storage, CACommonName string, certificateList []x509.RevocationListEntry, caCert *x509.Certificate, privKey crypto.Signer, validity time.Duration) (crl []byte, err error) {
 
+	number, err := nextCRLNumber(s, CACommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
 	crlTemplate := x509.RevocationList{
-		SignatureAlgorithm:        caCert.SignatureAlgorithm,
-		RevokedCertificateEntries: certificateList,
-		Number:                    newSerialNumber(),
-		ThisUpdate:                time.Now(),
-		NextUpdate:                time.Now().AddDate(0, 0, 1),
+		SignatureAlgorithm:        SignatureAlgorithm(privKey.Public()),
+		RevokedCertificateEntries: preserveEntryExtensions(certificateList),
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
 	}
 
 	crlByte, err := x509.CreateRevocationList(rand.Reader, &crlTemplate, caCert, privKey)
@@ -399,11 +531,40 @@ func RevokeCertificate(CACommonName string, certificateList []x509.RevocationLis
 		CreationType: storage.CreationTypeCA,
 	}
 
-	err = storage.SaveFile(fileData)
+	err = storage.SaveFile(s, fileData)
 
 	if err != nil {
 		return nil, err
 	}
 
+	err = s.Put(filepath.Join(CACommonName, "ca", crlNumberFile), []byte(number.String()+"\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+
 	return crlByte, err
 }
+
+// nextCRLNumber returns the number after the one kept in <CA>/ca/crlnumber
+// and the current CRL number
+func nextCRLNumber(s storage.Storage, CACommonName string) (*big.Int, error) {
+	number := big.NewInt(0)
+
+	data, err := s.Get(filepath.Join(CACommonName, "ca", crlNumberFile))
+	if err == nil {
+		if _, ok := number.SetString(strings.TrimSpace(string(data)), 10); !ok {
+			return nil, fmt.Errorf("invalid CRL number in %s", crlNumberFile)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// CRLs created before the crlnumber file have random numbers
+	if crlString, err := storage.LoadFile(s, CACommonName, "ca", CACommonName+crlExtension); err == nil {
+		if current, err := LoadCRL(crlString); err == nil && current.Number != nil && current.Number.Cmp(number) > 0 {
+			number.Set(current.Number)
+		}
+	}
+
+	return number.Add(number, big.NewInt(1)), nil
+}
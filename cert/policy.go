@@ -0,0 +1,195 @@
+package cert
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Day is the duration of one valid day
+const Day = 24 * time.Hour
+
+// ErrCAValidity means that the Certificate Authority expires before the
+// minimum certificate validity.
+var ErrCAValidity = errors.New("the Certificate Authority expires before the minimum certificate validity")
+
+// Duration is a time.Duration encoded in JSON as a string, for example
+// "9528h" or "15m".
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+
+	return nil
+}
+
+// Policy represents the issuance policy of a Certificate Authority
+//
+// Zero validity values use the DefaultPolicy values, except Backdate.
+type Policy struct {
+	MinValidity           Duration `json:"min_validity" swaggertype:"string" example:"24h"`                                     // Minimum certificate validity (default: 24h)
+	MaxValidity           Duration `json:"max_validity" swaggertype:"string" example:"19800h"`                                  // Maximum certificate validity (default: 825 days)
+	DefaultValidity       Duration `json:"default_validity" swaggertype:"string" example:"9528h"`                               // Default certificate validity (default: 397 days)
+	MaxCAValidity         Duration `json:"max_ca_validity" swaggertype:"string" example:"219000h"`                              // Maximum intermediate CA certificate validity (default: 9125 days)
+	CRLValidity           Duration `json:"crl_validity" swaggertype:"string" example:"24h"`                                     // CRL validity, NextUpdate after ThisUpdate (default: 24h)
+	Backdate              Duration `json:"backdate" swaggertype:"string" example:"1m"`                                          // NotBefore backdate for clock skew
+	CRLDistributionPoints []string `json:"crl_distribution_points,omitempty" example:"http://goca.example.com/crl/root-ca.crl"` // CRL Distribution Point URLs added to the issued certificates
+	IssuingCertificateURL []string `json:"issuing_certificate_url,omitempty" example:"http://goca.example.com/root-ca.cer"`     // CA Issuers URLs added to the issued certificates (AIA)
+	OCSPServer            []string `json:"ocsp_server,omitempty" example:"http://goca.example.com/ocsp/root-ca"`                // OCSP responder URLs added to the issued certificates (AIA)
+	OCSPSigner            string   `json:"ocsp_signer,omitempty" example:"ocsp.root-ca"`                                        // Delegated OCSP signing certificate common name (default: the CA signs)
+	AllowCAKeyExport      bool     `json:"allow_ca_key_export,omitempty" example:"false"`                                       // Allows the export of the Certificate Authority private key
+}
+
+// DefaultPolicy returns the policy used when the Certificate Authority has no
+// policy.
+func DefaultPolicy() Policy {
+	return Policy{
+		MinValidity:     Duration(time.Duration(MinValidCert) * Day),
+		MaxValidity:     Duration(time.Duration(MaxValidCert) * Day),
+		DefaultValidity: Duration(time.Duration(DefaultValidCert) * Day),
+		MaxCAValidity:   Duration(time.Duration(MaxValidCA) * Day),
+		CRLValidity:     Duration(Day),
+	}
+}
+
+// normalize returns the policy with the zero values set from the DefaultPolicy
+func (p Policy) normalize() Policy {
+	defaults := DefaultPolicy()
+
+	if p.MinValidity == 0 {
+		p.MinValidity = defaults.MinValidity
+	}
+	if p.MaxValidity == 0 {
+		p.MaxValidity = defaults.MaxValidity
+	}
+	if p.DefaultValidity == 0 {
+		p.DefaultValidity = defaults.DefaultValidity
+	}
+	if p.MaxCAValidity == 0 {
+		p.MaxCAValidity = defaults.MaxCAValidity
+	}
+	if p.CRLValidity == 0 {
+		p.CRLValidity = defaults.CRLValidity
+	}
+
+	return p
+}
+
+// Validate checks the policy validity bounds
+func (p Policy) Validate() error {
+	if p.MinValidity < 0 || p.MaxValidity < 0 || p.DefaultValidity < 0 || p.MaxCAValidity < 0 || p.CRLValidity < 0 || p.Backdate < 0 {
+		return errors.New("the policy durations cannot be negative")
+	}
+
+	n := p.normalize()
+	if n.MinValidity > n.MaxValidity || n.DefaultValidity < n.MinValidity || n.DefaultValidity > n.MaxValidity {
+		return fmt.Errorf("invalid policy validity: min %s, max %s, default %s",
+			time.Duration(n.MinValidity), time.Duration(n.MaxValidity), time.Duration(n.DefaultValidity))
+	}
+
+	return nil
+}
+
+// CRLNextUpdate returns the duration between the CRL ThisUpdate and NextUpdate
+func (p Policy) CRLNextUpdate() time.Duration {
+	return time.Duration(p.normalize().CRLValidity)
+}
+
+// CAValidity checks the valid days of a Certificate Authority certificate
+// signed under the policy
+func (p Policy) CAValidity(validDays int) error {
+	maxCAValidity := time.Duration(p.normalize().MaxCAValidity)
+	if time.Duration(validDays)*Day > maxCAValidity {
+		return fmt.Errorf("the Certificate Authority valid days exceeds the maximum of %d days", maxCAValidity/Day)
+	}
+
+	return nil
+}
+
+// bounds returns the minimum, maximum and default validity of the
+// certificates issued with the profile under the policy
+func (p Policy) bounds(profile Profile) (minValidity, maxValidity, defaultValidity time.Duration, err error) {
+	n := p.normalize()
+
+	minValidity = time.Duration(n.MinValidity)
+	maxValidity = time.Duration(n.MaxValidity)
+	defaultValidity = time.Duration(n.DefaultValidity)
+	if profile.IsCA {
+		maxValidity = time.Duration(n.MaxCAValidity)
+	}
+
+	if profile.MinValidity != 0 && time.Duration(profile.MinValidity) > minValidity {
+		minValidity = time.Duration(profile.MinValidity)
+	}
+	if profile.MaxValidity != 0 && time.Duration(profile.MaxValidity) < maxValidity {
+		maxValidity = time.Duration(profile.MaxValidity)
+	}
+	if profile.DefaultValidity != 0 {
+		defaultValidity = time.Duration(profile.DefaultValidity)
+	}
+
+	if minValidity > maxValidity {
+		return 0, 0, 0, fmt.Errorf("the profile %s validity is not allowed by the Certificate Authority policy", profile.Name)
+	}
+
+	if defaultValidity < minValidity {
+		defaultValidity = minValidity
+	}
+	if defaultValidity > maxValidity {
+		defaultValidity = maxValidity
+	}
+
+	return minValidity, maxValidity, defaultValidity, nil
+}
+
+// Validity returns the NotBefore and NotAfter of a certificate issued now
+// with the profile under the policy, 0 validity uses the default validity.
+// The NotAfter never exceeds the caCert NotAfter.
+func (p Policy) Validity(profile Profile, validity time.Duration, caCert *x509.Certificate) (notBefore, notAfter time.Time, err error) {
+	minValidity, maxValidity, defaultValidity, err := p.bounds(profile)
+	if err != nil {
+		return notBefore, notAfter, err
+	}
+
+	if validity == 0 {
+		validity = defaultValidity
+
+	} else if validity > maxValidity || validity < minValidity {
+		return notBefore, notAfter, fmt.Errorf("the certificate validity (min/max) is not between %s - %s", minValidity, maxValidity)
+	}
+
+	now := time.Now()
+	notBefore = now.Add(-time.Duration(p.Backdate))
+	if notBefore.Before(caCert.NotBefore) {
+		notBefore = caCert.NotBefore
+	}
+
+	// the certificate never outlives the Certificate Authority
+	notAfter = now.Add(validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+		if notAfter.Sub(now) < minValidity {
+			return notBefore, notAfter, ErrCAValidity
+		}
+	}
+
+	return notBefore, notAfter, nil
+}
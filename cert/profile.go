@@ -0,0 +1,269 @@
+package cert
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Built-in profile names
+const (
+	// DefaultProfile is used when no profile is requested: TLS server and
+	// client authentication, as GoCA always issued certificates.
+	DefaultProfile     string = "default"
+	TLSServerProfile   string = "tls-server"
+	TLSClientProfile   string = "tls-client"
+	CodeSigningProfile string = "code-signing"
+	EmailProfile       string = "email"
+	OCSPSigningProfile string = "ocsp-signing"
+	SubCAProfile       string = "sub-ca"
+)
+
+// Subject Alternative Name types
+const (
+	SANDNS   string = "dns"
+	SANIP    string = "ip"
+	SANEmail string = "email"
+	SANURI   string = "uri"
+)
+
+// ErrProfileNotFound means that the requested profile does not exist
+var ErrProfileNotFound = errors.New("the requested certificate profile does not exist")
+
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+	"cert_sign":          x509.KeyUsageCertSign,
+	"crl_sign":           x509.KeyUsageCRLSign,
+}
+
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// oidOCSPNoCheck is the id-pkix-ocsp-nocheck extension (RFC 6960)
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// Extension represents an additional certificate extension
+type Extension struct {
+	ID       string `json:"id" example:"1.3.6.1.5.5.7.48.1.5"`                         // Extension Object Identifier
+	Critical bool   `json:"critical" example:"false"`                                  // Critical extension
+	Value    []byte `json:"value" swaggertype:"string" format:"base64" example:"BQA="` // DER encoded extension value (base64 in JSON)
+}
+
+// Profile represents a certificate issuance profile
+//
+// The profile validity is bounded by the Certificate Authority Policy.
+// Subject Alternative Names of types not allowed by the profile are not
+// copied from the CSR to the certificate. The "key_encipherment" key usage is
+// only used with RSA keys.
+type Profile struct {
+	Name            string      `json:"name" example:"tls-server"`                                       // Profile name
+	KeyUsage        []string    `json:"key_usage" example:"digital_signature,key_encipherment"`          // Key usages
+	ExtKeyUsage     []string    `json:"ext_key_usage" example:"server_auth"`                             // Extended key usages
+	MinValidity     Duration    `json:"min_validity,omitempty" swaggertype:"string" example:"1h"`        // Minimum validity (default: policy minimum)
+	MaxValidity     Duration    `json:"max_validity,omitempty" swaggertype:"string" example:"9552h"`     // Maximum validity (default: policy maximum)
+	DefaultValidity Duration    `json:"default_validity,omitempty" swaggertype:"string" example:"9528h"` // Default validity (default: policy default)
+	AllowedSANs     []string    `json:"allowed_sans" example:"dns,ip"`                                   // Allowed Subject Alternative Name types: dns, ip, email, uri
+	IsCA            bool        `json:"is_ca" example:"false"`                                           // Certificate Authority certificate
+	MaxPathLen      int         `json:"max_path_len" example:"-1"`                                       // CA maximum path length, -1 is unlimited
+	Extensions      []Extension `json:"extensions,omitempty"`                                            // Additional extensions
+}
+
+// BuiltinProfiles returns the profiles available in every Certificate Authority
+func BuiltinProfiles() map[string]Profile {
+	return map[string]Profile{
+		DefaultProfile: {
+			Name:        DefaultProfile,
+			KeyUsage:    []string{"digital_signature", "key_encipherment"},
+			ExtKeyUsage: []string{"server_auth", "client_auth"},
+			AllowedSANs: []string{SANDNS, SANIP, SANEmail, SANURI},
+		},
+		TLSServerProfile: {
+			Name:            TLSServerProfile,
+			KeyUsage:        []string{"digital_signature", "key_encipherment"},
+			ExtKeyUsage:     []string{"server_auth"},
+			MaxValidity:     Duration(398 * Day),
+			DefaultValidity: Duration(397 * Day),
+			AllowedSANs:     []string{SANDNS, SANIP},
+		},
+		TLSClientProfile: {
+			Name:        TLSClientProfile,
+			KeyUsage:    []string{"digital_signature"},
+			ExtKeyUsage: []string{"client_auth"},
+			AllowedSANs: []string{SANDNS, SANIP, SANEmail, SANURI},
+		},
+		CodeSigningProfile: {
+			Name:            CodeSigningProfile,
+			KeyUsage:        []string{"digital_signature"},
+			ExtKeyUsage:     []string{"code_signing"},
+			MaxValidity:     Duration(1095 * Day),
+			DefaultValidity: Duration(365 * Day),
+		},
+		EmailProfile: {
+			Name:        EmailProfile,
+			KeyUsage:    []string{"digital_signature", "content_commitment", "key_encipherment"},
+			ExtKeyUsage: []string{"email_protection"},
+			AllowedSANs: []string{SANEmail},
+		},
+		OCSPSigningProfile: {
+			Name:            OCSPSigningProfile,
+			KeyUsage:        []string{"digital_signature"},
+			ExtKeyUsage:     []string{"ocsp_signing"},
+			MaxValidity:     Duration(90 * Day),
+			DefaultValidity: Duration(30 * Day),
+			Extensions: []Extension{
+				{ID: oidOCSPNoCheck.String(), Value: asn1.NullBytes},
+			},
+		},
+		SubCAProfile: {
+			Name:            SubCAProfile,
+			KeyUsage:        []string{"digital_signature", "cert_sign", "crl_sign"},
+			MaxValidity:     Duration(3650 * Day),
+			DefaultValidity: Duration(1825 * Day),
+			AllowedSANs:     []string{SANDNS, SANIP},
+			IsCA:            true,
+			MaxPathLen:      -1,
+		},
+	}
+}
+
+// Validate checks the profile names, usages, SAN types, validity and extensions
+func (p Profile) Validate() error {
+	if p.Name == "" {
+		return errors.New("the profile name is required")
+	}
+
+	for _, usage := range p.KeyUsage {
+		if _, ok := keyUsageNames[usage]; !ok {
+			return fmt.Errorf("unknown key usage %q", usage)
+		}
+	}
+
+	for _, usage := range p.ExtKeyUsage {
+		if _, ok := extKeyUsageNames[usage]; !ok {
+			return fmt.Errorf("unknown extended key usage %q", usage)
+		}
+	}
+
+	for _, san := range p.AllowedSANs {
+		switch san {
+		case SANDNS, SANIP, SANEmail, SANURI:
+		default:
+			return fmt.Errorf("unknown Subject Alternative Name type %q", san)
+		}
+	}
+
+	if p.MinValidity < 0 || p.MaxValidity < 0 || p.DefaultValidity < 0 {
+		return errors.New("the profile validity cannot be negative")
+	}
+	if p.MaxValidity != 0 && (p.MinValidity > p.MaxValidity || p.DefaultValidity > p.MaxValidity) {
+		return fmt.Errorf("invalid profile validity: min %s, max %s, default %s",
+			time.Duration(p.MinValidity), time.Duration(p.MaxValidity), time.Duration(p.DefaultValidity))
+	}
+
+	if _, err := p.extensions(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p Profile) allowsSAN(sanType string) bool {
+	for _, san := range p.AllowedSANs {
+		if san == sanType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p Profile) extensions() ([]pkix.Extension, error) {
+	var extensions []pkix.Extension
+
+	for _, extension := range p.Extensions {
+		var oid asn1.ObjectIdentifier
+		for _, arc := range strings.Split(extension.ID, ".") {
+			n, err := strconv.Atoi(arc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extension id %q", extension.ID)
+			}
+			oid = append(oid, n)
+		}
+		if len(oid) < 2 {
+			return nil, fmt.Errorf("invalid extension id %q", extension.ID)
+		}
+
+		extensions = append(extensions, pkix.Extension{
+			Id:       oid,
+			Critical: extension.Critical,
+			Value:    extension.Value,
+		})
+	}
+
+	return extensions, nil
+}
+
+// apply sets the profile usages, SANs and extensions in the certificate
+// template from the CSR
+func (p Profile) apply(template *x509.Certificate, csr x509.CertificateRequest) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	_, isRSA := csr.PublicKey.(*rsa.PublicKey)
+	for _, usage := range p.KeyUsage {
+		if usage == "key_encipherment" && !isRSA {
+			continue
+		}
+		template.KeyUsage |= keyUsageNames[usage]
+	}
+
+	for _, usage := range p.ExtKeyUsage {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, extKeyUsageNames[usage])
+	}
+
+	if p.allowsSAN(SANDNS) {
+		template.DNSNames = csr.DNSNames
+	}
+	if p.allowsSAN(SANIP) {
+		template.IPAddresses = csr.IPAddresses
+	}
+	if p.allowsSAN(SANEmail) {
+		template.EmailAddresses = csr.EmailAddresses
+	}
+	if p.allowsSAN(SANURI) {
+		template.URIs = csr.URIs
+	}
+
+	if p.IsCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.MaxPathLen = p.MaxPathLen
+		template.MaxPathLenZero = p.MaxPathLen == 0
+	}
+
+	extensions, err := p.extensions()
+	if err != nil {
+		return err
+	}
+	template.ExtraExtensions = extensions
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package cert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// RevocationReason is a RFC 5280 CRL entry reason code
+type RevocationReason int
+
+// RFC 5280 revocation reasons
+const (
+	Unspecified          RevocationReason = 0
+	KeyCompromise        RevocationReason = 1
+	CACompromise         RevocationReason = 2
+	AffiliationChanged   RevocationReason = 3
+	Superseded           RevocationReason = 4
+	CessationOfOperation RevocationReason = 5
+	CertificateHold      RevocationReason = 6
+	RemoveFromCRL        RevocationReason = 8
+	PrivilegeWithdrawn   RevocationReason = 9
+	AACompromise         RevocationReason = 10
+)
+
+// ErrRevocationReason means that the revocation reason is unknown or cannot
+// be used to revoke a certificate.
+var ErrRevocationReason = errors.New("invalid revocation reason")
+
+var revocationReasonNames = map[RevocationReason]string{
+	Unspecified:          "unspecified",
+	KeyCompromise:        "key_compromise",
+	CACompromise:         "ca_compromise",
+	AffiliationChanged:   "affiliation_changed",
+	Superseded:           "superseded",
+	CessationOfOperation: "cessation_of_operation",
+	CertificateHold:      "certificate_hold",
+	RemoveFromCRL:        "remove_from_crl",
+	PrivilegeWithdrawn:   "privilege_withdrawn",
+	AACompromise:         "aa_compromise",
+}
+
+var (
+	oidExtensionReasonCode     = asn1.ObjectIdentifier{2, 5, 29, 21}
+	oidExtensionInvalidityDate = asn1.ObjectIdentifier{2, 5, 29, 24}
+)
+
+// String returns the reason name, for example "key_compromise"
+func (r RevocationReason) String() string {
+	if name, ok := revocationReasonNames[r]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// ParseRevocationReason returns the reason from its name, as "key_compromise"
+// or the RFC 5280 "keyCompromise".
+func ParseRevocationReason(name string) (RevocationReason, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(name, "_", ""))
+
+	for reason, reasonName := range revocationReasonNames {
+		if normalized == strings.ReplaceAll(reasonName, "_", "") {
+			return reason, nil
+		}
+	}
+
+	return Unspecified, ErrRevocationReason
+}
+
+// RevocationEntry creates the CRL entry of the serial number with the reason
+// and the invalidity date (RFC 5280 5.3.2), omitted when it is zero.
+func RevocationEntry(serialNumber *big.Int, reason RevocationReason, invalidityDate time.Time) (x509.RevocationListEntry, error) {
+	if _, ok := revocationReasonNames[reason]; !ok || reason == RemoveFromCRL {
+		return x509.RevocationListEntry{}, ErrRevocationReason
+	}
+
+	entry := x509.RevocationListEntry{
+		SerialNumber:   serialNumber,
+		RevocationTime: time.Now(),
+		ReasonCode:     int(reason),
+	}
+
+	if !invalidityDate.IsZero() {
+		value, err := asn1.MarshalWithParams(invalidityDate.UTC(), "generalized")
+		if err != nil {
+			return x509.RevocationListEntry{}, err
+		}
+
+		entry.ExtraExtensions = []pkix.Extension{{Id: oidExtensionInvalidityDate, Value: value}}
+	}
+
+	return entry, nil
+}
+
+// InvalidityDate returns the CRL entry invalidity date, zero when absent
+func InvalidityDate(entry x509.RevocationListEntry) time.Time {
+	extensions := entry.ExtraExtensions
+	if len(extensions) == 0 {
+		extensions = entry.Extensions
+	}
+
+	for _, extension := range extensions {
+		if extension.Id.Equal(oidExtensionInvalidityDate) {
+			var invalidityDate time.Time
+			if _, err := asn1.UnmarshalWithParams(extension.Value, &invalidityDate, "generalized"); err == nil {
+				return invalidityDate
+			}
+		}
+	}
+
+	return time.Time{}
+}
+
+// preserveEntryExtensions copies the extensions of the parsed CRL entries to
+// ExtraExtensions, so they are kept when the CRL is created again
+func preserveEntryExtensions(entries []x509.RevocationListEntry) []x509.RevocationListEntry {
+	preserved := make([]x509.RevocationListEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		if len(entry.ExtraExtensions) == 0 {
+			for _, extension := range entry.Extensions {
+				if !extension.Id.Equal(oidExtensionReasonCode) {
+					entry.ExtraExtensions = append(entry.ExtraExtensions, extension)
+				}
+			}
+		}
+		preserved = append(preserved, entry)
+	}
+
+	return preserved
+}
@@ -0,0 +1,97 @@
+package goca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultCRLPublisherInterval is the time between the CRLPublisher checks
+const defaultCRLPublisherInterval = time.Hour
+
+// CRLPublisher signs again the Certificate Revocation Lists of all the
+// Certificate Authorities before they expire.
+//
+// Each CRL is signed again when its NextUpdate is within RenewBefore, using
+// the CA policy CRL validity and the next CRL number.
+type CRLPublisher struct {
+	Interval    time.Duration // Time between the checks (default: 1 hour)
+	RenewBefore time.Duration // Signs again the CRLs expiring within (default: half of the CA CRL validity)
+	Options     []Option      // Options to list and load the Certificate Authorities
+	OnError     func(error)   // Receives the errors of the checks run by Run
+}
+
+// PublishOnce checks the CRLs of all the Certificate Authorities once,
+// returning the errors of the Certificate Authorities that failed.
+func (p *CRLPublisher) PublishOnce() error {
+	var errs []error
+
+	for _, commonName := range List(p.Options...) {
+		ca, err := Load(commonName, p.Options...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", commonName, err))
+			continue
+		}
+
+		// intermediate CA waiting for the signed certificate
+		if ca.GoCertificate() == nil {
+			continue
+		}
+
+		renew, err := p.needsRenew(ca)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", commonName, err))
+			continue
+		}
+
+		if renew {
+			if err := ca.RegenerateCRL(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", commonName, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Run checks the CRLs immediately and every Interval until ctx is done.
+func (p *CRLPublisher) Run(ctx context.Context) error {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultCRLPublisherInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.PublishOnce(); err != nil && p.OnError != nil {
+			p.OnError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *CRLPublisher) needsRenew(ca CA) (bool, error) {
+	crl := ca.GoCRL()
+	if crl == nil {
+		return true, nil
+	}
+
+	renewBefore := p.RenewBefore
+	if renewBefore <= 0 {
+		policy, err := ca.Policy()
+		if err != nil {
+			return false, err
+		}
+		renewBefore = policy.CRLNextUpdate() / 2
+	}
+
+	return time.Until(crl.NextUpdate) < renewBefore, nil
+}
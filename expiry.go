@@ -0,0 +1,188 @@
+package goca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultExpiryMonitorInterval is the time between the ExpiryMonitor checks
+const defaultExpiryMonitorInterval = time.Hour
+
+// defaultExpiryWindow is the default ExpiryMonitor window of the upcoming
+// expirations
+const defaultExpiryWindow = 30 * 24 * time.Hour
+
+// Expiration is a CA certificate or a certificate issued by a Certificate
+// Authority that expires soon or has expired.
+type Expiration struct {
+	CA           string    `json:"ca" example:"go-root"`                                               // Common name of the Certificate Authority
+	CommonName   string    `json:"common_name" example:"intranet.go-root"`                             // Common name of the certificate
+	SerialNumber string    `json:"serial_number" example:"338255903472757769326153358304310617728"`    // Serial number of the certificate
+	IsCA         bool      `json:"is_ca"`                                                              // The certificate is the Certificate Authority certificate
+	NotAfter     time.Time `json:"not_after"`                                                          // Expiration of the certificate
+	Expired      bool      `json:"expired"`                                                            // The certificate has expired
+	Path         string    `json:"path" example:"go-root/certs/intranet.go-root/intranet.go-root.crt"` // Storage path of the certificate file
+}
+
+// ScanExpirations returns the expirations within the duration of the CA
+// certificates and of the current, not revoked, certificates of all the
+// Certificate Authorities, the expired certificates included. The expirations
+// are sorted by NotAfter and the errors of the Certificate Authorities that
+// failed are returned with the expirations of the others.
+func ScanExpirations(within time.Duration, opts ...Option) ([]Expiration, error) {
+	var (
+		expirations []Expiration
+		records     = map[string][]CertificateRecord{}
+		caSerials   = map[string]bool{}
+		errs        []error
+		now         = time.Now()
+		deadline    = now.Add(within)
+	)
+
+	for _, commonName := range List(opts...) {
+		ca, err := Load(commonName, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", commonName, err))
+			continue
+		}
+
+		// an intermediate CA waiting for the signed certificate has none
+		if certificate := ca.GoCertificate(); certificate != nil {
+			caSerials[certificate.SerialNumber.String()] = true
+
+			if certificate.NotAfter.Before(deadline) {
+				expirations = append(expirations, Expiration{
+					CA:           commonName,
+					CommonName:   certificate.Subject.CommonName,
+					SerialNumber: certificate.SerialNumber.String(),
+					IsCA:         true,
+					NotAfter:     certificate.NotAfter,
+					Expired:      now.After(certificate.NotAfter),
+					Path:         filepath.Join(commonName, "ca", commonName+certExtension),
+				})
+			}
+		}
+
+		if records[commonName], err = ca.CertificateRecords(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", commonName, err))
+		}
+	}
+
+	for commonName, caRecords := range records {
+		for _, record := range caRecords {
+			// the intermediate CA certificates are reported by their CA
+			if record.Archived() || record.Status != CertificateValid || caSerials[record.SerialNumber] || !record.NotAfter.Before(deadline) {
+				continue
+			}
+
+			expirations = append(expirations, Expiration{
+				CA:           commonName,
+				CommonName:   record.CommonName,
+				SerialNumber: record.SerialNumber,
+				NotAfter:     record.NotAfter,
+				Expired:      now.After(record.NotAfter),
+				Path:         record.Path,
+			})
+		}
+	}
+
+	slices.SortFunc(expirations, func(a, b Expiration) int {
+		return a.NotAfter.Compare(b.NotAfter)
+	})
+
+	return expirations, errors.Join(errs...)
+}
+
+// ExpirySink receives the expirations found by the ExpiryMonitor.
+type ExpirySink interface {
+	Notify(ctx context.Context, expiration Expiration) error
+}
+
+// ExpirySinkFunc is a function used as ExpirySink.
+type ExpirySinkFunc func(ctx context.Context, expiration Expiration) error
+
+// Notify calls f(ctx, expiration).
+func (f ExpirySinkFunc) Notify(ctx context.Context, expiration Expiration) error {
+	return f(ctx, expiration)
+}
+
+// ExpiryMonitor scans the expirations of all the Certificate Authorities and
+// notifies them to the sinks.
+//
+// Each sink is notified once of a certificate expiring within the window and
+// once again when it has expired. The failed notifications are sent again in
+// the next check.
+type ExpiryMonitor struct {
+	Interval time.Duration // Time between the checks (default: 1 hour)
+	Within   time.Duration // Window of the upcoming expirations (default: 30 days)
+	Options  []Option      // Options to list and load the Certificate Authorities
+	Sinks    []ExpirySink  // Receivers of the expirations
+	OnError  func(error)   // Receives the errors of the checks run by Run
+
+	mu       sync.Mutex
+	notified map[string]bool
+}
+
+// CheckOnce scans the expirations once and notifies the new ones to the
+// sinks, returning the errors of the scan and of the notifications.
+func (m *ExpiryMonitor) CheckOnce(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	within := m.Within
+	if within <= 0 {
+		within = defaultExpiryWindow
+	}
+
+	expirations, err := ScanExpirations(within, m.Options...)
+	errs := []error{err}
+
+	if m.notified == nil {
+		m.notified = map[string]bool{}
+	}
+
+	for _, expiration := range expirations {
+		for i, sink := range m.Sinks {
+			key := fmt.Sprintf("%d/%s/%s/%t", i, expiration.CA, expiration.SerialNumber, expiration.Expired)
+			if m.notified[key] {
+				continue
+			}
+
+			if err := sink.Notify(ctx, expiration); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", expiration.CA, expiration.CommonName, err))
+				continue
+			}
+			m.notified[key] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Run checks the expirations immediately and every Interval until ctx is done.
+func (m *ExpiryMonitor) Run(ctx context.Context) error {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultExpiryMonitorInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.CheckOnce(ctx); err != nil && m.OnError != nil {
+			m.OnError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package goca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+
+	"github.com/kairoaraujo/goca/v2/key"
+)
+
+// KeyFormat is the encoding of an exported private key
+type KeyFormat string
+
+// Private key export formats
+const (
+	KeyFormatPEM    KeyFormat = "pem"    // PEM encoded PKCS #8, not encrypted
+	KeyFormatPKCS8  KeyFormat = "pkcs8"  // PEM encoded encrypted PKCS #8, as the GoCA encrypted private keys
+	KeyFormatPKCS12 KeyFormat = "pkcs12" // Password protected PKCS #12 with the certificate and the CA chain
+)
+
+// ErrKeyExportNotAllowed means that the policy of the Certificate Authority
+// does not allow the export of its private key (Policy.AllowCAKeyExport).
+var ErrKeyExportNotAllowed = errors.New("the Certificate Authority policy does not allow the private key export")
+
+// ErrKeyNotAvailable means that the private key cannot be exported: it is
+// kept outside of the Storage (signed CSR or crypto.Signer) or it is encrypted
+// without the passphrase.
+var ErrKeyNotAvailable = errors.New("the private key is not available for export")
+
+// ErrKeyExportFormat means that the key export format is not supported
+var ErrKeyExportFormat = errors.New("unsupported key export format, use one of 'pem', 'pkcs8' or 'pkcs12'")
+
+// ErrKeyExportPassword means that the key export format requires a password
+var ErrKeyExportPassword = errors.New("the key export format requires a password")
+
+// ExportCertificateKey returns the private key of the certificate issued by
+// the Certificate Authority encoded in the format, encrypted with the
+// password for KeyFormatPKCS8 and KeyFormatPKCS12.
+//
+// The export is reported to the observers as OperationExportKey.
+func (c *CA) ExportCertificateKey(commonName string, format KeyFormat, password []byte) ([]byte, error) {
+	certificate, err := c.loadCertificate(commonName)
+	if err != nil {
+		c.notify(OperationExportKey, commonName, nil, err)
+		return nil, err
+	}
+
+	exported, err := c.exportKey(certificate.privateKey, certificate.certificate, format, password)
+	c.notify(OperationExportKey, commonName, certificate.certificate, err)
+
+	return exported, err
+}
+
+// ExportPrivateKey is like ExportCertificateKey for the private key of the
+// Certificate Authority, it returns ErrKeyExportNotAllowed unless the policy
+// AllowCAKeyExport is set.
+func (c *CA) ExportPrivateKey(format KeyFormat, password []byte) ([]byte, error) {
+	exported, err := c.exportPrivateKey(format, password)
+	c.notify(OperationExportKey, c.CommonName, c.Data.certificate, err)
+
+	return exported, err
+}
+
+func (c *CA) exportPrivateKey(format KeyFormat, password []byte) ([]byte, error) {
+	policy, err := c.issuancePolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if !policy.AllowCAKeyExport {
+		return nil, ErrKeyExportNotAllowed
+	}
+
+	return c.exportKey(c.Data.privateKey, c.Data.certificate, format, password)
+}
+
+// exportKey encodes the private key of the certificate issued by the
+// Certificate Authority
+func (c *CA) exportKey(privateKey crypto.Signer, certificate *x509.Certificate, format KeyFormat, password []byte) ([]byte, error) {
+	// keys held by a crypto.Signer, such as a HSM, are not exportable
+	switch privateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, ErrKeyNotAvailable
+	}
+
+	switch format {
+	case KeyFormatPEM:
+		return key.EncodePrivateKey(privateKey, nil)
+
+	case KeyFormatPKCS8:
+		if len(password) == 0 {
+			return nil, ErrKeyExportPassword
+		}
+		return key.EncodePrivateKey(privateKey, password)
+
+	case KeyFormatPKCS12:
+		if len(password) == 0 {
+			return nil, ErrKeyExportPassword
+		}
+		if certificate == nil {
+			return nil, ErrCertLoadNotFound
+		}
+
+		chain, err := c.chain()
+		if err != nil {
+			return nil, err
+		}
+		// the CA chain of the CA certificate starts with its parent
+		if len(chain) > 0 && chain[0].Equal(certificate) {
+			chain = chain[1:]
+		}
+
+		return pkcs12.Modern.Encode(privateKey, certificate, chain, string(password))
+	}
+
+	return nil, ErrKeyExportFormat
+}
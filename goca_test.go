@@ -1,12 +1,34 @@
 package goca
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/key"
+	"golang.org/x/crypto/ocsp"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
 )
 
 const CaTestFolder string = "./DoNotUseThisCAPATHTestOnly"
@@ -246,3 +268,1981 @@ func TestFunctionalRevokeCertificate(t *testing.T) {
 		t.Error("CRL X509 file is empty!")
 	}
 }
+
+func TestFunctionalMemoryStorage(t *testing.T) {
+	store := NewMemoryStorage()
+
+	id := Identity{
+		Organization:       "Memory CA Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		Intermediate:       false,
+	}
+
+	MemoryCA, err := New("go-memory.ca", id, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(CaTestFolder, "go-memory.ca")); !os.IsNotExist(err) {
+		t.Error("Memory CA was written to $CAPATH")
+	}
+
+	_, err = MemoryCA.IssueCertificate("w3.go-memory.ca", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(List(WithStorage(store)), []string{"go-memory.ca"}) {
+		t.Errorf("Expected only go-memory.ca in the storage but got: %q", List(WithStorage(store)))
+	}
+
+	LoadedCA, err := Load("go-memory.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if LoadedCA.GetCertificate() != MemoryCA.GetCertificate() {
+		t.Error("Loaded CA Certificate is not the same as the created one")
+	}
+
+	if !slices.Contains(LoadedCA.ListCertificates(), "w3.go-memory.ca") {
+		t.Errorf("Expected w3.go-memory.ca in the certificates but got: %q", LoadedCA.ListCertificates())
+	}
+
+	if _, err := Load("go-memory.ca"); err != ErrCALoadNotFound {
+		t.Errorf("Expected ErrCALoadNotFound loading from $CAPATH but got: %v", err)
+	}
+}
+
+func TestFunctionalKeyAlgorithms(t *testing.T) {
+	store := NewMemoryStorage()
+
+	id := Identity{
+		Organization:       "Key Algorithms Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP384,
+	}
+
+	ECRootCA, err := New("go-ecdsa.ca", id, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ECRootCA.GoPrivateKey().(*ecdsa.PrivateKey); !ok {
+		t.Errorf("Expected an ECDSA CA key but got: %T", ECRootCA.GoPrivateKey())
+	}
+	if ECRootCA.GoCertificate().SignatureAlgorithm != x509.ECDSAWithSHA384 {
+		t.Errorf("Expected ECDSAWithSHA384 but got: %s", ECRootCA.GoCertificate().SignatureAlgorithm)
+	}
+
+	id.Intermediate = true
+	id.KeyAlgorithm = key.Ed25519
+	EdCA, err := NewCA("go-ed25519.ca", "go-ecdsa.ca", id, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id.Intermediate = false
+	for _, algorithm := range []key.Algorithm{key.RSA, key.ECDSAP256, key.ECDSAP521, key.Ed25519} {
+		id.KeyAlgorithm = algorithm
+		commonName := string(algorithm) + ".go-ed25519.ca"
+
+		certificate, err := EdCA.IssueCertificate(commonName, id)
+		if err != nil {
+			t.Fatalf("Failed to issue %s certificate: %v", algorithm, err)
+		}
+
+		if err := certificate.certificate.CheckSignatureFrom(EdCA.GoCertificate()); err != nil {
+			t.Errorf("Certificate %s is not signed by the CA: %v", commonName, err)
+		}
+
+		loaded, err := EdCA.LoadCertificate(commonName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loaded.privateKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(certificate.publicKey) {
+			t.Errorf("Loaded %s private key does not match the certificate public key", algorithm)
+		}
+	}
+
+	LoadedCA, err := Load("go-ed25519.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := LoadedCA.GoPrivateKey().(ed25519.PrivateKey); !ok {
+		t.Errorf("Expected an Ed25519 CA key but got: %T", LoadedCA.GoPrivateKey())
+	}
+
+	if _, err := New("go-dsa.ca", Identity{
+		Organization:       "Key Algorithms Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       "dsa",
+	}, WithStorage(store)); err != key.ErrUnsupportedAlgorithm {
+		t.Errorf("Expected ErrUnsupportedAlgorithm but got: %v", err)
+	}
+}
+
+func TestFunctionalLoadPKCS1Keys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GoCA stores before ECDSA and Ed25519 support used PKCS #1 encoding
+	privateKey, err := key.LoadPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rsaKey.Equal(privateKey) {
+		t.Error("PKCS #1 private key was not loaded")
+	}
+
+	publicKey, err := key.LoadPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rsaKey.PublicKey.Equal(publicKey) {
+		t.Error("PKCS #1 public key was not loaded")
+	}
+}
+
+func TestFunctionalSignNonRSACSR(t *testing.T) {
+	store := NewMemoryStorage()
+
+	RSACA, err := New("go-rsa.ca", Identity{
+		Organization:       "Sign CSR Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "ec.go-rsa.ca"},
+		DNSNames: []string{"ec.go-rsa.ca"},
+	}, ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := cert.LoadCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecCert, err := RSACA.SignCSR(*csr, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ecCert.certificate.SignatureAlgorithm != x509.SHA256WithRSA {
+		t.Errorf("Expected SHA256WithRSA but got: %s", ecCert.certificate.SignatureAlgorithm)
+	}
+	if !ecKey.PublicKey.Equal(ecCert.certificate.PublicKey) {
+		t.Error("Certificate public key is not the CSR public key")
+	}
+	if ecCert.GetCSR() == "" {
+		t.Error("CSR was not stored with the certificate")
+	}
+
+	tampered := *csr
+	tampered.Subject = pkix.Name{CommonName: "tampered.go-rsa.ca"}
+	tampered.Signature = append([]byte{}, csr.Signature...)
+	tampered.Signature[len(tampered.Signature)-1] ^= 0xff
+	if _, err := RSACA.SignCSR(tampered, 30); err != cert.ErrCSRSignature {
+		t.Errorf("Expected ErrCSRSignature but got: %v", err)
+	}
+
+	if _, err := cert.LoadCSR([]byte("not a CSR")); err != cert.ErrInvalidCSR {
+		t.Errorf("Expected ErrInvalidCSR but got: %v", err)
+	}
+}
+
+func TestFunctionalSignCACSR(t *testing.T) {
+	store := NewMemoryStorage()
+	identity := Identity{
+		Organization:       "Sign CA CSR Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}
+
+	rootCA, err := New("go-sign-ca.ca", identity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := New("go-other-ca.ca", identity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateIdentity := identity
+	intermediateIdentity.Intermediate = true
+	intermediateCA, err := NewCA("go-sign-intermediate.ca", "go-sign-ca.ca", intermediateIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a CSR for an existing CA does not replace its certificate
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "go-other-ca.ca"},
+	}, csrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range []string{cert.DefaultProfile, cert.SubCAProfile} {
+		if _, err := rootCA.SignCSRWithProfile(*csr, 0, profile); err != ErrCSRCertificateAuthority {
+			t.Errorf("Expected ErrCSRCertificateAuthority with %s but got: %v", profile, err)
+		}
+	}
+	if _, err := otherCA.SignCSRWithProfile(*csr, 0, cert.SubCAProfile); err != ErrCSRCertificateAuthority {
+		t.Errorf("Expected ErrCSRCertificateAuthority for the own CA but got: %v", err)
+	}
+	if current, err := Load("go-other-ca.ca", WithStorage(store)); err != nil {
+		t.Fatal(err)
+	} else if !current.GoCertificate().Equal(otherCA.GoCertificate()) {
+		t.Error("The CA certificate was replaced")
+	}
+
+	// only the parent signs the intermediate CSR, with a CA profile
+	intermediateCSRBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "go-sign-intermediate.ca"},
+	}, intermediateCA.GoPrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateCSR, err := cert.LoadCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: intermediateCSRBytes}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherCA.SignCSRWithProfile(*intermediateCSR, 0, cert.SubCAProfile); err != ErrCSRCertificateAuthority {
+		t.Errorf("Expected ErrCSRCertificateAuthority for another CA but got: %v", err)
+	}
+	if _, err := rootCA.SignCSRWithProfile(*intermediateCSR, 0, cert.DefaultProfile); err != ErrCSRCertificateAuthority {
+		t.Errorf("Expected ErrCSRCertificateAuthority for a leaf profile but got: %v", err)
+	}
+	// the parent re-certifies the intermediate key
+	if err := store.Delete(filepath.Join("go-sign-ca.ca", "certs", "go-sign-intermediate.ca", "go-sign-intermediate.ca.crt")); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := rootCA.SignCSRWithProfile(*intermediateCSR, 0, cert.SubCAProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := Load("go-sign-intermediate.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.GoCertificate().Equal(signed.certificate) {
+		t.Error("The intermediate CA certificate was not replaced by the signed one")
+	}
+}
+
+func TestFunctionalEncryptedKeys(t *testing.T) {
+	store := NewMemoryStorage()
+	passphrase := []byte("correct horse battery staple")
+
+	id := Identity{
+		Organization:       "Encrypted CA Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}
+
+	_, err := New("go-encrypted.ca", id, WithStorage(store), WithPassphrase(passphrase), WithEncryptedCertificateKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyString, err := store.Get(filepath.Join("go-encrypted.ca", "ca", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.IsEncrypted(keyString) {
+		t.Error("CA private key is not encrypted")
+	}
+
+	if _, err := Load("go-encrypted.ca", WithStorage(store)); err != key.ErrPassphraseRequired {
+		t.Errorf("Expected ErrPassphraseRequired but got: %v", err)
+	}
+
+	if _, err := Load("go-encrypted.ca", WithStorage(store), WithPassphrase([]byte("wrong"))); err != key.ErrIncorrectPassphrase {
+		t.Errorf("Expected ErrIncorrectPassphrase but got: %v", err)
+	}
+
+	EncryptedCA, err := Load("go-encrypted.ca", WithStorage(store), WithPassphrase(passphrase), WithEncryptedCertificateKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = EncryptedCA.IssueCertificate("w3.go-encrypted.ca", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKeyString, _ := store.Get(filepath.Join("go-encrypted.ca", "certs", "w3.go-encrypted.ca", "key.pem"))
+	if !key.IsEncrypted(leafKeyString) {
+		t.Error("Certificate private key is not encrypted")
+	}
+
+	leafCert, err := EncryptedCA.LoadCertificate("w3.go-encrypted.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leafCert.privateKey == nil {
+		t.Error("Certificate private key was not decrypted")
+	}
+
+	// intermediate CA with its own passphrase, signed by the encrypted CA
+	passphrases := map[string][]byte{
+		"go-encrypted.ca":              passphrase,
+		"go-encrypted-intermediate.ca": []byte("another passphrase"),
+	}
+	provider := func(commonName string) ([]byte, error) {
+		return passphrases[commonName], nil
+	}
+
+	id.Intermediate = true
+	_, err = NewCA("go-encrypted-intermediate.ca", "go-encrypted.ca", id, WithStorage(store), WithPassphraseProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load("go-encrypted-intermediate.ca", WithStorage(store), WithPassphrase(passphrase)); err != key.ErrIncorrectPassphrase {
+		t.Errorf("Expected ErrIncorrectPassphrase but got: %v", err)
+	}
+
+	if _, err := Load("go-encrypted-intermediate.ca", WithStorage(store), WithPassphraseProvider(provider)); err != nil {
+		t.Error(err)
+	}
+
+	// unencrypted CAs keep loading when a passphrase is given
+	if _, err := Load("go-root.ca", WithPassphrase(passphrase)); err != nil {
+		t.Error(err)
+	}
+}
+
+// externalSigner hides the private key type, as a HSM key does
+type externalSigner struct {
+	crypto.Signer
+}
+
+func TestFunctionalSignerCA(t *testing.T) {
+	store := NewMemoryStorage()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := externalSigner{privateKey}
+
+	id := Identity{
+		Organization:       "HSM CA Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}
+
+	SignerCA, err := New("go-signer.ca", id, WithStorage(store), WithSigner(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Exists(filepath.Join("go-signer.ca", "ca", "key.pem")) {
+		t.Error("Signer CA private key was written to the storage")
+	}
+	if SignerCA.GetPrivateKey() != "" {
+		t.Error("Signer CA has a private key string")
+	}
+
+	if _, err := Load("go-signer.ca", WithStorage(store)); err == nil {
+		t.Error("Signer CA loaded without the signer")
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := Load("go-signer.ca", WithStorage(store), WithSigner(otherKey)); err != ErrSignerMismatch {
+		t.Errorf("Expected ErrSignerMismatch but got: %v", err)
+	}
+
+	provider := func(commonName string) (crypto.Signer, error) {
+		if commonName == "go-signer.ca" {
+			return signer, nil
+		}
+		return nil, nil
+	}
+
+	SignerCA, err = Load("go-signer.ca", WithStorage(store), WithSignerProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := SignerCA.IssueCertificate("w3.go-signer.ca", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.certificate.CheckSignatureFrom(SignerCA.GoCertificate()); err != nil {
+		t.Error(err)
+	}
+
+	if err := SignerCA.RevokeCertificate("w3.go-signer.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignerCA.GoCRL().CheckSignatureFrom(SignerCA.GoCertificate()); err != nil {
+		t.Error(err)
+	}
+
+	// the parent private key is provided by the signer provider
+	id.Intermediate = true
+	IntermediateCA, err := NewCA("go-signer-intermediate.ca", "go-signer.ca", id, WithStorage(store), WithSignerProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := IntermediateCA.GoCertificate().CheckSignatureFrom(SignerCA.GoCertificate()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFunctionalProfiles(t *testing.T) {
+	store := NewMemoryStorage()
+
+	ProfilesCA, err := New("go-profiles.ca", Identity{
+		Organization:       "Profiles Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ProfilesCA.GoCertificate().ExtKeyUsage) != 0 {
+		t.Errorf("CA certificate has extended key usages: %v", ProfilesCA.GoCertificate().ExtKeyUsage)
+	}
+
+	server, err := ProfilesCA.IssueCertificate("server.go-profiles.ca", Identity{
+		Organization:   "Profiles Company Inc.",
+		EmailAddresses: "server@go-profiles.ca",
+		DNSNames:       []string{"www.go-profiles.ca"},
+		Profile:        cert.TLSServerProfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert := server.GoCert()
+	if !slices.Equal(serverCert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+		t.Errorf("Expected server auth only but got: %v", serverCert.ExtKeyUsage)
+	}
+	if serverCert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("Unexpected key usage: %v", serverCert.KeyUsage)
+	}
+	if len(serverCert.EmailAddresses) != 0 {
+		t.Errorf("Email SAN not allowed by the profile was copied: %v", serverCert.EmailAddresses)
+	}
+	if !slices.Contains(serverCert.DNSNames, "www.go-profiles.ca") {
+		t.Errorf("DNS SAN is missing: %v", serverCert.DNSNames)
+	}
+
+	if _, err := ProfilesCA.IssueCertificate("long.go-profiles.ca", Identity{Valid: 500, Profile: cert.TLSServerProfile}); err == nil {
+		t.Error("Expected validity out of the profile bounds to fail")
+	}
+
+	if _, err := ProfilesCA.IssueCertificate("unknown.go-profiles.ca", Identity{Profile: "unknown"}); err != cert.ErrProfileNotFound {
+		t.Errorf("Expected ErrProfileNotFound but got: %v", err)
+	}
+
+	ocspKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ocsp.go-profiles.ca"},
+	}, ocspKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ocsp, err := ProfilesCA.SignCSRWithProfile(*csr, 0, cert.OCSPSigningProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocspCert := ocsp.GoCert()
+	if !slices.Equal(ocspCert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}) {
+		t.Errorf("Expected OCSP signing but got: %v", ocspCert.ExtKeyUsage)
+	}
+	if ocspCert.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Error("Key encipherment used with an ECDSA key")
+	}
+	noCheck := false
+	for _, extension := range ocspCert.Extensions {
+		if extension.Id.String() == "1.3.6.1.5.5.7.48.1.5" {
+			noCheck = true
+		}
+	}
+	if !noCheck {
+		t.Error("OCSP no check extension is missing")
+	}
+
+	subCAKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "sub.go-profiles.ca"},
+	}, subCAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err = x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subCA, err := ProfilesCA.SignCSRWithProfile(*csr, 0, cert.SubCAProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !subCA.GoCert().IsCA || subCA.GoCert().KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Error("Sub CA certificate is not a CA certificate")
+	}
+
+	custom := cert.Profile{
+		Name:        "short-client",
+		KeyUsage:    []string{"digital_signature"},
+		ExtKeyUsage: []string{"client_auth"},
+		MaxValidity: cert.Duration(7 * cert.Day),
+		AllowedSANs: []string{cert.SANDNS},
+	}
+	if err := ProfilesCA.SetProfile(custom); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProfilesCA.SetProfile(cert.Profile{Name: cert.DefaultProfile}); err != ErrProfileBuiltin {
+		t.Errorf("Expected ErrProfileBuiltin but got: %v", err)
+	}
+	if err := ProfilesCA.SetProfile(cert.Profile{Name: "invalid", KeyUsage: []string{"unknown"}}); err == nil {
+		t.Error("Expected invalid profile to fail")
+	}
+
+	ReloadedCA, err := Load("go-profiles.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := ReloadedCA.Profiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := profiles["short-client"]; !ok {
+		t.Fatal("Custom profile was not stored with the CA")
+	}
+
+	client, err := ReloadedCA.IssueCertificate("client.go-profiles.ca", Identity{Profile: "short-client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days := client.GoCert().NotAfter.Sub(client.GoCert().NotBefore).Hours() / 24; days > 7 {
+		t.Errorf("Expected 7 valid days but got: %v", days)
+	}
+}
+
+func TestFunctionalValidityPolicy(t *testing.T) {
+	store := NewMemoryStorage()
+
+	policy := cert.Policy{
+		MinValidity:     cert.Duration(5 * time.Minute),
+		MaxValidity:     cert.Duration(2 * time.Hour),
+		DefaultValidity: cert.Duration(time.Hour),
+		MaxCAValidity:   cert.Duration(30 * cert.Day),
+		Backdate:        cert.Duration(time.Minute),
+	}
+
+	caIdentity := Identity{
+		Organization:       "Policy Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+		Valid:              400,
+	}
+
+	if _, err := New("go-long.ca", caIdentity, WithStorage(store), WithPolicy(policy)); err == nil {
+		t.Error("Expected CA validity above the policy maximum to fail")
+	}
+
+	caIdentity.Valid = 20
+	PolicyCA, err := New("go-policy.ca", caIdentity, WithStorage(store), WithPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shortLived, err := PolicyCA.IssueCertificate("short.go-policy.ca", Identity{Validity: cert.Duration(30 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := time.Until(shortLived.GoCert().NotAfter); lifetime > 30*time.Minute || lifetime < 29*time.Minute {
+		t.Errorf("Expected 30 minutes validity but got: %s", lifetime)
+	}
+	// backdated, but never before the CA certificate
+	if !shortLived.GoCert().NotBefore.Equal(PolicyCA.GoCertificate().NotBefore) {
+		t.Errorf("Expected NotBefore %s but got: %s", PolicyCA.GoCertificate().NotBefore, shortLived.GoCert().NotBefore)
+	}
+
+	if _, err := PolicyCA.IssueCertificate("long.go-policy.ca", Identity{Validity: cert.Duration(3 * time.Hour)}); err == nil {
+		t.Error("Expected validity above the policy maximum to fail")
+	}
+	if store.Exists(filepath.Join("go-policy.ca", "certs", "long.go-policy.ca")) {
+		t.Error("Expected no keys for the refused certificate")
+	}
+
+	ReloadedCA, err := Load("go-policy.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ReloadedCA.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored, policy) {
+		t.Errorf("Expected stored policy %+v but got: %+v", policy, stored)
+	}
+
+	defaultCert, err := ReloadedCA.IssueCertificate("default.go-policy.ca", Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := time.Until(defaultCert.GoCert().NotAfter); lifetime > time.Hour || lifetime < 59*time.Minute {
+		t.Errorf("Expected 1 hour validity but got: %s", lifetime)
+	}
+
+	if err := ReloadedCA.SetPolicy(cert.Policy{MinValidity: cert.Duration(3 * cert.Day), MaxValidity: cert.Duration(cert.Day)}); err == nil {
+		t.Error("Expected invalid policy to fail")
+	}
+
+	// certificates and intermediate CAs never outlive the issuing CA
+	caIdentity.Valid = 2
+	ShortCA, err := New("go-short.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := ShortCA.IssueCertificate("leaf.go-short.ca", Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.GoCert().NotAfter.Equal(ShortCA.GoCertificate().NotAfter) {
+		t.Errorf("Expected NotAfter %s but got: %s", ShortCA.GoCertificate().NotAfter, leaf.GoCert().NotAfter)
+	}
+
+	if _, err := ShortCA.IssueCertificate("week.go-short.ca", Identity{Valid: 7, Profile: cert.TLSServerProfile}); err != nil {
+		t.Error(err)
+	}
+
+	caIdentity.Valid = 10
+	caIdentity.Intermediate = true
+	IntermediateCA, err := NewCA("go-short-intermediate.ca", "go-short.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IntermediateCA.GoCertificate().NotAfter.After(ShortCA.GoCertificate().NotAfter) {
+		t.Error("Intermediate CA outlives the parent CA")
+	}
+}
+
+func TestFunctionalOCSP(t *testing.T) {
+	store := NewMemoryStorage()
+
+	OCSPCA, err := New("go-ocsp.ca", Identity{
+		Organization:       "OCSP Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store), WithPolicy(cert.Policy{OCSPServer: []string{"http://goca.example.com/ocsp/go-ocsp.ca"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, err := OCSPCA.IssueCertificate("good.go-ocsp.ca", Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(good.GoCert().OCSPServer, []string{"http://goca.example.com/ocsp/go-ocsp.ca"}) {
+		t.Errorf("Expected the OCSP server URL in the AIA but got: %v", good.GoCert().OCSPServer)
+	}
+
+	revoked, err := OCSPCA.IssueCertificate("revoked.go-ocsp.ca", Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := OCSPCA.RevokeCertificate("revoked.go-ocsp.ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(ca CA, certificate *x509.Certificate) *ocsp.Response {
+		t.Helper()
+
+		request, err := ocsp.CreateRequest(certificate, ca.GoCertificate(), &ocsp.RequestOptions{Hash: crypto.SHA256})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := ca.OCSPResponse(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ocsp.ParseResponseForCert(response, certificate, ca.GoCertificate())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parsed
+	}
+
+	goodCert, revokedCert := good.GoCert(), revoked.GoCert()
+	if response := status(OCSPCA, &goodCert); response.Status != ocsp.Good {
+		t.Errorf("Expected good status but got: %d", response.Status)
+	}
+	if response := status(OCSPCA, &revokedCert); response.Status != ocsp.Revoked {
+		t.Errorf("Expected revoked status but got: %d", response.Status)
+	}
+
+	unknown := goodCert
+	unknown.SerialNumber = big.NewInt(42)
+	if response := status(OCSPCA, &unknown); response.Status != ocsp.Unknown {
+		t.Errorf("Expected unknown status but got: %d", response.Status)
+	}
+
+	OtherCA, err := New("go-ocsp-other.ca", Identity{
+		Organization:       "OCSP Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ocsp.CreateRequest(&goodCert, OCSPCA.GoCertificate(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OtherCA.OCSPResponse(request); err != ErrOCSPIssuer {
+		t.Errorf("Expected ErrOCSPIssuer but got: %v", err)
+	}
+	if _, err := OCSPCA.OCSPResponse([]byte("not an OCSP request")); err != ErrOCSPRequest {
+		t.Errorf("Expected ErrOCSPRequest but got: %v", err)
+	}
+
+	// delegated OCSP signer
+	signer, err := OCSPCA.IssueCertificate("ocsp.go-ocsp.ca", Identity{Profile: cert.OCSPSigningProfile, KeyAlgorithm: key.ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := OCSPCA.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.OCSPSigner = "ocsp.go-ocsp.ca"
+	if err := OCSPCA.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+
+	signerCert := signer.GoCert()
+	response := status(OCSPCA, &goodCert)
+	if response.Status != ocsp.Good {
+		t.Errorf("Expected good status but got: %d", response.Status)
+	}
+	if response.Certificate == nil || !response.Certificate.Equal(&signerCert) {
+		t.Error("The response is not signed by the delegated OCSP signer")
+	}
+
+	policy.OCSPSigner = "missing.go-ocsp.ca"
+	if err := OCSPCA.SetPolicy(policy); err != ErrCertLoadNotFound {
+		t.Errorf("Expected ErrCertLoadNotFound but got: %v", err)
+	}
+}
+
+func TestFunctionalRevocationReasons(t *testing.T) {
+	store := NewMemoryStorage()
+
+	RevocationCA, err := New("go-revocation.ca", Identity{
+		Organization:       "Revocation Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commonName := range []string{"compromised.go-revocation.ca", "hold.go-revocation.ca", "superseded.go-revocation.ca"} {
+		if _, err := RevocationCA.IssueCertificate(commonName, Identity{KeyAlgorithm: key.ECDSAP256}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entry := func(ca CA, commonName string) *x509.RevocationListEntry {
+		t.Helper()
+
+		certificate, err := ca.LoadCertificate(commonName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, revoked := range ca.GoCRL().RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(certificate.GoCert().SerialNumber) == 0 {
+				return &revoked
+			}
+		}
+
+		return nil
+	}
+
+	invalidityDate := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	if err := RevocationCA.RevokeCertificateWithReason("compromised.go-revocation.ca", cert.KeyCompromise, invalidityDate); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevocationCA.RevokeCertificateWithReason("hold.go-revocation.ca", cert.CertificateHold, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevocationCA.RevokeCertificateWithReason("superseded.go-revocation.ca", cert.CertificateHold, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ReloadedCA, err := Load("go-revocation.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReloadedCA.ReleaseCertificateHold("hold.go-revocation.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if entry(ReloadedCA, "hold.go-revocation.ca") != nil {
+		t.Error("Certificate on hold was not released")
+	}
+	if err := ReloadedCA.ReleaseCertificateHold("compromised.go-revocation.ca"); err != ErrCertNotOnHold {
+		t.Errorf("Expected ErrCertNotOnHold but got: %v", err)
+	}
+
+	compromised := entry(ReloadedCA, "compromised.go-revocation.ca")
+	if compromised == nil || cert.RevocationReason(compromised.ReasonCode) != cert.KeyCompromise {
+		t.Fatalf("Expected key compromise entry but got: %+v", compromised)
+	}
+	if got := cert.InvalidityDate(*compromised); !got.Equal(invalidityDate) {
+		t.Errorf("Expected invalidity date %s but got: %s", invalidityDate, got)
+	}
+
+	if err := ReloadedCA.RevokeCertificateWithReason("superseded.go-revocation.ca", cert.Superseded, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if superseded := entry(ReloadedCA, "superseded.go-revocation.ca"); superseded == nil || cert.RevocationReason(superseded.ReasonCode) != cert.Superseded {
+		t.Errorf("Expected superseded entry but got: %+v", superseded)
+	}
+	if err := ReloadedCA.RevokeCertificateWithReason("superseded.go-revocation.ca", cert.KeyCompromise, time.Time{}); err != ErrCertRevoked {
+		t.Errorf("Expected ErrCertRevoked but got: %v", err)
+	}
+	if err := ReloadedCA.RevokeCertificateWithReason("hold.go-revocation.ca", cert.RemoveFromCRL, time.Time{}); err != cert.ErrRevocationReason {
+		t.Errorf("Expected ErrRevocationReason but got: %v", err)
+	}
+
+	if reason, err := cert.ParseRevocationReason("cessationOfOperation"); err != nil || reason != cert.CessationOfOperation {
+		t.Errorf("Expected cessation of operation but got: %v, %v", reason, err)
+	}
+}
+
+func TestFunctionalConcurrentRevocations(t *testing.T) {
+	store := NewMemoryStorage()
+
+	ConcurrentCA, err := New("go-concurrent.ca", Identity{
+		Organization:       "Concurrent Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initialNumber := ConcurrentCA.GoCRL().Number
+
+	var commonNames []string
+	for i := 0; i < 8; i++ {
+		commonName := fmt.Sprintf("%d.go-concurrent.ca", i)
+		if _, err := ConcurrentCA.IssueCertificate(commonName, Identity{KeyAlgorithm: key.ECDSAP256}); err != nil {
+			t.Fatal(err)
+		}
+		commonNames = append(commonNames, commonName)
+	}
+
+	// the CAs loaded before the revocations keep a stale CRL
+	var loaded []CA
+	for range commonNames {
+		ca, err := Load("go-concurrent.ca", WithStorage(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded = append(loaded, ca)
+	}
+
+	errs := make(chan error, len(commonNames))
+	for i, commonName := range commonNames {
+		go func(ca CA, commonName string) {
+			errs <- ca.RevokeCertificate(commonName)
+		}(loaded[i], commonName)
+	}
+	for range commonNames {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ReloadedCA, err := Load("go-concurrent.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked := len(ReloadedCA.GoCRL().RevokedCertificateEntries); revoked != len(commonNames) {
+		t.Errorf("Expected %d revoked certificates but got: %d", len(commonNames), revoked)
+	}
+	expectedNumber := new(big.Int).Add(initialNumber, big.NewInt(int64(len(commonNames))))
+	if ReloadedCA.GoCRL().Number.Cmp(expectedNumber) != 0 {
+		t.Errorf("Expected CRL number %s but got: %s", expectedNumber, ReloadedCA.GoCRL().Number)
+	}
+
+	// the regenerated CRL keeps the revocations of the other loaded CAs
+	if err := ConcurrentCA.RegenerateCRL(); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := len(ConcurrentCA.GoCRL().RevokedCertificateEntries); revoked != len(commonNames) {
+		t.Errorf("Expected %d revoked certificates after RegenerateCRL but got: %d", len(commonNames), revoked)
+	}
+}
+
+func TestFunctionalCRLPublisher(t *testing.T) {
+	store := NewMemoryStorage()
+
+	CRLCA, err := New("go-crl.ca", Identity{
+		Organization:       "CRL Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store), WithPolicy(cert.Policy{CRLValidity: cert.Duration(time.Hour)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl := CRLCA.GoCRL()
+	if crl.NextUpdate.Sub(crl.ThisUpdate) != time.Hour {
+		t.Errorf("Expected CRL valid for 1 hour but got: %s", crl.NextUpdate.Sub(crl.ThisUpdate))
+	}
+	firstNumber := crl.Number
+
+	if _, err := CRLCA.IssueCertificate("revoked.go-crl.ca", Identity{KeyAlgorithm: key.ECDSAP256}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CRLCA.RevokeCertificate("revoked.go-crl.ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	// not expiring within the next minute
+	publisher := &CRLPublisher{RenewBefore: time.Minute, Options: []Option{WithStorage(store)}}
+	if err := publisher.PublishOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	ReloadedCA, err := Load("go-crl.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedNumber := ReloadedCA.GoCRL().Number
+	if revokedNumber.Cmp(firstNumber) <= 0 {
+		t.Errorf("Expected CRL number above %s but got: %s", firstNumber, revokedNumber)
+	}
+
+	// expiring within the next two hours
+	publisher.RenewBefore = 2 * time.Hour
+	if err := publisher.PublishOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	ReloadedCA, err = Load("go-crl.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl = ReloadedCA.GoCRL()
+	if crl.Number.Cmp(new(big.Int).Add(revokedNumber, big.NewInt(1))) != 0 {
+		t.Errorf("Expected CRL number %s + 1 but got: %s", revokedNumber, crl.Number)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 {
+		t.Errorf("Expected the revoked certificate in the new CRL but got: %d entries", len(crl.RevokedCertificateEntries))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := publisher.Run(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled but got: %v", err)
+	}
+}
+
+func TestFunctionalCRLDistributionPoints(t *testing.T) {
+	store := NewMemoryStorage()
+
+	caIdentity := Identity{
+		Organization:       "CDP Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}
+
+	crlURL := []string{"http://goca.example.com/crl/go-cdp.ca.crl"}
+	RootCA, err := New("go-cdp.ca", caIdentity, WithStorage(store), WithPolicy(cert.Policy{
+		CRLDistributionPoints: crlURL,
+		OCSPServer:            []string{"http://goca.example.com/ocsp/go-cdp.ca"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(RootCA.GoCertificate().CRLDistributionPoints) != 0 {
+		t.Errorf("Root CA certificate has CRL Distribution Points: %v", RootCA.GoCertificate().CRLDistributionPoints)
+	}
+
+	leaf, err := RootCA.IssueCertificate("leaf.go-cdp.ca", Identity{KeyAlgorithm: key.ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(leaf.GoCert().CRLDistributionPoints, crlURL) {
+		t.Errorf("Expected CRL Distribution Points %v but got: %v", crlURL, leaf.GoCert().CRLDistributionPoints)
+	}
+
+	caIdentity.Intermediate = true
+	IntermediateCA, err := NewCA("go-cdp-intermediate.ca", "go-cdp.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(IntermediateCA.GoCertificate().CRLDistributionPoints, crlURL) {
+		t.Errorf("Expected CRL Distribution Points %v but got: %v", crlURL, IntermediateCA.GoCertificate().CRLDistributionPoints)
+	}
+	if len(IntermediateCA.GoCertificate().OCSPServer) != 1 {
+		t.Errorf("Expected the parent OCSP server but got: %v", IntermediateCA.GoCertificate().OCSPServer)
+	}
+}
+
+func TestFunctionalCAIssuers(t *testing.T) {
+	store := NewMemoryStorage()
+
+	caIdentity := Identity{
+		Organization:       "AIA Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}
+
+	rootURL := []string{"http://goca.example.com/go-aia.ca.cer"}
+	RootCA, err := New("go-aia.ca", caIdentity, WithStorage(store), WithPolicy(cert.Policy{IssuingCertificateURL: rootURL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caIdentity.Intermediate = true
+	intermediateURL := []string{"http://goca.example.com/go-aia-intermediate.ca.cer"}
+	IntermediateCA, err := NewCA("go-aia-intermediate.ca", "go-aia.ca", caIdentity, WithStorage(store), WithPolicy(cert.Policy{IssuingCertificateURL: intermediateURL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(IntermediateCA.GoCertificate().IssuingCertificateURL, rootURL) {
+		t.Errorf("Expected CA Issuers %v but got: %v", rootURL, IntermediateCA.GoCertificate().IssuingCertificateURL)
+	}
+
+	leaf, err := IntermediateCA.IssueCertificate("leaf.go-aia.ca", Identity{KeyAlgorithm: key.ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(leaf.GoCert().IssuingCertificateURL, intermediateURL) {
+		t.Errorf("Expected CA Issuers %v but got: %v", intermediateURL, leaf.GoCert().IssuingCertificateURL)
+	}
+
+	chain, err := IntermediateCA.Chain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || !chain[0].Equal(IntermediateCA.GoCertificate()) || !chain[1].Equal(RootCA.GoCertificate()) {
+		t.Fatalf("Unexpected chain with %d certificates", len(chain))
+	}
+
+	bundle, err := cert.PKCS7Certificates(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, certificate := range chain {
+		if !bytes.Contains(bundle, certificate.Raw) {
+			t.Errorf("Certificate %s is missing in the PKCS #7 bundle", certificate.Subject.CommonName)
+		}
+	}
+
+	// the chain and the CRL are published without unlocking the CA key
+	publicOptions := []Option{
+		WithStorage(store),
+		WithPassphraseProvider(func(commonName string) ([]byte, error) {
+			t.Errorf("Unexpected passphrase request for %s", commonName)
+			return nil, errors.New("no passphrase")
+		}),
+		WithObserver(func(event Event) {
+			t.Errorf("Unexpected %s event", event.Operation)
+		}),
+	}
+	loadedChain, err := LoadChain("go-aia-intermediate.ca", publicOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loadedChain) != 2 || !loadedChain[0].Equal(chain[0]) || !loadedChain[1].Equal(chain[1]) {
+		t.Errorf("Unexpected loaded chain with %d certificates", len(loadedChain))
+	}
+	crl, err := LoadCRL("go-aia-intermediate.ca", publicOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crl == nil || !bytes.Equal(crl.Raw, IntermediateCA.GoCRL().Raw) {
+		t.Error("Unexpected loaded CRL")
+	}
+	if _, err := LoadChain("missing.go-aia.ca", publicOptions...); err != ErrCALoadNotFound {
+		t.Errorf("Expected ErrCALoadNotFound but got: %v", err)
+	}
+	if _, err := LoadCRL("missing.go-aia.ca", publicOptions...); err != ErrCALoadNotFound {
+		t.Errorf("Expected ErrCALoadNotFound but got: %v", err)
+	}
+}
+
+func TestFunctionalRenewCertificate(t *testing.T) {
+	store := NewMemoryStorage()
+
+	var events []Event
+	RenewalCA, err := New("go-renewal.ca", Identity{
+		Organization:       "Renewal Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store), WithObserver(func(event Event) {
+		events = append(events, event)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := RenewalCA.IssueCertificate("www.go-renewal.ca", Identity{KeyAlgorithm: key.ECDSAP384, DNSNames: []string{"www.go-renewal.ca"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RenewalCA.IssueCertificate("www.go-renewal.ca", Identity{KeyAlgorithm: key.ECDSAP384}); err != cert.ErrCertExists {
+		t.Errorf("Expected ErrCertExists but got: %v", err)
+	}
+
+	// same key
+	second, err := RenewalCA.RenewCertificate("www.go-renewal.ca", RenewOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.GoCert().SerialNumber.Cmp(first.GoCert().SerialNumber) == 0 {
+		t.Error("The renewal should issue a new certificate")
+	}
+	if !publicKeysEqual(second.GoCert().PublicKey, first.GoCert().PublicKey) || second.PrivateKey != first.PrivateKey {
+		t.Error("The renewal without rekey should keep the key")
+	}
+	if !slices.Equal(second.GoCert().DNSNames, first.GoCert().DNSNames) {
+		t.Errorf("Unexpected renewed DNS names %v", second.GoCert().DNSNames)
+	}
+
+	// new key of the same algorithm, revoking the previous certificate
+	third, err := RenewalCA.RenewCertificate("www.go-renewal.ca", RenewOptions{Rekey: true, Revoke: true, Profile: cert.TLSServerProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKeysEqual(third.GoCert().PublicKey, second.GoCert().PublicKey) || third.PrivateKey == second.PrivateKey {
+		t.Error("The rekey should create a new key")
+	}
+	if third.GoCert().PublicKey.(*ecdsa.PublicKey).Curve != elliptic.P384() {
+		t.Error("The rekey should keep the key algorithm")
+	}
+	if !slices.Equal(third.GoCert().ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+		t.Errorf("Unexpected renewed extended key usage %v", third.GoCert().ExtKeyUsage)
+	}
+
+	revoked := RenewalCA.GoCRL().RevokedCertificateEntries
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(second.GoCert().SerialNumber) != 0 || cert.RevocationReason(revoked[0].ReasonCode) != cert.Superseded {
+		t.Errorf("The previous certificate should be revoked as superseded, got %v", revoked)
+	}
+	if !slices.ContainsFunc(events, func(event Event) bool {
+		return event.Operation == OperationRevoke && event.Err == nil && event.SerialNumber == second.GoCert().SerialNumber.String()
+	}) {
+		t.Error("The revocation of the previous certificate should be observed")
+	}
+
+	// the CSR must be for the same common name
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "other.go-renewal.ca"}}, csrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := x509.ParseCertificateRequest(csrBytes)
+	if _, err := RenewalCA.RenewCertificate("www.go-renewal.ca", RenewOptions{CSR: csr}); err != ErrRenewCommonName {
+		t.Errorf("Expected ErrRenewCommonName but got: %v", err)
+	}
+	if _, err := RenewalCA.RenewCertificate("www.go-renewal.ca", RenewOptions{CSR: csr, Rekey: true}); err != ErrRenewRekeyCSR {
+		t.Errorf("Expected ErrRenewRekeyCSR but got: %v", err)
+	}
+
+	// a failed renewal keeps the current certificate
+	if _, err := RenewalCA.RenewCertificate("www.go-renewal.ca", RenewOptions{Profile: "unknown"}); err == nil {
+		t.Error("The renewal with an unknown profile should fail")
+	}
+
+	csrBytes, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.go-renewal.ca"}}, csrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ = x509.ParseCertificateRequest(csrBytes)
+	fourth, err := RenewalCA.RenewCertificate("www.go-renewal.ca", RenewOptions{CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKeysEqual(fourth.GoCert().PublicKey, csrKey.Public()) || fourth.PrivateKey != "" {
+		t.Error("The renewal with a CSR should certify the CSR key without keeping the previous private key")
+	}
+	if !slices.Equal(fourth.GoCert().ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+		t.Errorf("The renewal should keep the profile of the current certificate, got %v", fourth.GoCert().ExtKeyUsage)
+	}
+
+	ReloadedCA, err := Load("go-renewal.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ReloadedCA.LoadCertificate("www.go-renewal.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.GoCert().SerialNumber.Cmp(fourth.GoCert().SerialNumber) != 0 {
+		t.Error("The renewed certificate should be the current certificate")
+	}
+	if certificates := ReloadedCA.ListCertificates(); !slices.Equal(certificates, []string{"www.go-renewal.ca"}) {
+		t.Errorf("Unexpected certificates %v", certificates)
+	}
+
+	archived, err := ReloadedCA.ArchivedCertificates("www.go-renewal.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serials []string
+	for _, certificate := range archived {
+		serials = append(serials, certificate.SerialNumber.String())
+	}
+	expected := []string{first.GoCert().SerialNumber.String(), second.GoCert().SerialNumber.String(), third.GoCert().SerialNumber.String()}
+	slices.Sort(serials)
+	slices.Sort(expected)
+	if !slices.Equal(serials, expected) {
+		t.Errorf("Expected archived certificates %v but got: %v", expected, serials)
+	}
+
+	// the archived certificates are known by OCSP
+	firstCert := first.GoCert()
+	ocspRequest, err := ocsp.CreateRequest(&firstCert, ReloadedCA.GoCertificate(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocspResponse, err := ReloadedCA.OCSPResponse(ocspRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ocsp.ParseResponse(ocspResponse, ReloadedCA.GoCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != ocsp.Good {
+		t.Errorf("Expected the archived certificate OCSP status good but got: %d", response.Status)
+	}
+
+	if _, err := ReloadedCA.RenewCertificate("missing.go-renewal.ca", RenewOptions{}); err != ErrCertLoadNotFound {
+		t.Errorf("Expected ErrCertLoadNotFound but got: %v", err)
+	}
+
+	// the keys without the certificate are not a certificate
+	if err := store.Put(filepath.Join("go-renewal.ca", "certs", "keys-only.go-renewal.ca", "key.pub"), []byte(ReloadedCA.Data.PublicKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReloadedCA.LoadCertificate("keys-only.go-renewal.ca"); err != ErrCertLoadNotFound {
+		t.Errorf("Expected ErrCertLoadNotFound but got: %v", err)
+	}
+}
+
+func TestFunctionalCertificateIndex(t *testing.T) {
+	store := NewMemoryStorage()
+
+	caIdentity := Identity{
+		Organization:       "Index Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}
+	IndexCA, err := New("go-index.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web, err := IndexCA.IssueCertificate("web.go-index.ca", Identity{KeyAlgorithm: key.ECDSAP256, DNSNames: []string{"www.go-index.ca"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webCert := web.GoCert()
+
+	record, err := IndexCA.FindBySerial(webCert.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.CommonName != "web.go-index.ca" || record.Status != CertificateValid || !slices.Contains(record.DNSNames, "www.go-index.ca") ||
+		!slices.Equal(record.IPAddresses, []string{"10.0.0.1"}) || !record.NotAfter.Equal(webCert.NotAfter) ||
+		record.Path != filepath.Join("go-index.ca", "certs", "web.go-index.ca", "web.go-index.ca.crt") {
+		t.Errorf("Unexpected record %+v", record)
+	}
+	if record.Profile != cert.DefaultProfile || record.StatusAt(webCert.NotAfter.Add(time.Second)) != CertificateExpired {
+		t.Errorf("Unexpected record profile %q or expired status", record.Profile)
+	}
+
+	renewed, err := IndexCA.RenewCertificate("web.go-index.ca", RenewOptions{Rekey: true, Revoke: true, Profile: cert.TLSServerProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := IndexCA.FindBySubject("web.go-index.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].SerialNumber != webCert.SerialNumber.String() || records[1].SerialNumber != renewed.GoCert().SerialNumber.String() {
+		t.Fatalf("Expected the previous and the renewed certificates but got: %+v", records)
+	}
+	if records[0].Status != CertificateRevoked || records[0].RevocationReason != "superseded" || records[0].RevocationTime == nil ||
+		records[0].Path != filepath.Join("go-index.ca", "certs", "web.go-index.ca", "archive", webCert.SerialNumber.Text(16), "web.go-index.ca.crt") {
+		t.Errorf("Unexpected superseded record %+v", records[0])
+	}
+	if records[1].Profile != cert.TLSServerProfile || records[0].StatusAt(time.Now()) != CertificateRevoked || !records[0].Archived() || records[1].Archived() {
+		t.Errorf("Unexpected renewed record %+v", records[1])
+	}
+	if bySubject, err := IndexCA.FindBySubject(renewed.GoCert().Subject.String()); err != nil || len(bySubject) != 2 {
+		t.Errorf("Expected 2 records by subject but got %d: %v", len(bySubject), err)
+	}
+
+	// the hold and its release are kept in the database
+	if err := IndexCA.RevokeCertificateWithReason("web.go-index.ca", cert.CertificateHold, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := IndexCA.FindBySerial(renewed.GoCert().SerialNumber); record.Status != CertificateRevoked || record.RevocationReason != "certificate_hold" {
+		t.Errorf("Unexpected record on hold %+v", record)
+	}
+	if err := IndexCA.ReleaseCertificateHold("web.go-index.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := IndexCA.FindBySerial(renewed.GoCert().SerialNumber); record.Status != CertificateValid || record.RevocationTime != nil {
+		t.Errorf("Unexpected released record %+v", record)
+	}
+
+	// signed CSRs and intermediate Certificate Authorities are recorded
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device.go-index.ca"}}, csrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := x509.ParseCertificateRequest(csrBytes)
+	device, err := IndexCA.SignCSR(*csr, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IndexCA.FindBySerial(device.GoCert().SerialNumber); err != nil {
+		t.Error(err)
+	}
+
+	caIdentity.Intermediate = true
+	IntermediateCA, err := NewCA("go-index-intermediate.ca", "go-index.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := IndexCA.FindBySerial(IntermediateCA.GoCertificate().SerialNumber); err != nil || record.Path != filepath.Join("go-index-intermediate.ca", "ca", "go-index-intermediate.ca.crt") {
+		t.Errorf("Unexpected intermediate CA record %+v: %v", record, err)
+	}
+
+	// archived certificates are revoked by serial number
+	if err := IndexCA.RevokeCertificateBySerial(webCert.SerialNumber, cert.KeyCompromise, time.Time{}); err != ErrCertRevoked {
+		t.Errorf("Expected ErrCertRevoked but got: %v", err)
+	}
+	if err := IndexCA.RevokeCertificateBySerial(device.GoCert().SerialNumber, cert.KeyCompromise, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := IndexCA.FindBySerial(device.GoCert().SerialNumber); record.Status != CertificateRevoked || record.RevocationReason != "key_compromise" {
+		t.Errorf("Unexpected revoked record %+v", record)
+	}
+	if err := IndexCA.RevokeCertificateBySerial(big.NewInt(1), cert.KeyCompromise, time.Time{}); err != ErrCertLoadNotFound {
+		t.Errorf("Expected ErrCertLoadNotFound but got: %v", err)
+	}
+
+	if all, err := IndexCA.CertificateRecords(); err != nil || len(all) != 4 {
+		t.Errorf("Expected 4 certificates records but got %d: %v", len(all), err)
+	}
+
+	if _, err := IndexCA.FindBySerial(big.NewInt(1)); err != ErrCertLoadNotFound {
+		t.Errorf("Expected ErrCertLoadNotFound but got: %v", err)
+	}
+
+	// the database of existent Certificate Authorities is built on its first use
+	if err := store.Delete(filepath.Join("go-index.ca", "ca", "index.json")); err != nil {
+		t.Fatal(err)
+	}
+	ReloadedCA, err := Load("go-index.ca", WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = ReloadedCA.FindBySubject("web.go-index.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Status != CertificateRevoked || records[1].Status != CertificateValid {
+		t.Errorf("Unexpected rebuilt records %+v", records)
+	}
+	if err := ReloadedCA.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReloadedCA.FindBySerial(device.GoCert().SerialNumber); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFunctionalConcurrentIndex(t *testing.T) {
+	root := t.TempDir()
+	store := NewFileSystemStorage(root)
+
+	IndexCA, err := New("go-concurrent-index.ca", Identity{
+		Organization:       "Index Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the readers never see a partially written certificates database
+	const issued = 8
+	errs := make(chan error, 2*issued)
+	for i := 0; i < issued; i++ {
+		go func(commonName string) {
+			_, err := IndexCA.IssueCertificate(commonName, Identity{KeyAlgorithm: key.ECDSAP256})
+			errs <- err
+		}(fmt.Sprintf("%d.go-concurrent-index.ca", i))
+		go func() {
+			_, err := IndexCA.CertificateRecords()
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2*issued; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := IndexCA.CertificateRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != issued {
+		t.Errorf("Expected %d records but got: %d", issued, len(records))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "go-concurrent-index.ca", "ca"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("Temporary file %s was not renamed", entry.Name())
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(root, "go-concurrent-index.ca", "ca", indexFile)); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0644 {
+		t.Errorf("Expected index.json permissions 0644 but got: %s", fi.Mode())
+	}
+	if fi, err := os.Stat(filepath.Join(root, "go-concurrent-index.ca", "ca", "key.pub")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0644 {
+		t.Errorf("Expected key.pub permissions 0644 but got: %s", fi.Mode())
+	}
+
+	// reading a missing CA does not create the storage directories
+	missing := filepath.Join(root, "missing")
+	if _, err := Load("go-missing.ca", WithStorage(NewFileSystemStorage(missing))); err == nil {
+		t.Error("Expected an error loading a missing CA")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Expected %s not to be created but got: %v", missing, err)
+	}
+}
+
+func TestFunctionalExpiryMonitor(t *testing.T) {
+	store := NewMemoryStorage()
+
+	caIdentity := Identity{
+		Organization:       "Expiry Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+		Valid:              400,
+	}
+	RootCA, err := New("go-expiry.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caIdentity.Intermediate = true
+	caIdentity.Valid = 20
+	IntermediateCA, err := NewCA("go-expiry-intermediate.ca", "go-expiry.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, issue := range []struct {
+		ca         CA
+		commonName string
+		valid      int
+	}{
+		{RootCA, "week.go-expiry.ca", 7},
+		{RootCA, "revoked.go-expiry.ca", 5},
+		{RootCA, "year.go-expiry.ca", 300},
+		{IntermediateCA, "ten.go-expiry.ca", 10},
+	} {
+		if _, err := issue.ca.IssueCertificate(issue.commonName, Identity{KeyAlgorithm: key.ECDSAP256, Valid: issue.valid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RootCA.RevokeCertificate("revoked.go-expiry.ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	expirations, err := ScanExpirations(30*24*time.Hour, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, expiration := range expirations {
+		found = append(found, expiration.CA+"/"+expiration.CommonName)
+	}
+	expected := []string{"go-expiry.ca/week.go-expiry.ca", "go-expiry-intermediate.ca/ten.go-expiry.ca", "go-expiry-intermediate.ca/go-expiry-intermediate.ca"}
+	if !slices.Equal(found, expected) {
+		t.Fatalf("Expected the expirations %v but got: %v", expected, found)
+	}
+	if !expirations[2].IsCA || expirations[2].Expired || expirations[2].SerialNumber != IntermediateCA.GoCertificate().SerialNumber.String() {
+		t.Errorf("Unexpected intermediate CA expiration %+v", expirations[2])
+	}
+
+	var notified []Expiration
+	failing := true
+	monitor := &ExpiryMonitor{
+		Within:  30 * 24 * time.Hour,
+		Options: []Option{WithStorage(store)},
+		Sinks: []ExpirySink{
+			ExpirySinkFunc(func(_ context.Context, expiration Expiration) error {
+				notified = append(notified, expiration)
+				return nil
+			}),
+			ExpirySinkFunc(func(context.Context, Expiration) error {
+				if failing {
+					return errors.New("sink unavailable")
+				}
+				return nil
+			}),
+		},
+	}
+	if err := monitor.CheckOnce(context.Background()); err == nil {
+		t.Error("Expected the error of the failing sink")
+	}
+	if len(notified) != 3 {
+		t.Fatalf("Expected 3 notified expirations but got: %d", len(notified))
+	}
+
+	// the expirations are notified once to each sink
+	failing = false
+	if err := monitor.CheckOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 3 {
+		t.Errorf("Expected no new notified expirations but got: %d", len(notified)-3)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := monitor.Run(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled but got: %v", err)
+	}
+}
+
+func TestFunctionalObserver(t *testing.T) {
+	store := NewMemoryStorage()
+
+	var events []Event
+	observer := WithObserver(func(event Event) {
+		events = append(events, event)
+	})
+
+	ObservedCA, err := New("go-observer.ca", Identity{
+		Organization:       "Observer Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store), observer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web, err := ObservedCA.IssueCertificate("web.go-observer.ca", Identity{KeyAlgorithm: key.ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := ObservedCA.RenewCertificate("web.go-observer.ca", RenewOptions{Revoke: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ObservedCA.RevokeCertificate("web.go-observer.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ObservedCA.RevokeCertificate("missing.go-observer.ca"); err == nil {
+		t.Fatal("Expected the revocation of a missing certificate to fail")
+	}
+	if err := ObservedCA.RegenerateCRL(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		operation    Operation
+		commonName   string
+		serialNumber string
+		failed       bool
+	}{
+		{OperationCreate, "go-observer.ca", ObservedCA.GoCertificate().SerialNumber.String(), false},
+		{OperationIssue, "web.go-observer.ca", web.GoCert().SerialNumber.String(), false},
+		{OperationRevoke, "web.go-observer.ca", web.GoCert().SerialNumber.String(), false},
+		{OperationRenew, "web.go-observer.ca", renewed.GoCert().SerialNumber.String(), false},
+		{OperationRevoke, "web.go-observer.ca", renewed.GoCert().SerialNumber.String(), false},
+		{OperationRevoke, "missing.go-observer.ca", "", true},
+		{OperationCRL, "", "", false},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events but got: %+v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.CA != "go-observer.ca" || event.Operation != expected[i].operation || event.CommonName != expected[i].commonName ||
+			event.SerialNumber != expected[i].serialNumber || (event.Err != nil) != expected[i].failed || event.Time.IsZero() {
+			t.Errorf("Unexpected event %d: %+v", i, event)
+		}
+	}
+}
+
+func TestFunctionalKeyExport(t *testing.T) {
+	store := NewMemoryStorage()
+
+	var exports []Event
+	observer := WithObserver(func(event Event) {
+		if event.Operation == OperationExportKey {
+			exports = append(exports, event)
+		}
+	})
+
+	caIdentity := Identity{
+		Organization:       "Export Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}
+	RootCA, err := New("go-export.ca", caIdentity, WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caIdentity.Intermediate = true
+	ExportCA, err := NewCA("go-export-intermediate.ca", "go-export.ca", caIdentity, WithStorage(store), observer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web, err := ExportCA.IssueCertificate("web.go-export.ca", Identity{KeyAlgorithm: key.ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := ExportCA.ExportCertificateKey("web.go-export.ca", KeyFormatPEM, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privateKey, err := key.LoadPrivateKey(exported); err != nil || !publicKeysEqual(privateKey.Public(), web.GoCert().PublicKey) {
+		t.Errorf("Unexpected exported PEM private key: %v", err)
+	}
+
+	if _, err := ExportCA.ExportCertificateKey("web.go-export.ca", KeyFormatPKCS8, nil); err != ErrKeyExportPassword {
+		t.Errorf("Expected ErrKeyExportPassword but got: %v", err)
+	}
+	exported, err = ExportCA.ExportCertificateKey("web.go-export.ca", KeyFormatPKCS8, []byte("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privateKey, err := key.LoadEncryptedPrivateKey(exported, []byte("changeit")); err != nil || !publicKeysEqual(privateKey.Public(), web.GoCert().PublicKey) {
+		t.Errorf("Unexpected exported encrypted PKCS #8 private key: %v", err)
+	}
+
+	exported, err = ExportCA.ExportCertificateKey("web.go-export.ca", KeyFormatPKCS12, []byte("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, certificate, caCerts, err := pkcs12.DecodeChain(exported, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKeysEqual(privateKey.(crypto.Signer).Public(), web.GoCert().PublicKey) || !certificate.Equal(web.certificate) || len(caCerts) != 2 ||
+		!caCerts[0].Equal(ExportCA.GoCertificate()) || !caCerts[1].Equal(RootCA.GoCertificate()) {
+		t.Errorf("Unexpected PKCS #12 %v %v", certificate.Subject, caCerts)
+	}
+
+	if _, err := ExportCA.ExportCertificateKey("web.go-export.ca", "jks", []byte("changeit")); err != ErrKeyExportFormat {
+		t.Errorf("Expected ErrKeyExportFormat but got: %v", err)
+	}
+
+	// the signed CSRs private keys are not kept
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device.go-export.ca"}}, csrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := x509.ParseCertificateRequest(csrBytes)
+	if _, err := ExportCA.SignCSR(*csr, 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExportCA.ExportCertificateKey("device.go-export.ca", KeyFormatPEM, nil); err != ErrKeyNotAvailable {
+		t.Errorf("Expected ErrKeyNotAvailable but got: %v", err)
+	}
+
+	// the CA private key export requires the policy
+	if _, err := ExportCA.ExportPrivateKey(KeyFormatPEM, nil); err != ErrKeyExportNotAllowed {
+		t.Errorf("Expected ErrKeyExportNotAllowed but got: %v", err)
+	}
+	policy, err := ExportCA.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.AllowCAKeyExport = true
+	if err := ExportCA.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	exported, err = ExportCA.ExportPrivateKey(KeyFormatPKCS12, []byte("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, certificate, caCerts, err := pkcs12.DecodeChain(exported, "changeit"); err != nil || !certificate.Equal(ExportCA.GoCertificate()) ||
+		len(caCerts) != 1 || !caCerts[0].Equal(RootCA.GoCertificate()) {
+		t.Errorf("Unexpected CA PKCS #12: %v", err)
+	}
+
+	if len(exports) != 8 || exports[0].CommonName != "web.go-export.ca" || exports[0].SerialNumber != web.GoCert().SerialNumber.String() ||
+		exports[0].Err != nil || exports[1].Err != ErrKeyExportPassword || exports[7].CommonName != "go-export-intermediate.ca" {
+		t.Errorf("Unexpected key export events %+v", exports)
+	}
+}
+
+func TestFunctionalAuditLog(t *testing.T) {
+	store := NewMemoryStorage()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	audit, err := OpenAuditFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var auditErrors []error
+	auditSink := WithAuditSink(audit, func(err error) {
+		auditErrors = append(auditErrors, err)
+	})
+
+	AuditedCA, err := New("go-audit.ca", Identity{
+		Organization:       "Audit Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, WithStorage(store), WithPassphrase([]byte("audit")), WithActor("admin"), auditSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the operations of each loaded CA have their actor
+	LoadedCA, err := Load("go-audit.ca", WithStorage(store), WithPassphrase([]byte("audit")), WithActor("alice"), auditSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := LoadedCA.IssueCertificate("web.go-audit.ca", Identity{KeyAlgorithm: key.ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadedCA.RevokeCertificate("web.go-audit.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load("go-audit.ca", WithStorage(store), WithPassphrase([]byte("wrong")), WithActor("mallory"), auditSink); err == nil {
+		t.Fatal("Expected the load with a wrong passphrase to fail")
+	}
+	if _, err := Load("missing.go-audit.ca", WithStorage(store), auditSink); err != ErrCALoadNotFound {
+		t.Fatalf("Expected ErrCALoadNotFound but got: %v", err)
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain continues after reopening the file
+	audit, err = OpenAuditFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditSink = WithAuditSink(audit, nil)
+	ReopenedCA, err := Load("go-audit.ca", WithStorage(store), WithPassphrase([]byte("audit")), auditSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReopenedCA.RegenerateCRL(); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	if len(auditErrors) != 0 {
+		t.Errorf("Unexpected audit errors %v", auditErrors)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := VerifyAuditLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		actor     string
+		operation Operation
+		subject   string
+		serial    string
+		outcome   string
+	}{
+		{"admin", OperationCreate, "go-audit.ca", AuditedCA.GoCertificate().SerialNumber.String(), AuditSuccess},
+		{"alice", OperationLoadKey, "go-audit.ca", AuditedCA.GoCertificate().SerialNumber.String(), AuditSuccess},
+		{"alice", OperationIssue, "web.go-audit.ca", web.GoCert().SerialNumber.String(), AuditSuccess},
+		{"alice", OperationRevoke, "web.go-audit.ca", web.GoCert().SerialNumber.String(), AuditSuccess},
+		{"mallory", OperationLoadKey, "go-audit.ca", "", AuditFailure},
+		{"", OperationLoadKey, "go-audit.ca", AuditedCA.GoCertificate().SerialNumber.String(), AuditSuccess},
+		{"", OperationCRL, "", "", AuditSuccess},
+	}
+	if count != len(expected) {
+		t.Fatalf("Expected %d audit records but got %d:\n%s", len(expected), count, data)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	for i, line := range lines {
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Sequence != uint64(i+1) || record.CA != "go-audit.ca" || record.Actor != expected[i].actor ||
+			record.Operation != expected[i].operation || record.Subject != expected[i].subject ||
+			record.SerialNumber != expected[i].serial || record.Outcome != expected[i].outcome {
+			t.Errorf("Unexpected audit record %d: %s", i, line)
+		}
+	}
+	if !bytes.Contains(lines[4], []byte(`"error":`)) {
+		t.Errorf("Expected the error of the failed load: %s", lines[4])
+	}
+
+	// changed, removed and reordered records break the chain
+	tampered := map[string][][]byte{
+		"changed":   append(append([][]byte{}, lines[:2]...), append([][]byte{bytes.Replace(lines[2], []byte("alice"), []byte("bob  "), 1)}, lines[3:]...)...),
+		"removed":   append(append([][]byte{}, lines[:3]...), lines[4:]...),
+		"reordered": append(append([][]byte{}, lines[:2]...), append([][]byte{lines[3], lines[2]}, lines[4:]...)...),
+	}
+	for name, records := range tampered {
+		if _, err := VerifyAuditLog(bytes.NewReader(bytes.Join(records, []byte("\n")))); !errors.Is(err, ErrAuditChain) {
+			t.Errorf("Expected ErrAuditChain for the %s record but got: %v", name, err)
+		}
+	}
+
+	// the tampered file is not appended
+	if err := os.WriteFile(path, bytes.Join(tampered["removed"], []byte("\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditFile(path); !errors.Is(err, ErrAuditChain) {
+		t.Errorf("Expected ErrAuditChain opening the tampered file but got: %v", err)
+	}
+}
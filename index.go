@@ -0,0 +1,313 @@
+package goca
+
+import (
+	"crypto/x509"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	storage "github.com/kairoaraujo/goca/v2/_storage"
+	"github.com/kairoaraujo/goca/v2/cert"
+)
+
+// indexFile keeps the certificates database of the Certificate Authority
+const indexFile = "index.json"
+
+// indexMu serializes the updates of the certificates databases, the readers
+// hold its read lock
+var indexMu sync.RWMutex
+
+// CertificateStatus is the status of an issued certificate
+type CertificateStatus string
+
+// Certificate status in the certificates database
+const (
+	CertificateValid   CertificateStatus = "valid"
+	CertificateRevoked CertificateStatus = "revoked"
+	CertificateExpired CertificateStatus = "expired" // Valid status after the certificate NotAfter
+)
+
+// CertificateRecord is an entry of the certificates database of the
+// Certificate Authority, kept in <CA>/ca/index.json.
+//
+// Every certificate issued by the Certificate Authority has a record, the
+// current certificates and the ones archived by RenewCertificate.
+type CertificateRecord struct {
+	SerialNumber     string            `json:"serial_number" example:"338255903472757769326153358304310617728"`
+	CommonName       string            `json:"common_name" example:"intranet.go-root"`
+	Subject          string            `json:"subject" example:"CN=intranet.go-root,O=Company"`
+	DNSNames         []string          `json:"dns_names,omitempty"`
+	IPAddresses      []string          `json:"ip_addresses,omitempty"`
+	EmailAddresses   []string          `json:"email_addresses,omitempty"`
+	URIs             []string          `json:"uris,omitempty"`
+	NotBefore        time.Time         `json:"not_before"`
+	NotAfter         time.Time         `json:"not_after"`
+	Status           CertificateStatus `json:"status" example:"valid"`
+	RevocationTime   *time.Time        `json:"revocation_time,omitempty"`
+	RevocationReason string            `json:"revocation_reason,omitempty" example:"key_compromise"`
+	InvalidityDate   *time.Time        `json:"invalidity_date,omitempty"`
+	Profile          string            `json:"profile,omitempty" example:"tls-server"`                             // Certificate profile of the issuance, empty when unknown
+	Path             string            `json:"path" example:"go-root/certs/intranet.go-root/intranet.go-root.crt"` // Storage path of the certificate file
+}
+
+// StatusAt returns the status of the certificate at the time, the revoked
+// status or CertificateExpired after NotAfter.
+func (r CertificateRecord) StatusAt(t time.Time) CertificateStatus {
+	if r.Status == CertificateValid && t.After(r.NotAfter) {
+		return CertificateExpired
+	}
+
+	return r.Status
+}
+
+// Archived reports whether the certificate was replaced by a renewal
+func (r CertificateRecord) Archived() bool {
+	return filepath.Base(filepath.Dir(filepath.Dir(r.Path))) == storage.ArchiveFolder
+}
+
+// newCertificateRecord returns the valid record of the certificate stored in
+// path
+func newCertificateRecord(certificate *x509.Certificate, path string) CertificateRecord {
+	record := CertificateRecord{
+		SerialNumber:   certificate.SerialNumber.String(),
+		CommonName:     certificate.Subject.CommonName,
+		Subject:        certificate.Subject.String(),
+		DNSNames:       certificate.DNSNames,
+		EmailAddresses: certificate.EmailAddresses,
+		NotBefore:      certificate.NotBefore,
+		NotAfter:       certificate.NotAfter,
+		Status:         CertificateValid,
+		Path:           path,
+	}
+
+	for _, ip := range certificate.IPAddresses {
+		record.IPAddresses = append(record.IPAddresses, ip.String())
+	}
+	for _, uri := range certificate.URIs {
+		record.URIs = append(record.URIs, uri.String())
+	}
+
+	return record
+}
+
+// revoke sets the revocation of the CRL entry, or the valid status without it
+func (r *CertificateRecord) revoke(entry *x509.RevocationListEntry) {
+	r.Status = CertificateValid
+	r.RevocationTime = nil
+	r.RevocationReason = ""
+	r.InvalidityDate = nil
+
+	if entry == nil {
+		return
+	}
+
+	revocationTime := entry.RevocationTime
+	r.Status = CertificateRevoked
+	r.RevocationTime = &revocationTime
+	r.RevocationReason = cert.RevocationReason(entry.ReasonCode).String()
+	if invalidityDate := cert.InvalidityDate(*entry); !invalidityDate.IsZero() {
+		r.InvalidityDate = &invalidityDate
+	}
+}
+
+// readIndex returns the certificates database under the read lock of indexMu,
+// it is built under the write lock on its first use
+func (c *CA) readIndex() ([]CertificateRecord, error) {
+	var records []CertificateRecord
+
+	indexMu.RLock()
+	found, err := c.getJSON(c.CommonName, indexFile, &records)
+	indexMu.RUnlock()
+	if err != nil || found {
+		return records, err
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	return c.loadIndex()
+}
+
+// loadIndex returns the certificates database, building it from the stored
+// certificates when it does not exist yet. The caller holds the write lock of
+// indexMu.
+func (c *CA) loadIndex() ([]CertificateRecord, error) {
+	var records []CertificateRecord
+
+	found, err := c.getJSON(c.CommonName, indexFile, &records)
+	if err != nil || found {
+		return records, err
+	}
+
+	return c.buildIndex()
+}
+
+// buildIndex builds and stores the certificates database from the current and
+// archived certificates and the CRL
+func (c *CA) buildIndex() ([]CertificateRecord, error) {
+	records := []CertificateRecord{}
+
+	add := func(path string) error {
+		certString, err := c.storage.Get(path)
+		if err != nil {
+			return nil
+		}
+
+		certificate, err := cert.LoadCert(certString)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, newCertificateRecord(certificate, path))
+
+		return nil
+	}
+
+	for _, commonName := range c.ListCertificates() {
+		certDir := filepath.Join(c.CommonName, "certs", commonName)
+
+		for _, serial := range storage.ListArchivedCertificates(c.storage, c.CommonName, commonName) {
+			if err := add(filepath.Join(certDir, storage.ArchiveFolder, serial, commonName+certExtension)); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := add(filepath.Join(certDir, commonName+certExtension)); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b CertificateRecord) int {
+		return a.NotBefore.Compare(b.NotBefore)
+	})
+
+	var crl *x509.RevocationList
+	if crlString, err := storage.LoadFile(c.storage, c.CommonName, "ca", c.CommonName+crlExtension); err == nil {
+		if crl, err = cert.LoadCRL(crlString); err != nil {
+			return nil, err
+		}
+	}
+	syncRevocations(records, crl)
+
+	return records, c.putJSON(c.CommonName, indexFile, records)
+}
+
+// syncRevocations updates the status of the records from the CRL
+func syncRevocations(records []CertificateRecord, crl *x509.RevocationList) {
+	revoked := map[string]*x509.RevocationListEntry{}
+	if crl != nil {
+		for i, entry := range crl.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.String()] = &crl.RevokedCertificateEntries[i]
+		}
+	}
+
+	for i := range records {
+		records[i].revoke(revoked[records[i].SerialNumber])
+	}
+}
+
+// updateIndex applies update to the stored certificates database
+func (c *CA) updateIndex(update func(records []CertificateRecord) []CertificateRecord) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	records, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+
+	return c.putJSON(c.CommonName, indexFile, update(records))
+}
+
+// indexCertificate adds the certificate issued with the profile and stored in
+// path to the certificates database
+func (c *CA) indexCertificate(certificate *x509.Certificate, path, profile string) error {
+	record := newCertificateRecord(certificate, path)
+	record.Profile = profile
+
+	return c.updateIndex(func(records []CertificateRecord) []CertificateRecord {
+		// the database built on the first use already has the certificate
+		if i := slices.IndexFunc(records, func(r CertificateRecord) bool { return r.SerialNumber == record.SerialNumber }); i >= 0 {
+			records[i] = record
+			return records
+		}
+
+		return append(records, record)
+	})
+}
+
+// indexPath updates the storage path of the certificate in the certificates
+// database
+func (c *CA) indexPath(serialNumber *big.Int, path string) error {
+	return c.updateIndex(func(records []CertificateRecord) []CertificateRecord {
+		for i := range records {
+			if records[i].SerialNumber == serialNumber.String() {
+				records[i].Path = path
+			}
+		}
+
+		return records
+	})
+}
+
+// indexRevocations updates the status of the certificates from the CRL
+func (c *CA) indexRevocations(crl *x509.RevocationList) error {
+	return c.updateIndex(func(records []CertificateRecord) []CertificateRecord {
+		syncRevocations(records, crl)
+
+		return records
+	})
+}
+
+func (c *CA) findBySerial(serialNumber *big.Int) (CertificateRecord, error) {
+	records, err := c.readIndex()
+	if err != nil {
+		return CertificateRecord{}, err
+	}
+
+	for _, record := range records {
+		if record.SerialNumber == serialNumber.String() {
+			return record, nil
+		}
+	}
+
+	return CertificateRecord{}, ErrCertLoadNotFound
+}
+
+// loadCertificateBySerial loads the certificate, current or archived, issued
+// with the serial number
+func (c *CA) loadCertificateBySerial(serialNumber *big.Int) (*x509.Certificate, error) {
+	record, err := c.findBySerial(serialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	certString, err := storage.LoadFile(c.storage, record.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert.LoadCert(certString)
+}
+
+func (c *CA) certificateRecords() ([]CertificateRecord, error) {
+	return c.readIndex()
+}
+
+func (c *CA) findBySubject(subject string) ([]CertificateRecord, error) {
+	records, err := c.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []CertificateRecord
+	for _, record := range records {
+		if record.Subject == subject || record.CommonName == subject {
+			found = append(found, record)
+		}
+	}
+
+	return found, nil
+}
@@ -0,0 +1,255 @@
+// Package pkcs8 implements passphrase protected PKCS #8 private keys
+// (EncryptedPrivateKeyInfo, RFC 5958) using PBES2 (RFC 8018).
+//
+// Keys are encrypted with AES-256-GCM using a key derived from the passphrase
+// with scrypt (RFC 7914). Decryption also supports PBKDF2 and AES-128-GCM.
+package pkcs8
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrIncorrectPassphrase means that the private key could not be decrypted
+// with the given passphrase
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase or corrupted private key")
+
+// ErrUnsupportedEncryption means that the encryption scheme is not supported
+var ErrUnsupportedEncryption = errors.New("unsupported private key encryption scheme")
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// scrypt parameters used on encryption
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	saltSize      = 16
+	aes256KeySize = 32
+	gcmTagSize    = 16
+)
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+func algorithmIdentifier(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	paramsBytes, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oid,
+		Parameters: asn1.RawValue{FullBytes: paramsBytes},
+	}, nil
+}
+
+// IsEncrypted returns if der is a PKCS #8 EncryptedPrivateKeyInfo.
+func IsEncrypted(der []byte) bool {
+	var info encryptedPrivateKeyInfo
+	rest, err := asn1.Unmarshal(der, &info)
+
+	return err == nil && len(rest) == 0 && info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2)
+}
+
+// Encrypt encrypts the PKCS #8 private key der with the passphrase and returns
+// the DER encoded EncryptedPrivateKeyInfo.
+func Encrypt(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, aes256KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	kdf, err := algorithmIdentifier(oidScrypt, scryptParams{
+		Salt:                     salt,
+		CostParameter:            scryptN,
+		BlockSize:                scryptR,
+		ParallelizationParameter: scryptP,
+		KeyLength:                aes256KeySize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encryptionScheme, err := algorithmIdentifier(oidAES256GCM, gcmParams{Nonce: nonce, ICVLen: gcmTagSize})
+	if err != nil {
+		return nil, err
+	}
+
+	encryptionAlgorithm, err := algorithmIdentifier(oidPBES2, pbes2Params{
+		KeyDerivationFunc: kdf,
+		EncryptionScheme:  encryptionScheme,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: encryptionAlgorithm,
+		EncryptedData:       aead.Seal(nil, nonce, der, nil),
+	})
+}
+
+// Decrypt decrypts the DER encoded EncryptedPrivateKeyInfo with the
+// passphrase and returns the PKCS #8 private key.
+func Decrypt(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, ErrUnsupportedEncryption
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	var keySize int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256GCM):
+		keySize = 32
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128GCM):
+		keySize = 16
+	default:
+		return nil, ErrUnsupportedEncryption
+	}
+
+	var gcm gcmParams
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &gcm); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCMWithNonceSize(block, len(gcm.Nonce))
+	if err != nil {
+		return nil, err
+	}
+
+	if gcm.ICVLen != aead.Overhead() {
+		return nil, ErrUnsupportedEncryption
+	}
+
+	plaintext, err := aead.Open(nil, gcm.Nonce, info.EncryptedData, nil)
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return plaintext, nil
+}
+
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keySize int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if params.KeyLength != 0 && params.KeyLength != keySize {
+			return nil, ErrUnsupportedEncryption
+		}
+		return scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keySize)
+
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if params.KeyLength != 0 && params.KeyLength != keySize {
+			return nil, ErrUnsupportedEncryption
+		}
+
+		var prf func() hash.Hash
+		switch {
+		case len(params.PRF.Algorithm) == 0 || params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			prf = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			prf = sha256.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA512):
+			prf = sha512.New
+		default:
+			return nil, ErrUnsupportedEncryption
+		}
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keySize, prf), nil
+	}
+
+	return nil, ErrUnsupportedEncryption
+}
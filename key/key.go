@@ -20,46 +20,137 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-// Package key provides RSA Key API management for crypto/x509/rsa.
+// Package key provides Key API management for crypto/x509.
 //
-// This package makes easy to generate Keys and load RSA from files to be
-// used by GoLang applications.
+// This package makes easy to generate Keys and load RSA, ECDSA and Ed25519
+// keys from files to be used by GoLang applications.
 //
-// Generating RSA Keys, the files will be saved in the $CAPATH by default.
-// For $CAPATH, please check out the GoCA documentation.
+// Generating Keys, the files will be saved in the given Storage, the
+// $CAPATH by default. For $CAPATH, please check out the GoCA documentation.
 package key
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"strings"
 
 	storage "github.com/kairoaraujo/goca/v2/_storage"
+	"github.com/kairoaraujo/goca/v2/internal/pkcs8"
 )
 
-// KeysData represents the RSA keys with Private Key (Key) and Public Key (Public Key).
+// Algorithm represents the private key algorithm
+type Algorithm string
+
+const (
+	// RSA key, the size is defined by the bit size (default: 2048)
+	RSA Algorithm = "rsa"
+	// ECDSAP256 is an ECDSA key using the NIST P-256 curve
+	ECDSAP256 Algorithm = "ecdsa-p256"
+	// ECDSAP384 is an ECDSA key using the NIST P-384 curve
+	ECDSAP384 Algorithm = "ecdsa-p384"
+	// ECDSAP521 is an ECDSA key using the NIST P-521 curve
+	ECDSAP521 Algorithm = "ecdsa-p521"
+	// Ed25519 is an Ed25519 key
+	Ed25519 Algorithm = "ed25519"
+)
+
+// ErrUnsupportedAlgorithm means that the key algorithm is not supported
+var ErrUnsupportedAlgorithm = errors.New("unsupported key algorithm, use one of 'rsa', 'ecdsa-p256', 'ecdsa-p384', 'ecdsa-p521' or 'ed25519'")
+
+// ErrInvalidPEM means that the data is not a valid PEM block
+var ErrInvalidPEM = errors.New("failed to decode PEM data")
+
+// ErrPassphraseRequired means that the private key is encrypted and no
+// passphrase was given
+var ErrPassphraseRequired = errors.New("the private key is encrypted, a passphrase is required")
+
+// ErrIncorrectPassphrase means that the private key could not be decrypted
+// with the given passphrase
+var ErrIncorrectPassphrase = pkcs8.ErrIncorrectPassphrase
+
+const encryptedPEMType = "ENCRYPTED PRIVATE KEY"
+
+// KeysData represents the keys with Private Key (Key) and Public Key (Public Key).
+//
+// Key is one of *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey and
+// PublicKey the matching public key.
 type KeysData struct {
-	Key       rsa.PrivateKey
-	PublicKey rsa.PublicKey
+	Key       crypto.Signer
+	PublicKey crypto.PublicKey
 }
 
-// CreateKeys creates RSA private and public keyData that contains Key and PublicKey.
+// GenerateKey generates a new private key using the algorithm.
 //
-// The files are stored in the $CAPATH
-func CreateKeys(CACommonName, commonName string, creationType storage.CreationType, bitSize int) (KeysData, error) {
+// The bitSize is only used by RSA keys. An empty algorithm means RSA.
+func GenerateKey(algorithm Algorithm, bitSize int) (crypto.Signer, error) {
 	reader := rand.Reader
-	if bitSize == 0 {
-		bitSize = 2048
+
+	switch Algorithm(strings.ToLower(string(algorithm))) {
+	case "", RSA:
+		if bitSize == 0 {
+			bitSize = 2048
+		}
+		return rsa.GenerateKey(reader, bitSize)
+
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), reader)
+
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), reader)
+
+	case ECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), reader)
+
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(reader)
+		return key, err
+	}
+
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// PublicKeyAlgorithm returns the algorithm and, for RSA, the bit size of the
+// public key, to generate a key of the same type.
+func PublicKeyAlgorithm(publicKey crypto.PublicKey) (Algorithm, int, error) {
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		return RSA, pub.N.BitLen(), nil
+
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return ECDSAP256, 0, nil
+		case elliptic.P384():
+			return ECDSAP384, 0, nil
+		case elliptic.P521():
+			return ECDSAP521, 0, nil
+		}
+
+	case ed25519.PublicKey:
+		return Ed25519, 0, nil
 	}
 
-	key, err := rsa.GenerateKey(reader, bitSize)
+	return "", 0, ErrUnsupportedAlgorithm
+}
 
+// CreateKeys creates private and public keyData that contains Key and PublicKey.
+//
+// The files are stored in the Storage s. When passphrase is not empty the
+// private key is stored as an encrypted PKCS #8 file.
+func CreateKeys(s storage.Storage, CACommonName, commonName string, creationType storage.CreationType, algorithm Algorithm, bitSize int, passphrase []byte) (KeysData, error) {
+	key, err := GenerateKey(algorithm, bitSize)
 	if err != nil {
 		return KeysData{}, err
 	}
 
-	publicKey := key.PublicKey
+	publicKey := key.Public()
 
 	fileData := storage.File{
 		CA:             CACommonName,
@@ -67,38 +158,144 @@ func CreateKeys(CACommonName, commonName string, creationType storage.CreationTy
 		FileType:       storage.FileTypeKey,
 		PrivateKeyData: key,
 		PublicKeyData:  publicKey,
+		Passphrase:     passphrase,
 		CreationType:   creationType,
 	}
 
-	err = storage.SaveFile(fileData)
+	err = storage.SaveFile(s, fileData)
 	if err != nil {
 		return KeysData{}, err
 	}
 
 	keys := KeysData{
-		Key:       *key,
+		Key:       key,
 		PublicKey: publicKey,
 	}
 
 	return keys, nil
 }
 
-// LoadPrivateKey loads a RSA Private Key from a read file.
+// CreateSignerKeys stores the public key of a private key kept outside of the
+// Storage, for example in a HSM, and returns the keyData with the signer as Key.
+func CreateSignerKeys(s storage.Storage, CACommonName, commonName string, creationType storage.CreationType, signer crypto.Signer) (KeysData, error) {
+	publicKey := signer.Public()
+
+	fileData := storage.File{
+		CA:            CACommonName,
+		CommonName:    commonName,
+		FileType:      storage.FileTypeKey,
+		PublicKeyData: publicKey,
+		CreationType:  creationType,
+	}
+
+	if err := storage.SaveFile(s, fileData); err != nil {
+		return KeysData{}, err
+	}
+
+	return KeysData{Key: signer, PublicKey: publicKey}, nil
+}
+
+// IsEncrypted returns if the read private key file is encrypted.
+func IsEncrypted(keyString []byte) bool {
+	block, _ := pem.Decode(keyString)
+
+	return block != nil && block.Type == encryptedPEMType
+}
+
+// LoadPrivateKey loads a Private Key from a read file.
 //
+// PKCS #8, PKCS #1 (RSA) and SEC 1 (ECDSA) encodings are supported. Encrypted
+// keys return ErrPassphraseRequired, use LoadEncryptedPrivateKey.
 // Using ioutil.ReadFile() satisfyies it.
-func LoadPrivateKey(keyString []byte) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode([]byte(string(keyString)))
-	privateKey, _ := x509.ParsePKCS1PrivateKey(block.Bytes)
+func LoadPrivateKey(keyString []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyString)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
+
+	if block.Type == encryptedPEMType {
+		return nil, ErrPassphraseRequired
+	}
+
+	return parsePrivateKey(block.Bytes)
+}
+
+// LoadEncryptedPrivateKey loads a Private Key from a read file, decrypting it
+// with the passphrase.
+//
+// Unencrypted keys are loaded as LoadPrivateKey does.
+func LoadEncryptedPrivateKey(keyString, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyString)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
+
+	if block.Type != encryptedPEMType {
+		return parsePrivateKey(block.Bytes)
+	}
+
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+
+	keyBytes, err := pkcs8.Decrypt(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePrivateKey(keyBytes)
+}
 
-	return privateKey, nil
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if privateKey, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		return signer, nil
+	}
+
+	if privateKey, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return privateKey, nil
+	}
+
+	return x509.ParseECPrivateKey(der)
 }
 
-// LoadPublicKey loads a RSA Public Key from a read file.
+// EncodePrivateKey returns the PEM encoded PKCS #8 private key, encrypted with
+// the passphrase when it is not empty. The encrypted keys are loaded with
+// LoadEncryptedPrivateKey.
+func EncodePrivateKey(privateKey crypto.Signer, passphrase []byte) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+	}
+
+	encryptedBytes, err := pkcs8.Encrypt(keyBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedPEMType, Bytes: encryptedBytes}), nil
+}
+
+// LoadPublicKey loads a Public Key from a read file.
 //
+// PKIX and PKCS #1 (RSA) encodings are supported.
 // Using ioutil.ReadFile() satisfyies it.
-func LoadPublicKey(keyString []byte) (*rsa.PublicKey, error) {
-	block, _ := pem.Decode([]byte(string(keyString)))
-	publicKey, _ := x509.ParsePKCS1PublicKey(block.Bytes)
+func LoadPublicKey(keyString []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(keyString)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
+
+	if publicKey, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return publicKey, nil
+	}
 
-	return publicKey, nil
+	return x509.ParsePKCS1PublicKey(block.Bytes)
 }
@@ -0,0 +1,62 @@
+package goca
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// Operation is a Certificate Authority operation reported to the observers
+type Operation string
+
+// Certificate Authority operations
+const (
+	OperationCreate      Operation = "create"       // NewCA and New
+	OperationLoadKey     Operation = "load-key"     // Load, reading or unlocking the CA private key
+	OperationIssue       Operation = "issue"        // IssueCertificate
+	OperationSign        Operation = "sign"         // SignCSR and SignCSRWithProfile
+	OperationRenew       Operation = "renew"        // RenewCertificate
+	OperationRevoke      Operation = "revoke"       // RevokeCertificate, RevokeCertificateWithReason and RevokeCertificateBySerial
+	OperationReleaseHold Operation = "release-hold" // ReleaseCertificateHold
+	OperationCRL         Operation = "crl"          // RegenerateCRL
+	OperationExportKey   Operation = "export-key"   // ExportCertificateKey and ExportPrivateKey
+)
+
+// Event is a Certificate Authority operation, successful or failed, reported
+// to the observers given by WithObserver.
+type Event struct {
+	Operation    Operation // Operation of the Certificate Authority
+	Actor        string    // Actor of the operation given by WithActor, empty when unknown
+	CA           string    // Common name of the Certificate Authority
+	CommonName   string    // Common name of the certificate, empty for OperationCRL
+	SerialNumber string    // Serial number of the certificate, empty when unknown
+	Time         time.Time // Time of the operation
+	Err          error     // Error of the failed operation
+}
+
+// Observer receives the events of the Certificate Authority operations. It is
+// called synchronously after each operation and must not block.
+type Observer func(Event)
+
+// notify reports the operation to the observers
+func (c *CA) notify(operation Operation, commonName string, certificate *x509.Certificate, err error) {
+	if len(c.observers) == 0 {
+		return
+	}
+
+	event := Event{
+		Operation:  operation,
+		Actor:      c.actor,
+		CA:         c.CommonName,
+		CommonName: commonName,
+		Time:       time.Now(),
+		Err:        err,
+	}
+	if certificate != nil {
+		event.CommonName = certificate.Subject.CommonName
+		event.SerialNumber = certificate.SerialNumber.String()
+	}
+
+	for _, observer := range c.observers {
+		observer(event)
+	}
+}
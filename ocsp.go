@@ -0,0 +1,148 @@
+package goca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+
+	storage "github.com/kairoaraujo/goca/v2/_storage"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspValidity is the time the OCSP responses can be cached (NextUpdate)
+const ocspValidity = time.Hour
+
+// ErrOCSPRequest means that the OCSP request is malformed.
+var ErrOCSPRequest = errors.New("malformed OCSP request")
+
+// ErrOCSPIssuer means that the OCSP request is about a certificate issued by
+// another Certificate Authority.
+var ErrOCSPIssuer = errors.New("the OCSP request is not for this Certificate Authority")
+
+// ErrOCSPSigner means that the delegated OCSP signer certificate is expired or
+// its private key is not available.
+var ErrOCSPSigner = errors.New("the delegated OCSP signer is expired or its private key is not available")
+
+func (c *CA) ocspResponse(request []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(request)
+	if err != nil {
+		return nil, ErrOCSPRequest
+	}
+
+	if !ocspIssuerMatches(req, c.Data.certificate) {
+		return nil, ErrOCSPIssuer
+	}
+
+	policy, err := c.issuancePolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		responderCert *x509.Certificate = c.Data.certificate
+		responderKey  crypto.Signer     = c.Data.privateKey
+		delegated     *x509.Certificate
+	)
+
+	if policy.OCSPSigner != "" {
+		signer, err := c.loadCertificate(policy.OCSPSigner)
+		if err != nil {
+			return nil, err
+		}
+
+		if signer.privateKey == nil || signer.certificate == nil || time.Now().After(signer.certificate.NotAfter) {
+			return nil, ErrOCSPSigner
+		}
+
+		responderCert = signer.certificate
+		responderKey = signer.privateKey
+		delegated = signer.certificate
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspValidity),
+		IssuerHash:   req.HashAlgorithm,
+		Certificate:  delegated,
+	}
+
+	revoked, err := c.revocationEntry(req.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked != nil {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = revoked.RevocationTime
+		template.RevocationReason = revoked.ReasonCode
+	} else if c.issuedSerialNumber(req.SerialNumber) {
+		template.Status = ocsp.Good
+	}
+
+	return ocsp.CreateResponse(c.Data.certificate, responderCert, template, responderKey)
+}
+
+// ocspIssuerMatches reports whether the request issuer name and key hashes are
+// from caCert
+func ocspIssuerMatches(req *ocsp.Request, caCert *x509.Certificate) bool {
+	if caCert == nil || !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var publicKeyInfo struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(caCert.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	if !bytes.Equal(h.Sum(nil), req.IssuerKeyHash) {
+		return false
+	}
+
+	h.Reset()
+	h.Write(caCert.RawSubject)
+
+	return bytes.Equal(h.Sum(nil), req.IssuerNameHash)
+}
+
+// revocationEntry returns the CRL entry of the serial number or nil when the
+// certificate is not revoked
+func (c *CA) revocationEntry(serialNumber *big.Int) (*x509.RevocationListEntry, error) {
+	crlString, err := storage.LoadFile(c.storage, c.CommonName, "ca", c.CommonName+crlExtension)
+	if err != nil {
+		return nil, nil
+	}
+
+	crl, err := cert.LoadCRL(crlString)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(serialNumber) == 0 {
+			return &entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// issuedSerialNumber reports whether the Certificate Authority issued a
+// certificate with the serial number, current or archived by a renewal
+func (c *CA) issuedSerialNumber(serialNumber *big.Int) bool {
+	_, err := c.findBySerial(serialNumber)
+
+	return err == nil
+}
@@ -0,0 +1,135 @@
+//go:build cgo
+
+// Package pkcs11 provides Certificate Authority private keys kept in PKCS #11
+// tokens (HSMs, smart cards, SoftHSM) as crypto.Signer.
+//
+// The private keys never leave the token. The keys are identified by the
+// label, which is the Certificate Authority common name when used with
+// goca.WithSignerProvider.
+//
+//	token, err := pkcs11.Open(pkcs11.Config{
+//		Module:     "/usr/lib/softhsm/libsofthsm2.so",
+//		TokenLabel: "goca",
+//		PIN:        "1234",
+//	})
+//	...
+//	signer, err := token.GenerateKey("mycompany.com", key.ECDSAP256, 0)
+//	RootCA, err := goca.New("mycompany.com", identity, goca.WithSigner(signer))
+//	...
+//	RootCA, err = goca.Load("mycompany.com", goca.WithSignerProvider(token.Signer))
+//
+// This package requires cgo.
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/kairoaraujo/goca/v2/key"
+)
+
+// ErrKeyNotFound means that there is no key with the label in the token
+var ErrKeyNotFound = errors.New("the requested key does not exist in the PKCS #11 token")
+
+// ErrKeyExists means that a key with the label already exists in the token
+var ErrKeyExists = errors.New("a key with this label already exists in the PKCS #11 token")
+
+// Config represents the PKCS #11 token configuration
+type Config struct {
+	Module     string // PKCS #11 module (shared library) path
+	TokenLabel string // Token label, used when SlotNumber is nil
+	SlotNumber *int   // Token slot number
+	PIN        string // User PIN
+}
+
+// Token is an open session to a PKCS #11 token
+type Token struct {
+	ctx *crypto11.Context
+}
+
+// Open opens a session and logs in the PKCS #11 token.
+func Open(config Config) (*Token, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		SlotNumber: config.SlotNumber,
+		Pin:        config.PIN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{ctx: ctx}, nil
+}
+
+// Close closes the token session.
+func (t *Token) Close() error {
+	return t.ctx.Close()
+}
+
+// GenerateKey generates a new private key labeled label inside the token.
+//
+// RSA and ECDSA algorithms are supported. The bitSize is only used by RSA
+// keys (default: 2048).
+func (t *Token) GenerateKey(label string, algorithm key.Algorithm, bitSize int) (crypto.Signer, error) {
+	existent, err := t.ctx.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	if existent != nil {
+		return nil, ErrKeyExists
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	switch key.Algorithm(strings.ToLower(string(algorithm))) {
+	case "", key.RSA:
+		if bitSize == 0 {
+			bitSize = 2048
+		}
+		return t.ctx.GenerateRSAKeyPairWithLabel(id, []byte(label), bitSize)
+
+	case key.ECDSAP256:
+		return t.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P256())
+
+	case key.ECDSAP384:
+		return t.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P384())
+
+	case key.ECDSAP521:
+		return t.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P521())
+	}
+
+	return nil, key.ErrUnsupportedAlgorithm
+}
+
+// FindKey returns the private key labeled label.
+func (t *Token) FindKey(label string) (crypto.Signer, error) {
+	signer, err := t.Signer(label)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return signer, nil
+}
+
+// Signer returns the private key of the Certificate Authority commonName or
+// nil when it is not in the token. It is a goca.SignerProvider.
+func (t *Token) Signer(commonName string) (crypto.Signer, error) {
+	signer, err := t.ctx.FindKeyPair(nil, []byte(commonName))
+	if err != nil || signer == nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,83 @@
+//go:build cgo
+
+package pkcs11_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/key"
+	"github.com/kairoaraujo/goca/v2/pkcs11"
+)
+
+// TestFunctionalSoftHSM requires an initialized SoftHSM token:
+//
+//	softhsm2-util --init-token --free --label goca --pin 1234 --so-pin 1234
+//	GOCA_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so GOCA_PKCS11_TOKEN=goca GOCA_PKCS11_PIN=1234 go test ./pkcs11/
+func TestFunctionalSoftHSM(t *testing.T) {
+	module := os.Getenv("GOCA_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("GOCA_PKCS11_MODULE is not set")
+	}
+
+	token, err := pkcs11.Open(pkcs11.Config{
+		Module:     module,
+		TokenLabel: os.Getenv("GOCA_PKCS11_TOKEN"),
+		PIN:        os.Getenv("GOCA_PKCS11_PIN"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.Close()
+
+	store := goca.NewMemoryStorage()
+	id := goca.Identity{
+		Organization:       "SoftHSM CA Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}
+
+	signer, err := token.GenerateKey("go-softhsm.ca", key.ECDSAP256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := token.GenerateKey("go-softhsm.ca", key.ECDSAP256, 0); err != pkcs11.ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists but got: %v", err)
+	}
+
+	if _, err := goca.New("go-softhsm.ca", id, goca.WithStorage(store), goca.WithSigner(signer)); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Exists("go-softhsm.ca/ca/key.pem") {
+		t.Error("SoftHSM CA private key was written to the storage")
+	}
+
+	SoftHSMCA, err := goca.Load("go-softhsm.ca", goca.WithStorage(store), goca.WithSignerProvider(token.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := SoftHSMCA.IssueCertificate("w3.go-softhsm.ca", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafCert := leaf.GoCert()
+	if err := leafCert.CheckSignatureFrom(SoftHSMCA.GoCertificate()); err != nil {
+		t.Error(err)
+	}
+
+	if err := SoftHSMCA.RevokeCertificate("w3.go-softhsm.ca"); err != nil {
+		t.Error(err)
+	}
+
+	id.Intermediate = true
+	if _, err := goca.NewCA("go-softhsm-intermediate.ca", "go-softhsm.ca", id, goca.WithStorage(store), goca.WithSignerProvider(token.Signer)); err != nil {
+		t.Error(err)
+	}
+}
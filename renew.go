@@ -0,0 +1,268 @@
+package goca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"time"
+
+	storage "github.com/kairoaraujo/goca/v2/_storage"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/key"
+)
+
+// ErrRenewRekeyCSR means that a renewal asked to rekey and to certify a CSR
+var ErrRenewRekeyCSR = errors.New("the certificate renewal can rekey or certify a CSR, not both")
+
+// ErrRenewCommonName means that the renewal CSR is for another common name
+var ErrRenewCommonName = errors.New("the renewal CSR common name must be the certificate common name")
+
+// ErrRenewCSRNotFound means that the certificate has no stored CSR to sign
+// again, the renewal must rekey or certify a new CSR
+var ErrRenewCSRNotFound = errors.New("the certificate has no stored Certificate Signing Request, rekey or use a new CSR")
+
+// RenewOptions are the options of a certificate renewal. Without Rekey or CSR
+// the stored CSR, and so the same key, is certified again.
+type RenewOptions struct {
+	Rekey    bool                     // Creates a new private key with the algorithm of the current key
+	CSR      *x509.CertificateRequest // Certifies the key of a new CSR, with the same common name
+	Validity time.Duration            // Validity of the new certificate, 0 uses the default validity
+	Profile  string                   // Certificate profile of the new certificate (default: the profile of the current certificate)
+	Revoke   bool                     // Revokes the previous certificate with the cert.Superseded reason
+}
+
+// certificateFiles are the files of a certificate directory that are archived
+// and replaced by a renewal
+func certificateFiles(commonName string) []string {
+	return []string{commonName + certExtension, commonName + csrExtension, storage.PEMFile, storage.PublicPEMFile}
+}
+
+func (c *CA) renewCertificate(commonName string, opts RenewOptions) (certificate Certificate, err error) {
+
+	if opts.Rekey && opts.CSR != nil {
+		return certificate, ErrRenewRekeyCSR
+	}
+
+	current, err := c.loadCertificate(commonName)
+	if err != nil {
+		return certificate, err
+	} else if current.certificate == nil {
+		return certificate, ErrCertLoadNotFound
+	}
+
+	// the profile of the current certificate is kept by default, the
+	// records built from the stored certificates have no profile
+	if opts.Profile == "" {
+		record, err := c.findBySerial(current.certificate.SerialNumber)
+		if err != nil && !errors.Is(err, ErrCertLoadNotFound) {
+			return certificate, err
+		}
+		opts.Profile = record.Profile
+	}
+
+	// the CSR is prepared before any file changes
+	var (
+		csr    x509.CertificateRequest
+		newKey crypto.Signer
+	)
+	switch {
+	case opts.CSR != nil:
+		if opts.CSR.Subject.CommonName != commonName {
+			return certificate, ErrRenewCommonName
+		}
+		csr = *opts.CSR
+
+	case opts.Rekey:
+		algorithm, bitSize, err := key.PublicKeyAlgorithm(current.certificate.PublicKey)
+		if err != nil {
+			return certificate, err
+		}
+		if newKey, err = key.GenerateKey(algorithm, bitSize); err != nil {
+			return certificate, err
+		}
+
+		csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:        current.certificate.Subject,
+			DNSNames:       current.certificate.DNSNames,
+			EmailAddresses: current.certificate.EmailAddresses,
+			IPAddresses:    current.certificate.IPAddresses,
+			URIs:           current.certificate.URIs,
+		}, newKey)
+		if err != nil {
+			return certificate, err
+		}
+		parsed, err := x509.ParseCertificateRequest(csrBytes)
+		if err != nil {
+			return certificate, err
+		}
+		csr = *parsed
+
+	default:
+		if len(current.csr.Raw) == 0 {
+			return certificate, ErrRenewCSRNotFound
+		}
+		csr = current.csr
+	}
+
+	if err := c.archiveCertificate(commonName, current.certificate); err != nil {
+		return certificate, err
+	}
+
+	certificate, err = c.replaceCertificate(commonName, current, csr, newKey, opts)
+	if err != nil {
+		return certificate, errors.Join(err, c.restoreCertificate(commonName, current.certificate))
+	}
+
+	archive := filepath.Join(c.CommonName, "certs", commonName, storage.ArchiveFolder, current.certificate.SerialNumber.Text(16), commonName+certExtension)
+	if err := c.indexPath(current.certificate.SerialNumber, archive); err != nil {
+		return certificate, err
+	}
+
+	// the revocation is a CA operation of its own for the observers, unless
+	// the previous certificate was already revoked
+	if opts.Revoke {
+		err := c.revokeCertificate(current.certificate, cert.Superseded, time.Time{})
+		if errors.Is(err, ErrCertRevoked) {
+			err = nil
+		} else {
+			c.notify(OperationRevoke, commonName, current.certificate, err)
+		}
+		if err != nil {
+			return certificate, err
+		}
+	}
+
+	return c.loadCertificate(commonName)
+}
+
+// replaceCertificate removes the current certificate files replaced by the
+// renewal and certifies the CSR
+func (c *CA) replaceCertificate(commonName string, current Certificate, csr x509.CertificateRequest, newKey crypto.Signer, opts RenewOptions) (Certificate, error) {
+	certDir := filepath.Join(c.CommonName, "certs", commonName)
+
+	if err := c.storage.Delete(filepath.Join(certDir, commonName+certExtension)); err != nil {
+		return Certificate{}, err
+	}
+
+	// the keys are kept only when the same key is certified again
+	if newKey != nil || (opts.CSR != nil && !publicKeysEqual(opts.CSR.PublicKey, current.publicKey)) {
+		for _, name := range []string{storage.PEMFile, storage.PublicPEMFile} {
+			if err := c.storage.Delete(filepath.Join(certDir, name)); err != nil {
+				return Certificate{}, err
+			}
+		}
+	}
+
+	if newKey != nil {
+		var passphrase []byte
+		if c.encryptCertificateKeys {
+			var err error
+			if passphrase, err = c.passphrase(c.CommonName); err != nil {
+				return Certificate{}, err
+			}
+		}
+
+		err := storage.SaveFile(c.storage, storage.File{
+			CA:             c.CommonName,
+			CommonName:     commonName,
+			FileType:       storage.FileTypeKey,
+			PrivateKeyData: newKey,
+			PublicKeyData:  newKey.Public(),
+			Passphrase:     passphrase,
+			CreationType:   storage.CreationTypeCertificate,
+		})
+		if err != nil {
+			return Certificate{}, err
+		}
+	}
+
+	profile := opts.Profile
+	if profile == "" {
+		profile = cert.DefaultProfile
+	}
+
+	return c.signCSR(csr, opts.Validity, profile)
+}
+
+// archiveCertificate copies the certificate files to the archive directory of
+// its serial number
+func (c *CA) archiveCertificate(commonName string, certificate *x509.Certificate) error {
+	certDir := filepath.Join(c.CommonName, "certs", commonName)
+	archive := filepath.Join(certDir, storage.ArchiveFolder, certificate.SerialNumber.Text(16))
+
+	return copyFiles(c.storage, certDir, archive, certificateFiles(commonName))
+}
+
+// restoreCertificate brings back the archived certificate files after a failed
+// renewal
+func (c *CA) restoreCertificate(commonName string, certificate *x509.Certificate) error {
+	certDir := filepath.Join(c.CommonName, "certs", commonName)
+	archive := filepath.Join(certDir, storage.ArchiveFolder, certificate.SerialNumber.Text(16))
+
+	for _, name := range certificateFiles(commonName) {
+		if err := c.storage.Delete(filepath.Join(certDir, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := copyFiles(c.storage, archive, certDir, certificateFiles(commonName)); err != nil {
+		return err
+	}
+
+	return c.storage.Delete(archive)
+}
+
+// copyFiles copies the existent files from the src to the dest directory,
+// keeping the private keys readable only by the owner
+func copyFiles(s storage.Storage, src, dest string, names []string) error {
+	for _, name := range names {
+		data, err := s.Get(filepath.Join(src, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		perm := fs.FileMode(0644)
+		if name == storage.PEMFile {
+			perm = 0600
+		}
+
+		if err := s.Put(filepath.Join(dest, name), data, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *CA) archivedCertificates(commonName string) ([]*x509.Certificate, error) {
+	if !c.storage.Exists(filepath.Join(c.CommonName, "certs", commonName)) {
+		return nil, ErrCertLoadNotFound
+	}
+
+	var certificates []*x509.Certificate
+	for _, serial := range storage.ListArchivedCertificates(c.storage, c.CommonName, commonName) {
+		certString, err := storage.LoadFile(c.storage, c.CommonName, "certs", commonName, storage.ArchiveFolder, serial, commonName+certExtension)
+		if err != nil {
+			return nil, err
+		}
+
+		certificate, err := cert.LoadCert(certString)
+		if err != nil {
+			return nil, err
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	slices.SortFunc(certificates, func(a, b *x509.Certificate) int {
+		return a.NotBefore.Compare(b.NotBefore)
+	})
+
+	return certificates, nil
+}
@@ -0,0 +1,279 @@
+package acme
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accountResponse is the ACME account object (RFC 8555, section 7.1.2)
+type accountResponse struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders"`
+}
+
+// keyIndex is stored in <CA>/acme/keys/<JWK thumbprint>.json to find the
+// account of a key
+type keyIndex struct {
+	Account string `json:"account"`
+}
+
+func (s *Server) writeAccount(w http.ResponseWriter, req *request, acct *account, status int) {
+	accountURL := req.url + "/account/" + acct.ID
+
+	w.Header().Set("Location", accountURL)
+	writeJSON(w, status, accountResponse{
+		Status:  acct.Status,
+		Contact: acct.Contact,
+		Orders:  accountURL + "/orders",
+	})
+}
+
+// findAccount returns the account of the JWK, nil if there is none
+func findAccount(req *request, key []byte) (*account, error) {
+	keyThumbprint, err := jwkThumbprint(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var index keyIndex
+	if err := load(req.ca, "keys", keyThumbprint, &index); err != nil {
+		var p *problem
+		if errors.As(err, &p) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return loadAccount(req.ca, index.Account)
+}
+
+func saveKeyIndex(req *request, key []byte, acct *account) error {
+	keyThumbprint, err := jwkThumbprint(key)
+	if err != nil {
+		return err
+	}
+
+	return save(req.ca, "keys", keyThumbprint, keyIndex{Account: acct.ID})
+}
+
+func validateContact(contact []string) error {
+	for _, uri := range contact {
+		if !strings.HasPrefix(uri, "mailto:") || len(uri) == len("mailto:") {
+			return &problem{Type: errUnsupportedContactType, Detail: "only mailto contacts are supported", Status: http.StatusBadRequest}
+		}
+	}
+
+	return nil
+}
+
+// newAccount creates an account or returns the existent account of the key
+// (RFC 8555, section 7.3)
+func (s *Server) newAccount(w http.ResponseWriter, req *request) error {
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return malformed("invalid new account request")
+	}
+
+	acct, err := findAccount(req, req.jwk)
+	if err != nil {
+		return err
+	}
+
+	if acct != nil {
+		if acct.Status != statusValid {
+			return unauthorized("the account is " + acct.Status)
+		}
+		s.writeAccount(w, req, acct, http.StatusOK)
+		return nil
+	}
+
+	if payload.OnlyReturnExisting {
+		return &problem{Type: errAccountDoesNotExist, Detail: "no account exists with the key", Status: http.StatusBadRequest}
+	}
+
+	if err := validateContact(payload.Contact); err != nil {
+		return err
+	}
+
+	acct = &account{
+		ID:        newID(),
+		Status:    statusValid,
+		Contact:   payload.Contact,
+		Key:       req.jwk,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := save(req.ca, "accounts", acct.ID, acct); err != nil {
+		return err
+	}
+
+	if err := saveKeyIndex(req, acct.Key, acct); err != nil {
+		return err
+	}
+
+	s.writeAccount(w, req, acct, http.StatusCreated)
+
+	return nil
+}
+
+// updateAccount returns, updates the contacts or deactivates the account
+// (RFC 8555, section 7.3.2)
+func (s *Server) updateAccount(w http.ResponseWriter, req *request, id string) error {
+	acct := req.account
+	if acct.ID != id {
+		return unauthorized("the account does not match the JWS key ID")
+	}
+
+	if !req.postAsGet {
+		var payload struct {
+			Contact *[]string `json:"contact"`
+			Status  string    `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			return malformed("invalid account update request")
+		}
+
+		switch payload.Status {
+		case "":
+		case statusDeactivated:
+			acct.Status = statusDeactivated
+		default:
+			return malformed("the account status can only be changed to deactivated")
+		}
+
+		if payload.Contact != nil {
+			if err := validateContact(*payload.Contact); err != nil {
+				return err
+			}
+			acct.Contact = *payload.Contact
+		}
+
+		if err := save(req.ca, "accounts", acct.ID, acct); err != nil {
+			return err
+		}
+	}
+
+	s.writeAccount(w, req, acct, http.StatusOK)
+
+	return nil
+}
+
+// listOrders returns the orders of the account (RFC 8555, section 7.1.2.1)
+func (s *Server) listOrders(w http.ResponseWriter, req *request, id string) error {
+	if req.account.ID != id {
+		return unauthorized("the account does not match the JWS key ID")
+	}
+
+	orders := make([]string, 0, len(req.account.Orders))
+	for _, orderID := range req.account.Orders {
+		orders = append(orders, req.url+"/order/"+orderID)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Orders []string `json:"orders"`
+	}{orders})
+
+	return nil
+}
+
+// keyChange replaces the account key (RFC 8555, section 7.3.5)
+func (s *Server) keyChange(w http.ResponseWriter, req *request) error {
+	msg, header, err := parseJWS(req.payload)
+	if err != nil {
+		return err
+	}
+
+	if len(header.JWK) == 0 || header.KID != "" {
+		return malformed("the key change inner JWS must have the new key (jwk)")
+	}
+	if header.URL != req.url+"/key-change" {
+		return malformed("the key change inner JWS url does not match the request URL")
+	}
+
+	newKey, err := parseJWK(header.JWK)
+	if err != nil {
+		return err
+	}
+
+	if err := verifySignature(header.Alg, newKey, msg.Protected+"."+msg.Payload, msg.Signature); err != nil {
+		return err
+	}
+
+	payloadJSON, err := decodeBase64(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return malformed("invalid key change request")
+	}
+
+	acct := req.account
+	if payload.Account != req.url+"/account/"+acct.ID {
+		return unauthorized("the key change account does not match the JWS key ID")
+	}
+
+	if equal, err := sameKey(payload.OldKey, acct.Key); err != nil {
+		return err
+	} else if !equal {
+		return unauthorized("the key change old key does not match the account key")
+	}
+
+	existent, err := findAccount(req, header.JWK)
+	if err != nil {
+		return err
+	}
+	if existent != nil {
+		w.Header().Set("Location", req.url+"/account/"+existent.ID)
+		return &problem{Type: errMalformed, Detail: "the new key is used by another account", Status: http.StatusConflict}
+	}
+
+	oldThumbprint, err := jwkThumbprint(acct.Key)
+	if err != nil {
+		return err
+	}
+
+	acct.Key = header.JWK
+	if err := save(req.ca, "accounts", acct.ID, acct); err != nil {
+		return err
+	}
+
+	if err := saveKeyIndex(req, acct.Key, acct); err != nil {
+		return err
+	}
+
+	if err := req.ca.storage.Delete(objectPath(req.ca, "keys", oldThumbprint)); err != nil {
+		return err
+	}
+
+	s.writeAccount(w, req, acct, http.StatusOK)
+
+	return nil
+}
+
+// sameKey returns if the JWKs have the same public key
+func sameKey(a, b []byte) (bool, error) {
+	thumbprintA, err := jwkThumbprint(a)
+	if err != nil {
+		return false, err
+	}
+
+	thumbprintB, err := jwkThumbprint(b)
+	if err != nil {
+		return false, err
+	}
+
+	return thumbprintA == thumbprintB, nil
+}
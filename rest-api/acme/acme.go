@@ -0,0 +1,288 @@
+// Package acme provides an ACME (RFC 8555) server issuing certificates from
+// the GoCA Certificate Authorities, so standard ACME clients (certbot, lego,
+// cert-manager) can be used against a private CA.
+//
+// Each Certificate Authority has its own directory:
+//
+//	<BaseURL>/<CA Common Name>/directory
+//
+// The accounts, orders, authorizations and issued certificates are stored
+// with the Certificate Authority, in <CA>/acme. The http-01 and dns-01
+// challenges are checked by a Validator, NetValidator by default.
+//
+//	server := &acme.Server{
+//		LoadCA: func(commonName string) (goca.CA, error) {
+//			return goca.Load(commonName)
+//		},
+//	}
+//	http.Handle("/acme/", server)
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+)
+
+// Defaults of the Server
+const (
+	defaultPrefix            = "/acme"
+	defaultValidationTimeout = 30 * time.Second
+	orderValidity            = 7 * 24 * time.Hour
+	nonceValidity            = time.Hour
+	maxRequestSize           = 64 << 10
+	retryAfter               = "1"
+)
+
+// Server is an ACME (RFC 8555) server for the Certificate Authorities
+// returned by LoadCA.
+//
+// The directories, nonces, accounts, orders and challenges are served with the
+// CAOptions without loading the Certificate Authority private key, LoadCA is
+// only called to finalize the orders and revoke the certificates. The orders
+// are finalized with CA.SignCSRWithProfile and the certificates revoked with
+// CA.RevokeCertificateBySerial.
+type Server struct {
+	LoadCA            func(commonName string) (goca.CA, error) // Loads the Certificate Authority of the directory to issue and revoke the certificates
+	CAOptions         []goca.Option                            // Options reading the Certificate Authorities without their private key
+	Prefix            string                                   // Path where the Server is mounted (default: /acme)
+	BaseURL           string                                   // External URL of Prefix, e.g. https://ca.example.com/acme (default: built from the request)
+	Validator         Validator                                // Validates the challenges (default: NetValidator)
+	ValidationTimeout time.Duration                            // Timeout of a challenge validation (default: 30 seconds)
+	Profile           string                                   // Certificate profile of the issued certificates (default: cert.DefaultProfile)
+
+	mu     sync.Mutex // serializes the changes of the stored ACME objects
+	nonces nonces
+}
+
+// directory is the ACME directory object (RFC 8555, section 7.1.1)
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	RevokeCert string `json:"revokeCert"`
+	KeyChange  string `json:"keyChange"`
+}
+
+// authority is the Certificate Authority of a directory, without its private
+// key
+type authority struct {
+	commonName  string
+	certificate *x509.Certificate
+	storage     goca.Storage
+}
+
+// request is a verified ACME request to a Certificate Authority directory
+type request struct {
+	ca        *authority
+	url       string   // URL of the CA directory root, <BaseURL>/<CA>
+	payload   []byte   // JWS payload, empty for POST-as-GET
+	jwk       []byte   // JWK of the JWS, nil when signed by an account (kid)
+	account   *account // account signing the JWS, nil when signed with a JWK
+	postAsGet bool
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.EscapedPath(), s.prefix()+"/")
+	parts := strings.Split(path, "/")
+	if !ok || len(parts) < 2 {
+		writeProblem(w, &problem{Type: errMalformed, Detail: "unknown ACME resource", Status: http.StatusNotFound})
+		return
+	}
+
+	commonName, err := url.PathUnescape(parts[0])
+	if err != nil {
+		writeProblem(w, &problem{Type: errMalformed, Detail: "unknown ACME resource", Status: http.StatusNotFound})
+		return
+	}
+
+	caCertificate, err := goca.LoadCACertificate(commonName, s.CAOptions...)
+	if err != nil {
+		writeProblem(w, &problem{Type: errMalformed, Detail: "unknown Certificate Authority", Status: http.StatusNotFound})
+		return
+	}
+
+	ca := &authority{commonName: commonName, certificate: caCertificate, storage: goca.OptionsStorage(s.CAOptions...)}
+	req := &request{ca: ca, url: s.baseURL(r) + "/" + parts[0]}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Replay-Nonce", s.nonces.new())
+	w.Header().Add("Link", `<`+req.url+`/directory>;rel="index"`)
+
+	if err := s.route(w, r, req, parts[1], parts[2:]); err != nil {
+		writeProblem(w, err)
+	}
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request, req *request, resource string, ids []string) error {
+	switch {
+	case resource == "directory" && len(ids) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, directory{
+			NewNonce:   req.url + "/new-nonce",
+			NewAccount: req.url + "/new-account",
+			NewOrder:   req.url + "/new-order",
+			RevokeCert: req.url + "/revoke-cert",
+			KeyChange:  req.url + "/key-change",
+		})
+		return nil
+
+	case resource == "new-nonce" && len(ids) == 0 && (r.Method == http.MethodHead || r.Method == http.MethodGet):
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return nil
+
+	case r.Method != http.MethodPost:
+		return &problem{Type: errMalformed, Detail: "ACME resources require POST", Status: http.StatusMethodNotAllowed}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jwkAllowed := len(ids) == 0 && (resource == "new-account" || resource == "revoke-cert")
+	if err := s.verify(r, req, jwkAllowed); err != nil {
+		return err
+	}
+
+	switch {
+	case resource == "new-account" && len(ids) == 0:
+		return s.newAccount(w, req)
+	case resource == "new-order" && len(ids) == 0:
+		return s.newOrder(w, req)
+	case resource == "revoke-cert" && len(ids) == 0:
+		return s.revokeCert(w, req)
+	case resource == "key-change" && len(ids) == 0:
+		return s.keyChange(w, req)
+	case resource == "account" && len(ids) == 1:
+		return s.updateAccount(w, req, ids[0])
+	case resource == "account" && len(ids) == 2 && ids[1] == "orders":
+		return s.listOrders(w, req, ids[0])
+	case resource == "order" && len(ids) == 1:
+		return s.getOrder(w, req, ids[0])
+	case resource == "order" && len(ids) == 2 && ids[1] == "finalize":
+		return s.finalizeOrder(w, req, ids[0])
+	case resource == "authz" && len(ids) == 1:
+		return s.updateAuthorization(w, req, ids[0])
+	case resource == "challenge" && len(ids) == 2:
+		return s.respondChallenge(w, req, ids[0], ids[1])
+	case resource == "cert" && len(ids) == 1:
+		return s.getCertificate(w, req, ids[0])
+	}
+
+	return &problem{Type: errMalformed, Detail: "unknown ACME resource", Status: http.StatusNotFound}
+}
+
+func (s *Server) prefix() string {
+	if s.Prefix == "" {
+		return defaultPrefix
+	}
+
+	return strings.TrimSuffix(s.Prefix, "/")
+}
+
+func (s *Server) baseURL(r *http.Request) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + s.prefix()
+}
+
+func (s *Server) validator() Validator {
+	if s.Validator == nil {
+		return NetValidator{}
+	}
+
+	return s.Validator
+}
+
+func (s *Server) validationTimeout() time.Duration {
+	if s.ValidationTimeout <= 0 {
+		return defaultValidationTimeout
+	}
+
+	return s.ValidationTimeout
+}
+
+// nonces keeps the issued anti-replay nonces until they are used or expire
+type nonces struct {
+	mu      sync.Mutex
+	issued  map[string]time.Time
+	cleaned time.Time // last removal of the expired nonces
+}
+
+func (n *nonces) new() string {
+	nonce := newID()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if n.issued == nil {
+		n.issued = make(map[string]time.Time)
+	}
+	if now.Sub(n.cleaned) > time.Minute {
+		for issued, expires := range n.issued {
+			if now.After(expires) {
+				delete(n.issued, issued)
+			}
+		}
+		n.cleaned = now
+	}
+	n.issued[nonce] = now.Add(nonceValidity)
+
+	return nonce
+}
+
+// use returns if the nonce was issued and not used yet
+func (n *nonces) use(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expires, ok := n.issued[nonce]
+	delete(n.issued, nonce)
+
+	return ok && time.Now().Before(expires)
+}
+
+// newID returns a random identifier safe to be used in URLs and file names
+func newID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, err error) {
+	var p *problem
+	if !errors.As(err, &p) {
+		p = &problem{Type: errServerInternal, Detail: err.Error(), Status: http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
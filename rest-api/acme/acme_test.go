@@ -0,0 +1,391 @@
+package acme_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/rest-api/acme"
+)
+
+// stubValidator answers the challenges with the responses published by the
+// test instead of the network
+type stubValidator struct {
+	mu         sync.Mutex
+	http01     map[string]string // token: response
+	dns01      map[string]string // domain: TXT record
+	identifier []acme.Identifier // identifiers validated with http-01
+}
+
+func (v *stubValidator) HTTP01(ctx context.Context, identifier acme.Identifier, token, keyAuthorization string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.identifier = append(v.identifier, identifier)
+	if v.http01[token] != keyAuthorization {
+		return errors.New("invalid key authorization")
+	}
+
+	return nil
+}
+
+func (v *stubValidator) DNS01(ctx context.Context, domain, keyAuthorization string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.dns01[domain] != acme.DNS01Digest(keyAuthorization) {
+		return errors.New("invalid TXT record")
+	}
+
+	return nil
+}
+
+// publish publishes the client response of the challenge
+func (v *stubValidator) publish(t *testing.T, client *xacme.Client, authz *xacme.Authorization, chal *xacme.Challenge) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch chal.Type {
+	case "http-01":
+		response, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.http01[chal.Token] = response
+	case "dns-01":
+		record, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.dns01[authz.Identifier.Value] = record
+	}
+}
+
+func newACMEClient(t *testing.T, directoryURL string) *xacme.Client {
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &xacme.Client{Key: accountKey, DirectoryURL: directoryURL}
+	if _, err := client.Register(context.Background(), &xacme.Account{Contact: []string{"mailto:admin@example.com"}}, xacme.AcceptTOS); err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// authorize fulfills the authorizations of the order, preferring the challenge
+// type when available
+func authorize(t *testing.T, client *xacme.Client, validator *stubValidator, order *xacme.Order, challengeType string) error {
+	ctx := context.Background()
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chal := authz.Challenges[0]
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				chal = c
+			}
+		}
+
+		validator.publish(t, client, authz, chal)
+
+		if _, err := client.Accept(ctx, chal); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestFunctionalACME(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	store := goca.NewMemoryStorage()
+	caIdentity := goca.Identity{
+		Organization:       "GO CA ACME Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}
+	if _, err := goca.New("go-acme.ca", caIdentity, goca.WithStorage(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA key is only loaded to finalize the orders and revoke
+	var keyLoads atomic.Int32
+	validator := &stubValidator{http01: map[string]string{}, dns01: map[string]string{}}
+	server := httptest.NewServer(&acme.Server{
+		LoadCA: func(commonName string) (goca.CA, error) {
+			keyLoads.Add(1)
+			return goca.Load(commonName, goca.WithStorage(store))
+		},
+		CAOptions: []goca.Option{goca.WithStorage(store)},
+		Validator: validator,
+	})
+	defer server.Close()
+
+	directoryURL := server.URL + "/acme/go-acme.ca/directory"
+	client := newACMEClient(t, directoryURL)
+
+	// the account key is registered once
+	if _, err := client.Register(ctx, &xacme.Account{}, xacme.AcceptTOS); !errors.Is(err, xacme.ErrAccountAlreadyExists) {
+		t.Errorf("Registering the account again should fail with ErrAccountAlreadyExists, got %v", err)
+	}
+
+	if _, err := client.GetReg(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown Certificate Authority
+	unknown := &xacme.Client{Key: client.Key, DirectoryURL: server.URL + "/acme/unknown.ca/directory"}
+	if _, err := unknown.Discover(ctx); err == nil {
+		t.Error("The directory of an unknown Certificate Authority should not exist")
+	}
+
+	ids := []xacme.AuthzID{
+		{Type: "dns", Value: "www.example.com"},
+		{Type: "dns", Value: "*.example.com"},
+		{Type: "ip", Value: "10.0.0.1"},
+	}
+	order, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != xacme.StatusPending || len(order.AuthzURLs) != 3 {
+		t.Fatalf("Unexpected new order %+v", order)
+	}
+
+	if err := authorize(t, client, validator, order, "http-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	// wildcards are validated by dns-01 and the others by http-01
+	if len(validator.identifier) != 2 || !slices.Contains(validator.identifier, acme.Identifier{Type: "ip", Value: "10.0.0.1"}) {
+		t.Errorf("Unexpected http-01 validations %v", validator.identifier)
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != xacme.StatusReady {
+		t.Fatalf("The order should be ready, got %s", order.Status)
+	}
+	if loads := keyLoads.Load(); loads != 0 {
+		t.Errorf("The accounts, orders and challenges should not load the CA key, got %d loads", loads)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the CSR must request the order identifiers
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com"},
+	}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true); err == nil {
+		t.Error("Finalizing the order with a CSR missing identifiers should fail")
+	}
+
+	csr, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "www.example.com"},
+		DNSNames:    []string{"www.example.com", "*.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, certURL, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(der) != 2 {
+		t.Fatalf("The certificate chain should have the certificate and the CA certificate, got %d certificates", len(der))
+	}
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Issuer.CommonName != "go-acme.ca" || !slices.Equal(leaf.DNSNames, []string{"www.example.com", "*.example.com"}) || len(leaf.IPAddresses) != 1 {
+		t.Errorf("Unexpected certificate %v %v %v", leaf.Issuer, leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	ca, err := goca.Load("go-acme.ca", goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ca.LoadCertificate("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.GoCert().SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("The issued certificate should be stored in the Certificate Authority")
+	}
+
+	// the certificate belongs to the account
+	other := newACMEClient(t, directoryURL)
+	if _, err := other.FetchCert(ctx, certURL, true); err == nil {
+		t.Error("Other accounts should not fetch the certificate")
+	}
+	if err := other.RevokeCert(ctx, nil, der[0], xacme.CRLReasonKeyCompromise); err == nil {
+		t.Error("Other accounts should not revoke the certificate")
+	}
+
+	// failed challenge
+	order, err = client.AuthorizeOrder(ctx, xacme.DomainIDs("bad.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chal := range authz.Challenges {
+		if chal.Type == "dns-01" {
+			if _, err := client.Accept(ctx, chal); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var authzErr *xacme.AuthorizationError
+	if _, err := client.WaitAuthorization(ctx, authz.URI); !errors.As(err, &authzErr) {
+		t.Errorf("The authorization with a failed challenge should be invalid, got %v", err)
+	}
+	if _, err := client.WaitOrder(ctx, order.URI); err == nil {
+		t.Error("The order with an invalid authorization should be invalid")
+	}
+
+	// key rollover keeps the account and its certificates
+	newAccountKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AccountKeyRollover(ctx, newAccountKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchCert(ctx, certURL, false); err != nil {
+		t.Error(err)
+	}
+
+	if err := client.RevokeCert(ctx, nil, der[0], xacme.CRLReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err = goca.Load("go-acme.ca", goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := ca.GoCRL().RevokedCertificateEntries
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 || revoked[0].ReasonCode != int(cert.KeyCompromise) {
+		t.Errorf("The certificate should be revoked with the key compromise reason, got %v", revoked)
+	}
+
+	// a new order for the common name renews the certificate
+	order, err = client.AuthorizeOrder(ctx, xacme.DomainIDs("www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(t, client, validator, order, "http-01"); err != nil {
+		t.Fatal(err)
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		t.Fatal(err)
+	}
+	csr, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com"},
+	}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err = goca.Load("go-acme.ca", goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err = ca.LoadCertificate("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.GoCert().Raw, renewed[0]) {
+		t.Error("The renewed certificate should be the current certificate")
+	}
+	if archived, err := ca.ArchivedCertificates("www.example.com"); err != nil || len(archived) != 1 || !archived[0].Equal(leaf) {
+		t.Errorf("The previous certificate should be archived, got %d certificates: %v", len(archived), err)
+	}
+
+	if err := client.DeactivateReg(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AuthorizeOrder(ctx, xacme.DomainIDs("www.example.com")); err == nil {
+		t.Error("Deactivated accounts should not create orders")
+	}
+}
+
+func TestNetValidatorPrivateIPs(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "token.thumbprint")
+	}))
+	defer server.Close()
+
+	// the port 80 requests are sent to the test server
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+
+	for _, address := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "0.0.0.0"} {
+		identifier := acme.Identifier{Type: "ip", Value: address}
+		if err := (acme.NetValidator{Client: client}).HTTP01(ctx, identifier, "token", "token.thumbprint"); err == nil {
+			t.Errorf("The http-01 challenge of %s should be rejected", address)
+		}
+	}
+
+	identifier := acme.Identifier{Type: "ip", Value: "127.0.0.1"}
+	if err := (acme.NetValidator{Client: client, AllowPrivateIPs: true}).HTTP01(ctx, identifier, "token", "token.thumbprint"); err != nil {
+		t.Errorf("The http-01 challenge of an allowed private IP should be valid, got %v", err)
+	}
+}
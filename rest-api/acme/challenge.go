@@ -0,0 +1,187 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// authorizationResponse is the ACME authorization object (RFC 8555, section
+// 7.1.4)
+type authorizationResponse struct {
+	Status     string              `json:"status"`
+	Expires    time.Time           `json:"expires"`
+	Identifier Identifier          `json:"identifier"`
+	Challenges []challengeResponse `json:"challenges"`
+	Wildcard   bool                `json:"wildcard,omitempty"`
+}
+
+// challengeResponse is the ACME challenge object (RFC 8555, section 8)
+type challengeResponse struct {
+	Type      string     `json:"type"`
+	URL       string     `json:"url"`
+	Status    string     `json:"status"`
+	Token     string     `json:"token"`
+	Validated *time.Time `json:"validated,omitempty"`
+	Error     *problem   `json:"error,omitempty"`
+}
+
+func newChallengeResponse(req *request, authz *authorization, chal challenge) challengeResponse {
+	return challengeResponse{
+		Type:      chal.Type,
+		URL:       req.url + "/challenge/" + authz.ID + "/" + chal.Type,
+		Status:    chal.Status,
+		Token:     chal.Token,
+		Validated: chal.Validated,
+		Error:     chal.Error,
+	}
+}
+
+func (s *Server) writeAuthorization(w http.ResponseWriter, req *request, authz *authorization) {
+	response := authorizationResponse{
+		Status:     authz.Status,
+		Expires:    authz.Expires,
+		Identifier: authz.Identifier,
+		Wildcard:   authz.Wildcard,
+	}
+	for _, chal := range authz.Challenges {
+		response.Challenges = append(response.Challenges, newChallengeResponse(req, authz, chal))
+	}
+
+	if authz.Status == statusPending {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// updateAuthorization returns or deactivates the authorization (RFC 8555,
+// sections 7.5 and 7.5.2)
+func (s *Server) updateAuthorization(w http.ResponseWriter, req *request, id string) error {
+	authz, err := loadAuthorization(req.ca, req.account, id)
+	if err != nil {
+		return err
+	}
+
+	if !req.postAsGet {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			return malformed("invalid authorization update request")
+		}
+
+		if payload.Status != statusDeactivated {
+			return malformed("the authorization status can only be changed to deactivated")
+		}
+		if authz.Status != statusPending && authz.Status != statusValid {
+			return unauthorized("the authorization is " + authz.Status)
+		}
+
+		authz.Status = statusDeactivated
+		if err := save(req.ca, "authz", authz.ID, authz); err != nil {
+			return err
+		}
+	}
+
+	s.writeAuthorization(w, req, authz)
+
+	return nil
+}
+
+// respondChallenge returns the challenge or, when the client is ready,
+// starts its validation (RFC 8555, section 7.5.1)
+func (s *Server) respondChallenge(w http.ResponseWriter, req *request, authzID, challengeType string) error {
+	authz, err := loadAuthorization(req.ca, req.account, authzID)
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, chal := range authz.Challenges {
+		if chal.Type == challengeType {
+			index = i
+		}
+	}
+	if index < 0 {
+		return notFound("the ACME challenge does not exist")
+	}
+
+	chal := &authz.Challenges[index]
+	if !req.postAsGet && chal.Status == statusPending && authz.Status == statusPending {
+		keyAuth, err := keyAuthorization(chal.Token, req.account.Key)
+		if err != nil {
+			return err
+		}
+
+		chal.Status = statusProcessing
+		if err := save(req.ca, "authz", authz.ID, authz); err != nil {
+			return err
+		}
+
+		go s.validate(req, authz.ID, *chal, keyAuth)
+	}
+
+	w.Header().Add("Link", `<`+req.url+`/authz/`+authz.ID+`>;rel="up"`)
+	writeJSON(w, http.StatusOK, newChallengeResponse(req, authz, *chal))
+
+	return nil
+}
+
+// validate validates the challenge of the authorization and stores the result
+func (s *Server) validate(req *request, authzID string, chal challenge, keyAuth string) {
+	s.mu.Lock()
+	var authz authorization
+	err := load(req.ca, "authz", authzID, &authz)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.validationTimeout())
+	defer cancel()
+
+	switch chal.Type {
+	case challengeHTTP:
+		err = s.validator().HTTP01(ctx, authz.Identifier, chal.Token, keyAuth)
+	case challengeDNS:
+		err = s.validator().DNS01(ctx, authz.Identifier.Value, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the authorization may have changed during the validation
+	if load(req.ca, "authz", authzID, &authz) != nil || authz.Status != statusPending {
+		return
+	}
+
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type != chal.Type {
+			continue
+		}
+
+		if err != nil {
+			authz.Challenges[i].Status = statusInvalid
+			authz.Challenges[i].Error = validationProblem(err)
+			authz.Status = statusInvalid
+		} else {
+			validated := time.Now().UTC().Truncate(time.Second)
+			authz.Challenges[i].Status = statusValid
+			authz.Challenges[i].Validated = &validated
+			authz.Status = statusValid
+		}
+	}
+
+	_ = save(req.ca, "authz", authz.ID, &authz)
+}
+
+// validationProblem returns the ACME error of a failed validation
+func validationProblem(err error) *problem {
+	if p, ok := err.(*problem); ok {
+		return p
+	}
+
+	return &problem{Type: errIncorrectResponse, Detail: err.Error(), Status: http.StatusForbidden}
+}
@@ -0,0 +1,325 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// jws is a JWS in the flattened JSON serialization (RFC 7515)
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// jwsHeader is the JWS protected header of the ACME requests
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	KID   string          `json:"kid"`
+	JWK   json.RawMessage `json:"jwk"`
+}
+
+// jwk is a JSON Web Key (RFC 7517) with the RSA, EC and OKP public key members
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// verify checks the JWS of the request: nonce, URL, key and signature, and
+// sets the payload and the account or the JWK of req.
+//
+// A JWK (instead of an account key ID) is accepted only when jwkAllowed.
+func (s *Server) verify(r *http.Request, req *request, jwkAllowed bool) error {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/jose+json" {
+		return malformed("the request content type must be application/jose+json")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		return err
+	} else if len(body) > maxRequestSize {
+		return malformed("the request is too large")
+	}
+
+	msg, header, err := parseJWS(body)
+	if err != nil {
+		return err
+	}
+
+	if !s.nonces.use(header.Nonce) {
+		return &problem{Type: errBadNonce, Detail: "invalid or expired nonce", Status: http.StatusBadRequest}
+	}
+
+	if header.URL != s.baseURL(r)+strings.TrimPrefix(r.URL.EscapedPath(), s.prefix()) {
+		return unauthorized("the JWS url does not match the request URL")
+	}
+
+	var key crypto.PublicKey
+	switch {
+	case len(header.JWK) > 0 && header.KID != "":
+		return malformed("the JWS must have either jwk or kid")
+	case len(header.JWK) > 0:
+		if !jwkAllowed {
+			return malformed("the JWS must be signed by an account (kid)")
+		}
+		if key, err = parseJWK(header.JWK); err != nil {
+			return err
+		}
+		req.jwk = header.JWK
+	case header.KID != "":
+		id, ok := strings.CutPrefix(header.KID, req.url+"/account/")
+		if !ok {
+			return &problem{Type: errAccountDoesNotExist, Detail: "unknown account", Status: http.StatusBadRequest}
+		}
+		acct, err := loadAccount(req.ca, id)
+		if err != nil {
+			return err
+		}
+		if acct.Status != statusValid {
+			return unauthorized("the account is " + acct.Status)
+		}
+		if key, err = parseJWK(acct.Key); err != nil {
+			return err
+		}
+		req.account = acct
+	default:
+		return malformed("the JWS must have either jwk or kid")
+	}
+
+	if err := verifySignature(header.Alg, key, msg.Protected+"."+msg.Payload, msg.Signature); err != nil {
+		return err
+	}
+
+	req.postAsGet = msg.Payload == ""
+	req.payload, err = decodeBase64(msg.Payload)
+
+	return err
+}
+
+func parseJWS(data []byte) (msg jws, header jwsHeader, err error) {
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, header, malformed("the request is not a flattened JWS")
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return msg, header, malformed("invalid JWS protected header encoding")
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return msg, header, malformed("invalid JWS protected header")
+	}
+
+	return msg, header, nil
+}
+
+// verifySignature verifies the base64url encoded signature of the JWS
+// signing input with the public key, according to the algorithm
+func verifySignature(alg string, key crypto.PublicKey, signingInput, signature string) error {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return malformed("invalid JWS signature encoding")
+	}
+
+	var valid bool
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return badSignatureAlgorithm(alg)
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		valid = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		hash, size := ecdsaHash(pub.Curve)
+		if alg != ecdsaAlgorithm(pub.Curve) {
+			return badSignatureAlgorithm(alg)
+		}
+		if len(sig) != 2*size {
+			return malformed("invalid ECDSA signature length")
+		}
+		h := hash.New()
+		h.Write([]byte(signingInput))
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		valid = ecdsa.Verify(pub, h.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return badSignatureAlgorithm(alg)
+		}
+		valid = ed25519.Verify(pub, []byte(signingInput), sig)
+	default:
+		return badSignatureAlgorithm(alg)
+	}
+
+	if !valid {
+		return malformed("invalid JWS signature")
+	}
+
+	return nil
+}
+
+func ecdsaAlgorithm(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P256():
+		return "ES256"
+	case elliptic.P384():
+		return "ES384"
+	case elliptic.P521():
+		return "ES512"
+	}
+
+	return ""
+}
+
+// ecdsaHash returns the hash and the coordinates size in bytes of the curve
+func ecdsaHash(curve elliptic.Curve) (crypto.Hash, int) {
+	size := (curve.Params().BitSize + 7) / 8
+	switch curve {
+	case elliptic.P384():
+		return crypto.SHA384, size
+	case elliptic.P521():
+		return crypto.SHA512, size
+	}
+
+	return crypto.SHA256, size
+}
+
+// parseJWK returns the public key of the JSON Web Key
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	var k jwk
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, malformed("invalid JWK")
+	}
+
+	decode := func(values ...string) ([][]byte, error) {
+		decoded := make([][]byte, len(values))
+		for i, value := range values {
+			b, err := base64.RawURLEncoding.DecodeString(value)
+			if err != nil || len(b) == 0 {
+				return nil, malformed("invalid JWK")
+			}
+			decoded[i] = b
+		}
+		return decoded, nil
+	}
+
+	switch {
+	case k.Kty == "RSA":
+		v, err := decode(k.N, k.E)
+		if err != nil {
+			return nil, err
+		}
+		e := new(big.Int).SetBytes(v[1])
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, malformed("invalid JWK RSA exponent")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(v[0]), E: int(e.Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, &problem{Type: errBadPublicKey, Detail: "RSA keys must have at least 2048 bits", Status: http.StatusBadRequest}
+		}
+		return pub, nil
+
+	case k.Kty == "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, &problem{Type: errBadPublicKey, Detail: "unsupported curve " + k.Crv, Status: http.StatusBadRequest}
+		}
+		v, err := decode(k.X, k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(v[0]), Y: new(big.Int).SetBytes(v[1])}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, malformed("invalid JWK EC point")
+		}
+		return pub, nil
+
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		v, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(v[0]) != ed25519.PublicKeySize {
+			return nil, malformed("invalid JWK Ed25519 key")
+		}
+		return ed25519.PublicKey(v[0]), nil
+	}
+
+	return nil, &problem{Type: errBadPublicKey, Detail: "unsupported key type " + k.Kty, Status: http.StatusBadRequest}
+}
+
+// thumbprint returns the JWK thumbprint (RFC 7638) of the public key
+func thumbprint(key crypto.PublicKey) (string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	var canonical string
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		canonical = `{"e":"` + encode(big.NewInt(int64(pub.E)).Bytes()) + `","kty":"RSA","n":"` + encode(pub.N.Bytes()) + `"}`
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		canonical = `{"crv":"` + pub.Curve.Params().Name + `","kty":"EC","x":"` + encode(pub.X.FillBytes(make([]byte, size))) +
+			`","y":"` + encode(pub.Y.FillBytes(make([]byte, size))) + `"}`
+	case ed25519.PublicKey:
+		canonical = `{"crv":"Ed25519","kty":"OKP","x":"` + encode(pub) + `"}`
+	default:
+		return "", errors.New("unsupported key type")
+	}
+
+	digest := sha256.Sum256([]byte(canonical))
+
+	return encode(digest[:]), nil
+}
+
+// jwkThumbprint returns the thumbprint of the JSON Web Key
+func jwkThumbprint(data []byte) (string, error) {
+	key, err := parseJWK(data)
+	if err != nil {
+		return "", err
+	}
+
+	return thumbprint(key)
+}
+
+// keyAuthorization returns the challenge key authorization of the token
+// (RFC 8555, section 8.1)
+func keyAuthorization(token string, accountKey []byte) (string, error) {
+	keyThumbprint, err := jwkThumbprint(accountKey)
+	if err != nil {
+		return "", err
+	}
+
+	return token + "." + keyThumbprint, nil
+}
+
+func decodeBase64(value string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, malformed("invalid base64url encoding")
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,268 @@
+package acme
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// ACME objects status
+const (
+	statusPending     = "pending"
+	statusProcessing  = "processing"
+	statusReady       = "ready"
+	statusValid       = "valid"
+	statusInvalid     = "invalid"
+	statusDeactivated = "deactivated"
+	statusExpired     = "expired"
+)
+
+// ACME identifier and challenge types
+const (
+	identifierDNS = "dns"
+	identifierIP  = "ip"
+	challengeHTTP = "http-01"
+	challengeDNS  = "dns-01"
+)
+
+// ACME error types (RFC 8555, section 6.7)
+const (
+	errAccountDoesNotExist    = "urn:ietf:params:acme:error:accountDoesNotExist"
+	errAlreadyRevoked         = "urn:ietf:params:acme:error:alreadyRevoked"
+	errBadCSR                 = "urn:ietf:params:acme:error:badCSR"
+	errBadNonce               = "urn:ietf:params:acme:error:badNonce"
+	errBadPublicKey           = "urn:ietf:params:acme:error:badPublicKey"
+	errBadRevocationReason    = "urn:ietf:params:acme:error:badRevocationReason"
+	errBadSignatureAlgorithm  = "urn:ietf:params:acme:error:badSignatureAlgorithm"
+	errConnection             = "urn:ietf:params:acme:error:connection"
+	errDNS                    = "urn:ietf:params:acme:error:dns"
+	errIncorrectResponse      = "urn:ietf:params:acme:error:incorrectResponse"
+	errMalformed              = "urn:ietf:params:acme:error:malformed"
+	errOrderNotReady          = "urn:ietf:params:acme:error:orderNotReady"
+	errRejectedIdentifier     = "urn:ietf:params:acme:error:rejectedIdentifier"
+	errServerInternal         = "urn:ietf:params:acme:error:serverInternal"
+	errUnauthorized           = "urn:ietf:params:acme:error:unauthorized"
+	errUnsupportedIdentifier  = "urn:ietf:params:acme:error:unsupportedIdentifier"
+	errUnsupportedContactType = "urn:ietf:params:acme:error:unsupportedContact"
+)
+
+// validID matches the identifiers of the stored ACME objects
+var validID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// problem is an ACME error, a problem document (RFC 7807)
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (p *problem) Error() string {
+	return p.Detail
+}
+
+func malformed(detail string) *problem {
+	return &problem{Type: errMalformed, Detail: detail, Status: http.StatusBadRequest}
+}
+
+func unauthorized(detail string) *problem {
+	return &problem{Type: errUnauthorized, Detail: detail, Status: http.StatusForbidden}
+}
+
+func badSignatureAlgorithm(alg string) *problem {
+	return &problem{Type: errBadSignatureAlgorithm, Detail: "unsupported JWS algorithm " + alg, Status: http.StatusBadRequest}
+}
+
+func notFound(detail string) *problem {
+	return &problem{Type: errMalformed, Detail: detail, Status: http.StatusNotFound}
+}
+
+// Identifier is an ACME identifier, a DNS name or an IP address (RFC 8738)
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// account is an ACME account stored in <CA>/acme/accounts/<id>.json
+type account struct {
+	ID        string          `json:"id"`
+	Status    string          `json:"status"`
+	Contact   []string        `json:"contact,omitempty"`
+	Key       json.RawMessage `json:"key"`
+	Orders    []string        `json:"orders,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// order is an ACME order stored in <CA>/acme/orders/<id>.json
+type order struct {
+	ID             string       `json:"id"`
+	Account        string       `json:"account"`
+	Status         string       `json:"status"`
+	Expires        time.Time    `json:"expires"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *problem     `json:"error,omitempty"`
+}
+
+// authorization is an ACME authorization stored in <CA>/acme/authz/<id>.json
+type authorization struct {
+	ID         string      `json:"id"`
+	Account    string      `json:"account"`
+	Status     string      `json:"status"`
+	Expires    time.Time   `json:"expires"`
+	Identifier Identifier  `json:"identifier"`
+	Wildcard   bool        `json:"wildcard,omitempty"`
+	Challenges []challenge `json:"challenges"`
+}
+
+// challenge is an ACME challenge of an authorization
+type challenge struct {
+	Type      string     `json:"type"`
+	Status    string     `json:"status"`
+	Token     string     `json:"token"`
+	Validated *time.Time `json:"validated,omitempty"`
+	Error     *problem   `json:"error,omitempty"`
+}
+
+// issuedCertificate is a certificate issued to an ACME account stored in
+// <CA>/acme/certs/<serial number>.json
+type issuedCertificate struct {
+	Account     string `json:"account"`
+	Order       string `json:"order"`
+	Certificate []byte `json:"certificate"`
+}
+
+// refresh updates the status of the expired authorization, returning if it
+// changed
+func (a *authorization) refresh() bool {
+	if (a.Status == statusPending || a.Status == statusValid) && time.Now().After(a.Expires) {
+		a.Status = statusExpired
+		return true
+	}
+
+	return false
+}
+
+// refresh updates the order status from its authorizations, returning if it
+// changed
+func (o *order) refresh(authorizations []*authorization) bool {
+	if o.Status != statusPending && o.Status != statusReady {
+		return false
+	}
+
+	status := statusReady
+	if time.Now().After(o.Expires) {
+		status = statusInvalid
+	}
+	for _, authz := range authorizations {
+		switch authz.Status {
+		case statusPending:
+			if status == statusReady {
+				status = statusPending
+			}
+		case statusValid:
+		default:
+			status = statusInvalid
+		}
+	}
+
+	changed := status != o.Status
+	o.Status = status
+
+	return changed
+}
+
+func objectPath(ca *authority, kind, id string) string {
+	return filepath.Join(ca.commonName, "acme", kind, id+".json")
+}
+
+// load decodes the stored ACME object kind/id into v
+func load(ca *authority, kind, id string, v any) error {
+	if !validID.MatchString(id) {
+		return notFound("the ACME " + kind + " does not exist")
+	}
+
+	data, err := ca.storage.Get(objectPath(ca, kind, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return notFound("the ACME " + kind + " does not exist")
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func save(ca *authority, kind, id string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ca.storage.Put(objectPath(ca, kind, id), data, 0644)
+}
+
+func loadAccount(ca *authority, id string) (*account, error) {
+	var acct account
+	if err := load(ca, "accounts", id, &acct); err != nil {
+		var p *problem
+		if errors.As(err, &p) {
+			return nil, &problem{Type: errAccountDoesNotExist, Detail: "unknown account", Status: http.StatusBadRequest}
+		}
+		return nil, err
+	}
+
+	return &acct, nil
+}
+
+// loadOrder returns the order of the account and its authorizations, with the
+// status updated
+func loadOrder(ca *authority, acct *account, id string) (*order, []*authorization, error) {
+	var o order
+	if err := load(ca, "orders", id, &o); err != nil {
+		return nil, nil, err
+	}
+	if o.Account != acct.ID {
+		return nil, nil, unauthorized("the order belongs to another account")
+	}
+
+	authorizations := make([]*authorization, 0, len(o.Authorizations))
+	for _, authzID := range o.Authorizations {
+		authz, err := loadAuthorization(ca, acct, authzID)
+		if err != nil {
+			return nil, nil, err
+		}
+		authorizations = append(authorizations, authz)
+	}
+
+	if o.refresh(authorizations) {
+		if err := save(ca, "orders", o.ID, &o); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &o, authorizations, nil
+}
+
+// loadAuthorization returns the authorization of the account, with the
+// status updated
+func loadAuthorization(ca *authority, acct *account, id string) (*authorization, error) {
+	var authz authorization
+	if err := load(ca, "authz", id, &authz); err != nil {
+		return nil, err
+	}
+	if authz.Account != acct.ID {
+		return nil, unauthorized("the authorization belongs to another account")
+	}
+
+	if authz.refresh() {
+		if err := save(ca, "authz", authz.ID, &authz); err != nil {
+			return nil, err
+		}
+	}
+
+	return &authz, nil
+}
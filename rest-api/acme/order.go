@@ -0,0 +1,443 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+)
+
+// maxIdentifiers is the maximum number of identifiers of an order
+const maxIdentifiers = 100
+
+// dnsLabel matches a DNS name label
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// orderResponse is the ACME order object (RFC 8555, section 7.1.3)
+type orderResponse struct {
+	Status         string       `json:"status"`
+	Expires        time.Time    `json:"expires"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *problem     `json:"error,omitempty"`
+}
+
+func (s *Server) writeOrder(w http.ResponseWriter, req *request, o *order, status int) {
+	response := orderResponse{
+		Status:      o.Status,
+		Expires:     o.Expires,
+		Identifiers: o.Identifiers,
+		Finalize:    req.url + "/order/" + o.ID + "/finalize",
+		Error:       o.Error,
+	}
+	for _, authzID := range o.Authorizations {
+		response.Authorizations = append(response.Authorizations, req.url+"/authz/"+authzID)
+	}
+	if o.Certificate != "" {
+		response.Certificate = req.url + "/cert/" + o.Certificate
+	}
+
+	w.Header().Set("Location", req.url+"/order/"+o.ID)
+	writeJSON(w, status, response)
+}
+
+// normalizeIdentifier validates the identifier and returns it in the
+// canonical form: lower case DNS names and IP addresses as net.IP.String
+func normalizeIdentifier(id Identifier) (Identifier, error) {
+	switch id.Type {
+	case identifierDNS:
+		name := strings.ToLower(id.Value)
+		labels := strings.Split(strings.TrimPrefix(name, "*."), ".")
+		valid := len(name) <= 253 && len(labels) > 1
+		for _, label := range labels {
+			valid = valid && dnsLabel.MatchString(label)
+		}
+		if !valid {
+			return id, &problem{Type: errRejectedIdentifier, Detail: "invalid DNS name " + id.Value, Status: http.StatusBadRequest}
+		}
+		return Identifier{Type: identifierDNS, Value: name}, nil
+
+	case identifierIP:
+		ip := net.ParseIP(id.Value)
+		if ip == nil {
+			return id, &problem{Type: errRejectedIdentifier, Detail: "invalid IP address " + id.Value, Status: http.StatusBadRequest}
+		}
+		return Identifier{Type: identifierIP, Value: ip.String()}, nil
+	}
+
+	return id, &problem{Type: errUnsupportedIdentifier, Detail: "unsupported identifier type " + id.Type, Status: http.StatusBadRequest}
+}
+
+// newAuthorization returns a pending authorization of the identifier with
+// the challenges available for it: http-01 for DNS names (except
+// wildcards) and IP addresses, dns-01 for DNS names
+func newAuthorization(acct *account, id Identifier, expires time.Time) *authorization {
+	authz := &authorization{
+		ID:         newID(),
+		Account:    acct.ID,
+		Status:     statusPending,
+		Expires:    expires,
+		Identifier: id,
+	}
+
+	if value, ok := strings.CutPrefix(id.Value, "*."); ok {
+		authz.Identifier.Value = value
+		authz.Wildcard = true
+	}
+
+	if !authz.Wildcard {
+		authz.Challenges = append(authz.Challenges, challenge{Type: challengeHTTP, Status: statusPending, Token: newID()})
+	}
+	if id.Type == identifierDNS {
+		authz.Challenges = append(authz.Challenges, challenge{Type: challengeDNS, Status: statusPending, Token: newID()})
+	}
+
+	return authz
+}
+
+// newOrder creates an order and its authorizations (RFC 8555, section 7.4)
+func (s *Server) newOrder(w http.ResponseWriter, req *request) error {
+	var payload struct {
+		Identifiers []Identifier `json:"identifiers"`
+		NotBefore   string       `json:"notBefore"`
+		NotAfter    string       `json:"notAfter"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return malformed("invalid new order request")
+	}
+
+	if payload.NotBefore != "" || payload.NotAfter != "" {
+		return malformed("notBefore and notAfter are not supported, the validity is defined by the Certificate Authority policy")
+	}
+
+	if len(payload.Identifiers) == 0 || len(payload.Identifiers) > maxIdentifiers {
+		return malformed("the order must have between 1 and 100 identifiers")
+	}
+
+	var identifiers []Identifier
+	for _, id := range payload.Identifiers {
+		normalized, err := normalizeIdentifier(id)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(identifiers, normalized) {
+			identifiers = append(identifiers, normalized)
+		}
+	}
+
+	expires := time.Now().Add(orderValidity).UTC().Truncate(time.Second)
+	o := &order{
+		ID:          newID(),
+		Account:     req.account.ID,
+		Status:      statusPending,
+		Expires:     expires,
+		Identifiers: identifiers,
+	}
+
+	for _, id := range identifiers {
+		authz := newAuthorization(req.account, id, expires)
+		if err := save(req.ca, "authz", authz.ID, authz); err != nil {
+			return err
+		}
+		o.Authorizations = append(o.Authorizations, authz.ID)
+	}
+
+	if err := save(req.ca, "orders", o.ID, o); err != nil {
+		return err
+	}
+
+	req.account.Orders = append(req.account.Orders, o.ID)
+	if err := save(req.ca, "accounts", req.account.ID, req.account); err != nil {
+		return err
+	}
+
+	s.writeOrder(w, req, o, http.StatusCreated)
+
+	return nil
+}
+
+// getOrder returns the order (RFC 8555, section 7.4)
+func (s *Server) getOrder(w http.ResponseWriter, req *request, id string) error {
+	o, _, err := loadOrder(req.ca, req.account, id)
+	if err != nil {
+		return err
+	}
+
+	s.writeOrder(w, req, o, http.StatusOK)
+
+	return nil
+}
+
+// csrIdentifiers returns the identifiers requested by the CSR: the Subject
+// Alternative Names and the common name
+func csrIdentifiers(csr *x509.CertificateRequest) ([]Identifier, error) {
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return nil, &problem{Type: errBadCSR, Detail: "the CSR can only have DNS names and IP addresses", Status: http.StatusBadRequest}
+	}
+
+	var identifiers []Identifier
+	add := func(id Identifier) error {
+		normalized, err := normalizeIdentifier(id)
+		if err != nil {
+			return &problem{Type: errBadCSR, Detail: err.Error(), Status: http.StatusBadRequest}
+		}
+		if !slices.Contains(identifiers, normalized) {
+			identifiers = append(identifiers, normalized)
+		}
+		return nil
+	}
+
+	for _, name := range csr.DNSNames {
+		if err := add(Identifier{Type: identifierDNS, Value: name}); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if err := add(Identifier{Type: identifierIP, Value: ip.String()}); err != nil {
+			return nil, err
+		}
+	}
+
+	if commonName := csr.Subject.CommonName; commonName != "" {
+		id := Identifier{Type: identifierDNS, Value: commonName}
+		if net.ParseIP(commonName) != nil {
+			id.Type = identifierIP
+		}
+		if err := add(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return identifiers, nil
+}
+
+// sameIdentifiers returns if a and b have the same identifiers in any order
+func sameIdentifiers(a, b []Identifier) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, id := range a {
+		if !slices.Contains(b, id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// finalizeOrder signs the order CSR with the Certificate Authority (RFC 8555,
+// section 7.4)
+func (s *Server) finalizeOrder(w http.ResponseWriter, req *request, id string) error {
+	o, _, err := loadOrder(req.ca, req.account, id)
+	if err != nil {
+		return err
+	}
+
+	if o.Status != statusReady {
+		return &problem{Type: errOrderNotReady, Detail: "the order is " + o.Status, Status: http.StatusForbidden}
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return malformed("invalid finalize request")
+	}
+
+	csrDER, err := decodeBase64(payload.CSR)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return &problem{Type: errBadCSR, Detail: "invalid CSR", Status: http.StatusBadRequest}
+	}
+
+	requested, err := csrIdentifiers(csr)
+	if err != nil {
+		return err
+	}
+	if !sameIdentifiers(requested, o.Identifiers) {
+		return &problem{Type: errBadCSR, Detail: "the CSR identifiers do not match the order identifiers", Status: http.StatusBadRequest}
+	}
+
+	// the certificates are kept by common name
+	if csr.Subject.CommonName == "" {
+		csr.Subject.CommonName = o.Identifiers[0].Value
+	}
+
+	profile := s.Profile
+	if profile == "" {
+		profile = cert.DefaultProfile
+	}
+
+	// the Certificate Authority private key is only loaded to issue
+	ca, err := s.LoadCA(req.ca.commonName)
+	if err != nil {
+		return err
+	}
+
+	// a certificate for an existent common name renews it, the previous
+	// certificate stays valid until it expires or is revoked
+	certificate, err := ca.SignCSRWithProfile(*csr, 0, profile)
+	if errors.Is(err, cert.ErrCertExists) {
+		certificate, err = ca.RenewCertificate(csr.Subject.CommonName, goca.RenewOptions{CSR: csr, Profile: profile})
+	}
+	switch {
+	case errors.Is(err, cert.ErrCSRSignature):
+		return &problem{Type: errBadCSR, Detail: err.Error(), Status: http.StatusBadRequest}
+	case err != nil:
+		return err
+	}
+
+	issued := certificate.GoCert()
+	serialNumber := issued.SerialNumber.Text(16)
+
+	err = save(req.ca, "certs", serialNumber, issuedCertificate{
+		Account:     req.account.ID,
+		Order:       o.ID,
+		Certificate: issued.Raw,
+	})
+	if err != nil {
+		return err
+	}
+
+	o.Status = statusValid
+	o.Certificate = serialNumber
+	if err := save(req.ca, "orders", o.ID, o); err != nil {
+		return err
+	}
+
+	s.writeOrder(w, req, o, http.StatusOK)
+
+	return nil
+}
+
+// getCertificate returns the PEM certificate chain of an issued certificate
+// (RFC 8555, section 7.4.2)
+func (s *Server) getCertificate(w http.ResponseWriter, req *request, serialNumber string) error {
+	var issued issuedCertificate
+	if err := load(req.ca, "certs", serialNumber, &issued); err != nil {
+		return err
+	}
+	if issued.Account != req.account.ID {
+		return unauthorized("the certificate belongs to another account")
+	}
+
+	chain, err := goca.LoadChain(req.ca.commonName, s.CAOptions...)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	_ = pem.Encode(&body, &pem.Block{Type: "CERTIFICATE", Bytes: issued.Certificate})
+	for _, caCert := range chain {
+		_ = pem.Encode(&body, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body.Bytes())
+
+	return nil
+}
+
+// revokeCert revokes a certificate issued by the Certificate Authority
+// (RFC 8555, section 7.6). The request is signed by the account that
+// requested the certificate or by the certificate key.
+func (s *Server) revokeCert(w http.ResponseWriter, req *request) error {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      *int   `json:"reason"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return malformed("invalid revocation request")
+	}
+
+	certDER, err := decodeBase64(payload.Certificate)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return malformed("invalid certificate")
+	}
+
+	if err := certificate.CheckSignatureFrom(req.ca.certificate); err != nil {
+		return notFound("the certificate was not issued by the Certificate Authority")
+	}
+
+	if err := authorizeRevocation(req, certificate); err != nil {
+		return err
+	}
+
+	reason := cert.Unspecified
+	if payload.Reason != nil {
+		reason = cert.RevocationReason(*payload.Reason)
+	}
+
+	ca, err := s.LoadCA(req.ca.commonName)
+	if err != nil {
+		return err
+	}
+
+	err = ca.RevokeCertificateBySerial(certificate.SerialNumber, reason, time.Time{})
+	switch {
+	case errors.Is(err, goca.ErrCertLoadNotFound):
+		return notFound("the certificate is not managed by the Certificate Authority")
+	case errors.Is(err, cert.ErrRevocationReason):
+		return &problem{Type: errBadRevocationReason, Detail: err.Error(), Status: http.StatusBadRequest}
+	case errors.Is(err, goca.ErrCertRevoked):
+		return &problem{Type: errAlreadyRevoked, Detail: err.Error(), Status: http.StatusBadRequest}
+	case err != nil:
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// authorizeRevocation checks that the revocation request is signed by the
+// account that requested the certificate or by the certificate key
+func authorizeRevocation(req *request, certificate *x509.Certificate) error {
+	if req.account == nil {
+		key, err := parseJWK(req.jwk)
+		if err != nil {
+			return err
+		}
+		if pub, ok := certificate.PublicKey.(interface{ Equal(any) bool }); !ok || !pub.Equal(key) {
+			return unauthorized("the request is not signed by the certificate key")
+		}
+		return nil
+	}
+
+	var issued issuedCertificate
+	if err := load(req.ca, "certs", certificate.SerialNumber.Text(16), &issued); err != nil {
+		var p *problem
+		if errors.As(err, &p) {
+			return unauthorized("the certificate was not issued to the account")
+		}
+		return err
+	}
+	if issued.Account != req.account.ID {
+		return unauthorized("the certificate was not issued to the account")
+	}
+
+	return nil
+}
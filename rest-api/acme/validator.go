@@ -0,0 +1,152 @@
+package acme
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// maxHTTP01ResponseSize is the maximum size of the http-01 challenge response
+const maxHTTP01ResponseSize = 8 << 10
+
+// Validator validates the ACME challenges.
+//
+// The Server calls it with the key authorization of the challenge token
+// (RFC 8555, section 8.1). Returning an error marks the challenge and the
+// authorization invalid.
+type Validator interface {
+	// HTTP01 checks that http://<identifier>/.well-known/acme-challenge/<token>
+	// returns the key authorization (RFC 8555, section 8.3).
+	HTTP01(ctx context.Context, identifier Identifier, token, keyAuthorization string) error
+	// DNS01 checks that the TXT record _acme-challenge.<domain> has the
+	// DNS01Digest of the key authorization (RFC 8555, section 8.4).
+	DNS01(ctx context.Context, domain, keyAuthorization string) error
+}
+
+// DNS01Digest returns the TXT record value of the dns-01 challenge for the key
+// authorization
+func DNS01Digest(keyAuthorization string) string {
+	digest := sha256.Sum256([]byte(keyAuthorization))
+
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// NetValidator validates the challenges using the network: HTTP requests to
+// port 80 and DNS TXT queries.
+//
+// The http-01 challenges of the IP identifiers in the loopback, link-local and
+// private ranges are rejected unless AllowPrivateIPs is set, the server does
+// not request its own network for the ACME clients.
+type NetValidator struct {
+	Client          *http.Client  // HTTP client of the http-01 challenges (default: http.Client without redirects to other ports)
+	Resolver        *net.Resolver // Resolver of the dns-01 challenges (default: net.DefaultResolver)
+	AllowPrivateIPs bool          // Validates the IP identifiers in the loopback, link-local and private ranges
+}
+
+// HTTP01 implements Validator.
+func (v NetValidator) HTTP01(ctx context.Context, identifier Identifier, token, keyAuthorization string) error {
+	challengeURL := url.URL{
+		Scheme: "http",
+		Host:   identifier.Value,
+		Path:   "/.well-known/acme-challenge/" + token,
+	}
+	if identifier.Type == identifierIP {
+		if err := v.checkIP(identifier.Value); err != nil {
+			return &problem{Type: errRejectedIdentifier, Detail: err.Error(), Status: http.StatusForbidden}
+		}
+		if strings.Contains(identifier.Value, ":") {
+			challengeURL.Host = "[" + identifier.Value + "]"
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, challengeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{CheckRedirect: v.checkRedirect}
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return &problem{Type: errConnection, Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return &problem{Type: errIncorrectResponse, Detail: fmt.Sprintf("%s returned %s", challengeURL.String(), response.Status), Status: http.StatusForbidden}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxHTTP01ResponseSize))
+	if err != nil {
+		return &problem{Type: errConnection, Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return &problem{Type: errIncorrectResponse, Detail: challengeURL.String() + " returned an invalid key authorization", Status: http.StatusForbidden}
+	}
+
+	return nil
+}
+
+// DNS01 implements Validator.
+func (v NetValidator) DNS01(ctx context.Context, domain, keyAuthorization string) error {
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	name := "_acme-challenge." + domain
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return &problem{Type: errDNS, Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+
+	if !slices.Contains(records, DNS01Digest(keyAuthorization)) {
+		return &problem{Type: errIncorrectResponse, Detail: "no TXT record of " + name + " has the key authorization digest", Status: http.StatusForbidden}
+	}
+
+	return nil
+}
+
+// checkIP rejects the IP addresses in the loopback, link-local and private
+// ranges unless they are allowed
+func (v NetValidator) checkIP(address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %s", address)
+	}
+
+	if !v.AllowPrivateIPs && (ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()) {
+		return fmt.Errorf("the IP address %s is not public", address)
+	}
+
+	return nil
+}
+
+// checkRedirect follows up to 10 redirects to the ports 80 and 443 (RFC 8555,
+// section 8.3), not to the IP addresses rejected by checkIP
+func (v NetValidator) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+
+	if port := request.URL.Port(); port != "" && port != "80" && port != "443" {
+		return fmt.Errorf("redirect to the port %s is not allowed", port)
+	}
+
+	if host := request.URL.Hostname(); net.ParseIP(host) != nil {
+		return v.checkIP(host)
+	}
+
+	return nil
+}
@@ -0,0 +1,305 @@
+// Package auth provides the authentication and the role-based authorization
+// of the GoCA REST API.
+//
+// The principals are authenticated by static API tokens (Authorization:
+// Bearer), HTTP Basic with bcrypt password hashes or TLS client certificates
+// issued by a GoCA Certificate Authority. Their roles authorize the actions:
+//
+//	admin              all the actions
+//	issuer:<CA>        reads, issues, signs, renews, revokes and exports the
+//	                   certificates private keys in the CA
+//	auditor            reads all the Certificate Authorities
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/kairoaraujo/goca/v2"
+)
+
+// Role is a role of a principal
+type Role string
+
+// Roles
+const (
+	RoleAdmin   Role = "admin"
+	RoleAuditor Role = "auditor"
+	roleIssuer  Role = "issuer:"
+)
+
+// IssuerRole returns the issuer role of the Certificate Authority
+func IssuerRole(ca string) Role {
+	return roleIssuer + Role(ca)
+}
+
+// valid reports whether the role is admin, auditor or issuer of a CA
+func (r Role) valid() bool {
+	return r == RoleAdmin || r == RoleAuditor || (strings.HasPrefix(string(r), string(roleIssuer)) && len(r) > len(roleIssuer))
+}
+
+// Action is an action authorized by the roles
+type Action string
+
+// Actions
+const (
+	ActionRead      Action = "read"       // Reads the Certificate Authority
+	ActionIssue     Action = "issue"      // Issues, signs, renews and revokes certificates of the Certificate Authority
+	ActionExportKey Action = "export-key" // Exports the private keys of the certificates of the Certificate Authority
+	ActionAdmin     Action = "admin"      // Creates and configures the Certificate Authorities, exports their private keys
+)
+
+// Authentication methods
+const (
+	MethodToken             = "token"
+	MethodBasic             = "basic"
+	MethodClientCertificate = "client-certificate"
+)
+
+// Principal is an authenticated user of the REST API
+type Principal struct {
+	Name   string // Name of the user
+	Method string // Authentication method
+	Roles  []Role // Roles of the user
+}
+
+// Allowed reports whether the roles of the principal authorize the action in
+// the Certificate Authority ca, empty for the actions on all the Certificate
+// Authorities (as listing them).
+func (p *Principal) Allowed(action Action, ca string) bool {
+	for _, role := range p.Roles {
+		switch {
+		case role == RoleAdmin:
+			return true
+		case role == RoleAuditor && action == ActionRead:
+			return true
+		case strings.HasPrefix(string(role), string(roleIssuer)) && action != ActionAdmin:
+			if (ca == "" && action == ActionRead) || role == IssuerRole(ca) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ErrInvalidCredentials is returned by the Authenticators when the request
+// credentials are not valid
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator authenticates the principal of a request. It returns nil
+// without an error when the request has no credentials for it.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// User is a user of the REST API and its credentials, at least one of them.
+type User struct {
+	Name           string `json:"name"`                      // Name of the user, the certificate common name for ClientCA
+	PasswordBcrypt string `json:"password_bcrypt,omitempty"` // bcrypt hash of the HTTP Basic password
+	TokenSHA256    string `json:"token_sha256,omitempty"`    // Hex encoded SHA-256 of the API token
+	ClientCA       string `json:"client_ca,omitempty"`       // Certificate Authority issuing the TLS client certificate of the user
+	Roles          []Role `json:"roles"`                     // Roles of the user
+}
+
+func (u User) principal(method string) *Principal {
+	return &Principal{Name: u.Name, Method: method, Roles: u.Roles}
+}
+
+// TokenAuthenticator authenticates the Authorization: Bearer API tokens
+type TokenAuthenticator struct {
+	Users []User
+}
+
+// Authenticate implements Authenticator.
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	for _, user := range a.Users {
+		if user.TokenSHA256 == "" {
+			continue
+		}
+		expected, err := hex.DecodeString(user.TokenSHA256)
+		if err == nil && subtle.ConstantTimeCompare(hash[:], expected) == 1 {
+			return user.principal(MethodToken), nil
+		}
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// BasicAuthenticator authenticates the HTTP Basic credentials with the bcrypt
+// password hashes
+type BasicAuthenticator struct {
+	Users []User
+}
+
+// Authenticate implements Authenticator.
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	for _, user := range a.Users {
+		if user.Name != name || user.PasswordBcrypt == "" {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordBcrypt), []byte(password)) == nil {
+			return user.principal(MethodBasic), nil
+		}
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// ClientCertificateAuthenticator authenticates the TLS client certificates.
+//
+// The client certificate must be the current, not revoked, certificate of the
+// user common name issued by the user ClientCA. The Certificate Authority
+// private key is not loaded.
+type ClientCertificateAuthenticator struct {
+	Users     []User
+	CAOptions []goca.Option // Options of the Certificate Authorities issuing the client certificates
+}
+
+// Authenticate implements Authenticator.
+func (a *ClientCertificateAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+
+	peer := r.TLS.PeerCertificates[0]
+	now := time.Now()
+	if now.Before(peer.NotBefore) || now.After(peer.NotAfter) {
+		return nil, ErrInvalidCredentials
+	}
+
+	commonName := peer.Subject.CommonName
+	for _, user := range a.Users {
+		if user.Name != commonName || user.ClientCA == "" {
+			continue
+		}
+
+		caCertificate, err := goca.LoadCACertificate(user.ClientCA, a.CAOptions...)
+		if err != nil || peer.CheckSignatureFrom(caCertificate) != nil {
+			continue
+		}
+
+		record, err := goca.LoadCertificateRecord(user.ClientCA, peer.SerialNumber, a.CAOptions...)
+		if err != nil || record.Status == goca.CertificateRevoked ||
+			record.Path != filepath.Join(user.ClientCA, "certs", commonName, commonName+".crt") {
+			continue
+		}
+
+		return user.principal(MethodClientCertificate), nil
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// principalKey keeps the Principal in the gin.Context
+const principalKey = "goca.principal"
+
+// guardKey keeps the Guard authenticating the request in the gin.Context
+const guardKey = "goca.guard"
+
+// PrincipalFrom returns the principal authenticated by the Guard, nil when the
+// Guard has no Authenticators.
+func PrincipalFrom(c *gin.Context) *Principal {
+	principal, _ := c.Value(principalKey).(*Principal)
+	return principal
+}
+
+// Guard authenticates the requests and authorizes the actions of the
+// principals.
+//
+// A Guard without Authenticators accepts all the requests, except the private
+// keys exports that require an authenticated principal.
+type Guard struct {
+	Authenticators []Authenticator
+}
+
+// Principal authenticates the request with the Authenticators, it fails
+// without valid credentials. It returns nil without an error when the Guard
+// has no Authenticators.
+func (g *Guard) Principal(r *http.Request) (*Principal, error) {
+	if len(g.Authenticators) == 0 {
+		return nil, nil
+	}
+
+	for _, authenticator := range g.Authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if principal != nil {
+			return principal, nil
+		}
+	}
+
+	return nil, errors.New("authentication required")
+}
+
+// Authenticate is the middleware authenticating the requests, the requests
+// without valid credentials are rejected with 401 Unauthorized.
+func (g *Guard) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := g.Principal(c.Request)
+		if err != nil {
+			unauthorized(c, err)
+			return
+		}
+		if principal != nil {
+			c.Set(principalKey, principal)
+		}
+		c.Set(guardKey, g)
+	}
+}
+
+// Allowed reports whether the request authenticated by the Guard middleware
+// is allowed the action in the Certificate Authority of the cn path
+// parameter, for the handlers authorizing an action from the request content.
+// The requests not authenticated by a Guard are not allowed.
+func Allowed(c *gin.Context, action Action) bool {
+	g, ok := c.Value(guardKey).(*Guard)
+	return ok && g.allowed(c, action)
+}
+
+func (g *Guard) allowed(c *gin.Context, action Action) bool {
+	if len(g.Authenticators) == 0 {
+		return action != ActionExportKey
+	}
+
+	principal := PrincipalFrom(c)
+	return principal != nil && principal.Allowed(action, c.Param("cn"))
+}
+
+// Require is the middleware authorizing the action in the Certificate
+// Authority of the cn path parameter, the requests of principals without a
+// role allowing it are rejected with 403 Forbidden.
+func (g *Guard) Require(action Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !g.allowed(c, action) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed to " + string(action)})
+		}
+	}
+}
+
+func unauthorized(c *gin.Context, err error) {
+	c.Header("WWW-Authenticate", `Basic realm="GoCA", Bearer`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,215 @@
+package auth_test
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/key"
+	"github.com/kairoaraujo/goca/v2/rest-api/auth"
+)
+
+func TestAllowed(t *testing.T) {
+	for _, test := range []struct {
+		role    auth.Role
+		action  auth.Action
+		ca      string
+		allowed bool
+	}{
+		{auth.RoleAdmin, auth.ActionAdmin, "", true},
+		{auth.RoleAdmin, auth.ActionIssue, "go-auth.ca", true},
+		{auth.RoleAuditor, auth.ActionRead, "", true},
+		{auth.RoleAuditor, auth.ActionRead, "go-auth.ca", true},
+		{auth.RoleAuditor, auth.ActionIssue, "go-auth.ca", false},
+		{auth.IssuerRole("go-auth.ca"), auth.ActionRead, "", true},
+		{auth.IssuerRole("go-auth.ca"), auth.ActionIssue, "go-auth.ca", true},
+		{auth.IssuerRole("go-auth.ca"), auth.ActionIssue, "other.ca", false},
+		{auth.IssuerRole("go-auth.ca"), auth.ActionRead, "other.ca", false},
+		{auth.IssuerRole("go-auth.ca"), auth.ActionAdmin, "go-auth.ca", false},
+	} {
+		principal := &auth.Principal{Roles: []auth.Role{test.role}}
+		if allowed := principal.Allowed(test.action, test.ca); allowed != test.allowed {
+			t.Errorf("Expected %s %s in %q allowed %t but got: %t", test.role, test.action, test.ca, test.allowed, allowed)
+		}
+	}
+}
+
+func TestFunctionalGuard(t *testing.T) {
+	store := goca.NewMemoryStorage()
+	ca, err := goca.New("go-auth.ca", goca.Identity{
+		Organization:       "Auth Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ca.IssueCertificate("ops.go-auth.ca", goca.Identity{KeyAlgorithm: key.ECDSAP256, Profile: cert.TLSClientProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCertificate, err := tls.X509KeyPair([]byte(client.Certificate), []byte(client.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := sha256.Sum256([]byte("ci-token"))
+
+	configFile := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(configFile, []byte(`{"users": [
+		{"name": "admin", "password_bcrypt": "`+string(password)+`", "roles": ["admin"]},
+		{"name": "ci", "token_sha256": "`+hex.EncodeToString(token[:])+`", "roles": ["issuer:go-auth.ca"]},
+		{"name": "ops.go-auth.ca", "client_ca": "go-auth.ca", "roles": ["auditor"]}
+	]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := auth.LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client certificates are verified without loading the CA key
+	guard := &auth.Guard{Authenticators: config.Authenticators(goca.WithStorage(store), goca.WithObserver(func(event goca.Event) {
+		t.Errorf("Unexpected %s event", event.Operation)
+	}))}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	v1 := router.Group("/api/v1", guard.Authenticate())
+	ok := func(c *gin.Context) {
+		c.String(http.StatusOK, auth.PrincipalFrom(c).Name)
+	}
+	v1.GET("/ca", guard.Require(auth.ActionRead), ok)
+	v1.POST("/ca", guard.Require(auth.ActionAdmin), ok)
+	v1.POST("/ca/:cn/certificates", guard.Require(auth.ActionIssue), ok)
+	v1.POST("/ca/:cn/sign", guard.Require(auth.ActionIssue), func(c *gin.Context) {
+		if !auth.Allowed(c, auth.ActionAdmin) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		ok(c)
+	})
+	router.POST("/unguarded/:cn", func(c *gin.Context) {
+		if !auth.Allowed(c, auth.ActionRead) {
+			c.AbortWithStatus(http.StatusForbidden)
+		}
+	})
+
+	server := httptest.NewUnstartedServer(router)
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	mtlsTransport := server.Client().Transport.(*http.Transport).Clone()
+	mtlsTransport.TLSClientConfig.Certificates = []tls.Certificate{clientCertificate}
+	mtlsClient := &http.Client{Transport: mtlsTransport}
+
+	for _, test := range []struct {
+		name   string
+		client *http.Client
+		method string
+		path   string
+		header func(r *http.Request)
+		status int
+	}{
+		{"anonymous", server.Client(), http.MethodGet, "/api/v1/ca", nil, http.StatusUnauthorized},
+		{"basic admin", server.Client(), http.MethodPost, "/api/v1/ca", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"basic wrong password", server.Client(), http.MethodGet, "/api/v1/ca", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"token issuer", server.Client(), http.MethodPost, "/api/v1/ca/go-auth.ca/certificates", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-token") }, http.StatusOK},
+		{"token issuer other CA", server.Client(), http.MethodPost, "/api/v1/ca/other.ca/certificates", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-token") }, http.StatusForbidden},
+		{"token issuer create CA", server.Client(), http.MethodPost, "/api/v1/ca", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-token") }, http.StatusForbidden},
+		{"token issuer admin action", server.Client(), http.MethodPost, "/api/v1/ca/go-auth.ca/sign", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ci-token") }, http.StatusForbidden},
+		{"basic admin admin action", server.Client(), http.MethodPost, "/api/v1/ca/go-auth.ca/sign", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"not authenticated by a guard", server.Client(), http.MethodPost, "/unguarded/go-auth.ca", nil, http.StatusForbidden},
+		{"wrong token", server.Client(), http.MethodGet, "/api/v1/ca", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"client certificate auditor", mtlsClient, http.MethodGet, "/api/v1/ca", nil, http.StatusOK},
+		{"client certificate auditor issue", mtlsClient, http.MethodPost, "/api/v1/ca/go-auth.ca/certificates", nil, http.StatusForbidden},
+	} {
+		request, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != nil {
+			test.header(request)
+		}
+
+		response, err := test.client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != test.status {
+			t.Errorf("%s: expected status %d but got: %d", test.name, test.status, response.StatusCode)
+		}
+	}
+
+	// the revoked client certificate is not accepted
+	if err := ca.RevokeCertificate("ops.go-auth.ca"); err != nil {
+		t.Fatal(err)
+	}
+	mtlsClient.CloseIdleConnections()
+	response, err := mtlsClient.Get(server.URL + "/api/v1/ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked client certificate to be unauthorized but got: %d", response.StatusCode)
+	}
+}
+
+func TestGuardWithoutAuthenticators(t *testing.T) {
+	guard := &auth.Guard{}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	v1 := router.Group("/api/v1", guard.Authenticate())
+	ok := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	v1.POST("/ca", guard.Require(auth.ActionAdmin), ok)
+	v1.POST("/ca/:cn/certificates/:cert_cn/key", guard.Require(auth.ActionExportKey), ok)
+
+	for path, status := range map[string]int{
+		"/api/v1/ca": http.StatusOK,
+		"/api/v1/ca/go-auth.ca/certificates/go-auth/key": http.StatusForbidden,
+	} {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodPost, path, nil))
+		if response.Code != status {
+			t.Errorf("%s: expected status %d but got: %d", path, status, response.Code)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, config := range []auth.Config{
+		{Users: []auth.User{{Name: "", TokenSHA256: hex.EncodeToString(make([]byte, 32)), Roles: []auth.Role{auth.RoleAdmin}}}},
+		{Users: []auth.User{{Name: "admin", Roles: []auth.Role{auth.RoleAdmin}}}},
+		{Users: []auth.User{{Name: "ci", TokenSHA256: "plain-token", Roles: []auth.Role{auth.RoleAdmin}}}},
+		{Users: []auth.User{{Name: "ci", ClientCA: "go-auth.ca", Roles: []auth.Role{"issuer:"}}}},
+		{Users: []auth.User{{Name: "ci", ClientCA: "go-auth.ca"}}},
+		{Users: []auth.User{{Name: "ci", ClientCA: "go-auth.ca", Roles: []auth.Role{auth.RoleAuditor}}, {Name: "ci", ClientCA: "go-auth.ca", Roles: []auth.Role{auth.RoleAuditor}}}},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected the configuration %+v to be invalid", config)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kairoaraujo/goca/v2"
+)
+
+// Config is the authentication configuration file of the REST API:
+//
+//	{
+//	  "users": [
+//	    {"name": "admin", "password_bcrypt": "$2a$10$...", "roles": ["admin"]},
+//	    {"name": "ci", "token_sha256": "9f86d08...", "roles": ["issuer:mycompany.com"]},
+//	    {"name": "ops.mycompany.com", "client_ca": "mycompany.com", "roles": ["auditor"]}
+//	  ]
+//	}
+type Config struct {
+	Users []User `json:"users"`
+}
+
+// LoadConfig reads and validates the JSON configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid authentication configuration %s: %w", path, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid authentication configuration %s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+// Validate checks that the users have a name, at least one credential and
+// valid roles.
+func (c *Config) Validate() error {
+	names := map[string]bool{}
+
+	for i, user := range c.Users {
+		if user.Name == "" {
+			return fmt.Errorf("user %d has no name", i)
+		}
+		if names[user.Name] {
+			return fmt.Errorf("user %s is duplicated", user.Name)
+		}
+		names[user.Name] = true
+
+		if user.PasswordBcrypt == "" && user.TokenSHA256 == "" && user.ClientCA == "" {
+			return fmt.Errorf("user %s has no password_bcrypt, token_sha256 or client_ca", user.Name)
+		}
+		if token, err := hex.DecodeString(user.TokenSHA256); user.TokenSHA256 != "" && (err != nil || len(token) != 32) {
+			return fmt.Errorf("user %s token_sha256 is not a hex encoded SHA-256", user.Name)
+		}
+
+		if len(user.Roles) == 0 {
+			return fmt.Errorf("user %s has no roles", user.Name)
+		}
+		for _, role := range user.Roles {
+			if !role.valid() {
+				return fmt.Errorf("user %s has the invalid role %q", user.Name, role)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Authenticators returns the Authenticators of the users credentials: API
+// tokens, HTTP Basic and TLS client certificates of the Certificate
+// Authorities loaded with the caOptions.
+func (c *Config) Authenticators(caOptions ...goca.Option) []Authenticator {
+	var (
+		authenticators                     []Authenticator
+		hasToken, hasPassword, hasClientCA bool
+	)
+
+	for _, user := range c.Users {
+		hasToken = hasToken || user.TokenSHA256 != ""
+		hasPassword = hasPassword || user.PasswordBcrypt != ""
+		hasClientCA = hasClientCA || user.ClientCA != ""
+	}
+
+	if hasToken {
+		authenticators = append(authenticators, &TokenAuthenticator{Users: c.Users})
+	}
+	if hasPassword {
+		authenticators = append(authenticators, &BasicAuthenticator{Users: c.Users})
+	}
+	if hasClientCA {
+		authenticators = append(authenticators, &ClientCertificateAuthenticator{Users: c.Users, CAOptions: caOptions})
+	}
+
+	return authenticators
+}
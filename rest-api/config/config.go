@@ -0,0 +1,504 @@
+// Package config provides the configuration of the GoCA REST API server: a
+// YAML (or JSON) file, the GOCA_* environment variables overriding it for the
+// container deployments and the command line flags overriding both.
+//
+//	listen: ":8443"
+//	tls:
+//	  ca: mycompany.com
+//	  hosts: [goca.mycompany.com, 10.0.0.10]
+//	  client_ca: mycompany.com
+//	storage:
+//	  path: /var/lib/goca
+//	auth:
+//	  config_file: /etc/goca/auth.json
+//	cas:
+//	  mycompany.com:
+//	    policy:
+//	      default_validity: 2160h
+//	      crl_distribution_points: [http://goca.mycompany.com/crl/mycompany.com.crl]
+//	crl:
+//	  interval: 30m
+//	audit:
+//	  file: /var/log/goca/audit.log
+//	log:
+//	  access_format: json
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/rest-api/auth"
+)
+
+// Storage backends
+const (
+	BackendFileSystem = "filesystem"
+	BackendMemory     = "memory"
+)
+
+// Access log formats
+const (
+	AccessFormatText = "text"
+	AccessFormatJSON = "json"
+	AccessFormatNone = "none"
+)
+
+// Config is the configuration of the REST API server
+type Config struct {
+	Listen          string        `json:"listen"`                    // Address to listen (default: ":80", ":443" with TLS)
+	ShutdownTimeout cert.Duration `json:"shutdown_timeout"`          // Time to finish the requests in progress on SIGTERM
+	PassphraseFile  string        `json:"passphrase_file,omitempty"` // File with the passphrase of the CA private keys (default: $GOCA_PASSPHRASE)
+	TLS             TLS           `json:"tls"`                       // HTTPS serving
+	Storage         Storage       `json:"storage"`                   // Storage of the Certificate Authorities
+	Auth            Auth          `json:"auth"`                      // Authentication of the API users
+	CAs             map[string]CA `json:"cas,omitempty"`             // Policies and profiles by Certificate Authority common name
+	CRL             CRL           `json:"crl"`                       // CRLs publishing
+	Expiry          Expiry        `json:"expiry"`                    // Certificates expiration monitoring
+	ACME            ACME          `json:"acme"`                      // ACME directories
+	EST             EST           `json:"est"`                       // EST enrollment
+	SCEP            SCEP          `json:"scep"`                      // SCEP enrollment
+	Audit           Audit         `json:"audit"`                     // Audit log of the CA operations
+	Log             Log           `json:"log"`                       // Logging
+}
+
+// TLS configures the HTTPS serving with a certificate file or a certificate
+// issued by one of the Certificate Authorities.
+type TLS struct {
+	Cert               string   `json:"cert,omitempty"`                 // Certificate file, with Key
+	Key                string   `json:"key,omitempty"`                  // Private key file of Cert
+	CA                 string   `json:"ca,omitempty"`                   // Certificate Authority issuing and renewing the server certificate
+	Hosts              []string `json:"hosts,omitempty"`                // DNS names and IP addresses of the CA server certificate, the first one is the common name (default: hostname)
+	ClientCA           string   `json:"client_ca,omitempty"`            // Certificate Authority verifying the TLS client certificates
+	ClientCertRequired bool     `json:"client_cert_required,omitempty"` // Rejects the clients without a certificate issued by ClientCA
+}
+
+// Enabled reports whether the server serves HTTPS
+func (t TLS) Enabled() bool {
+	return t.Cert != "" || t.CA != ""
+}
+
+// Storage configures the Storage of the Certificate Authorities
+type Storage struct {
+	Backend string `json:"backend,omitempty"` // filesystem or memory (default: filesystem)
+	Path    string `json:"path,omitempty"`    // Root directory of the filesystem backend (default: $CAPATH)
+}
+
+// Open returns the Storage of the backend
+func (s Storage) Open() goca.Storage {
+	if s.Backend == BackendMemory {
+		return goca.NewMemoryStorage()
+	}
+
+	return goca.NewFileSystemStorage(s.Path)
+}
+
+// Auth configures the API users, inline or in the auth.Config JSON file
+type Auth struct {
+	ConfigFile string      `json:"config_file,omitempty"` // auth.Config JSON file
+	Users      []auth.User `json:"users,omitempty"`       // Users of the API, exclusive with ConfigFile
+}
+
+// Load returns the authentication configuration, nil without users (the API
+// accepts unauthenticated requests).
+func (a Auth) Load() (*auth.Config, error) {
+	if a.ConfigFile != "" {
+		return auth.LoadConfig(a.ConfigFile)
+	}
+	if len(a.Users) == 0 {
+		return nil, nil
+	}
+
+	return &auth.Config{Users: a.Users}, nil
+}
+
+// CA is the configuration applied to an existing Certificate Authority at
+// startup
+type CA struct {
+	Policy   *cert.Policy   `json:"policy,omitempty"`   // Issuance policy, replacing the stored one
+	Profiles []cert.Profile `json:"profiles,omitempty"` // Custom certificate profiles, replacing the stored ones with the same name
+}
+
+// CRL configures the CRLs publishing
+type CRL struct {
+	Interval cert.Duration `json:"interval"` // Interval to sign again the CRLs before they expire, 0 disables it
+}
+
+// Expiry configures the certificates expiration monitoring
+type Expiry struct {
+	Interval cert.Duration `json:"interval"`           // Interval to check the certificates expirations, 0 disables it
+	Within   cert.Duration `json:"within"`             // Notifies the certificates expiring within
+	Webhooks []string      `json:"webhooks,omitempty"` // URLs receiving the expiration events as JSON POST
+}
+
+// ACME configures the ACME directories. The http-01 challenges of the IP
+// identifiers in the loopback, link-local and private ranges are rejected
+// unless AllowPrivateIPs is set.
+type ACME struct {
+	Enabled         bool   `json:"enabled,omitempty"`           // Serves the ACME directories
+	URL             string `json:"url,omitempty"`               // External URL of the ACME directories (default: built from the request)
+	Profile         string `json:"profile,omitempty"`           // Certificate profile of the certificates issued by ACME
+	AllowPrivateIPs bool   `json:"allow_private_ips,omitempty"` // Validates the http-01 challenges of the private IP identifiers
+}
+
+// EST configures the EST enrollment. The enrollments are authorized by the
+// API authentication (issuer role of the CA), the re-enrollments by the
+// current client certificate.
+type EST struct {
+	Enabled bool   `json:"enabled,omitempty"` // Serves the EST endpoints, requires auth
+	Profile string `json:"profile,omitempty"` // Certificate profile of the certificates issued by EST, not a CA profile (default: tls-client)
+}
+
+// SCEP configures the SCEP enrollment, disabled without a challenge password.
+// The challenge password has no command line flag, it is set in the file or
+// with $GOCA_SCEP_CHALLENGE.
+type SCEP struct {
+	Challenge string `json:"challenge,omitempty"` // Challenge password of the SCEP requests (default: SCEP disabled)
+	Profile   string `json:"profile,omitempty"`   // Certificate profile of the certificates issued by SCEP
+}
+
+// Audit configures the audit log of the Certificate Authority operations
+type Audit struct {
+	File string `json:"file,omitempty"` // Hash chained JSON lines audit log file (default: no audit log)
+}
+
+// Log configures the logging
+type Log struct {
+	Output       string `json:"output,omitempty"`        // stderr, stdout or a file path (default: stderr)
+	AccessFormat string `json:"access_format,omitempty"` // HTTP access log: text, json or none (default: text)
+}
+
+// Default returns the configuration without file, environment or flags
+func Default() *Config {
+	return &Config{
+		ShutdownTimeout: cert.Duration(30 * time.Second),
+		CRL:             CRL{Interval: cert.Duration(time.Hour)},
+		EST:             EST{Profile: cert.TLSClientProfile},
+		Expiry: Expiry{
+			Interval: cert.Duration(time.Hour),
+			Within:   cert.Duration(30 * 24 * time.Hour),
+		},
+	}
+}
+
+// Parse returns the configuration from the file given by -config (or
+// $GOCA_CONFIG), the environment variables returned by lookupEnv and the
+// command line arguments, in increasing precedence, validated.
+func Parse(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+
+	configFile, _ := lookupEnv("GOCA_CONFIG")
+	fs.StringVar(&configFile, "config", configFile, "Configuration file (default: $GOCA_CONFIG)")
+	c.RegisterFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		if err := c.Load(configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.ApplyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	// the command line flags override the file and the environment
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return c, nil
+}
+
+// Load reads the YAML or JSON configuration file over the current values
+func (c *Config) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// RegisterFlags defines the command line flags of the configuration
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("p", "Port to listen, default is 80 (443 with TLS)", func(value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return errors.New("invalid port")
+		}
+		c.Listen = fmt.Sprintf(":%d", port)
+		return nil
+	})
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Address to listen, e.g. 127.0.0.1:8080")
+	fs.DurationVar((*time.Duration)(&c.ShutdownTimeout), "shutdown-timeout", time.Duration(c.ShutdownTimeout), "Time to finish the requests in progress on SIGTERM")
+	fs.StringVar(&c.PassphraseFile, "passphrase-file", c.PassphraseFile, "File with the passphrase of the CA private keys (default: $GOCA_PASSPHRASE)")
+
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "Certificate file to serve HTTPS, with -tls-key")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "Private key file of the -tls-cert certificate")
+	fs.StringVar(&c.TLS.CA, "tls-ca", c.TLS.CA, "Certificate Authority issuing and renewing the server certificate to serve HTTPS")
+	fs.Func("tls-hosts", "Comma separated DNS names and IP addresses of the -tls-ca server certificate, the first one is the common name (default: hostname)", func(value string) error {
+		c.TLS.Hosts = splitList(value)
+		return nil
+	})
+	fs.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "Certificate Authority verifying the TLS client certificates")
+	fs.BoolVar(&c.TLS.ClientCertRequired, "tls-client-cert-required", c.TLS.ClientCertRequired, "Rejects the TLS clients without a certificate issued by -tls-client-ca")
+
+	fs.StringVar(&c.Storage.Backend, "storage-backend", c.Storage.Backend, "Storage of the Certificate Authorities: filesystem or memory (default: filesystem)")
+	fs.StringVar(&c.Storage.Path, "storage-path", c.Storage.Path, "Root directory of the filesystem storage (default: $CAPATH)")
+
+	fs.StringVar(&c.Auth.ConfigFile, "auth-config", c.Auth.ConfigFile, "Authentication configuration file of the API users and roles (default: no authentication)")
+
+	fs.DurationVar((*time.Duration)(&c.CRL.Interval), "crl-interval", time.Duration(c.CRL.Interval), "Interval to sign again the CRLs before they expire, 0 disables it")
+
+	fs.DurationVar((*time.Duration)(&c.Expiry.Interval), "expiry-interval", time.Duration(c.Expiry.Interval), "Interval to check the certificates expirations, 0 disables it")
+	fs.DurationVar((*time.Duration)(&c.Expiry.Within), "expiry-within", time.Duration(c.Expiry.Within), "Notifies the certificates expiring within")
+	fs.Func("expiry-webhook", "Comma separated URLs receiving the expiration events as JSON POST", func(value string) error {
+		c.Expiry.Webhooks = splitList(value)
+		return nil
+	})
+
+	fs.BoolVar(&c.ACME.Enabled, "acme-enabled", c.ACME.Enabled, "Serves the ACME directories")
+	fs.StringVar(&c.ACME.URL, "acme-url", c.ACME.URL, "External URL of the ACME directories, e.g. https://ca.example.com/acme (default: built from the request)")
+	fs.StringVar(&c.ACME.Profile, "acme-profile", c.ACME.Profile, "Certificate profile of the certificates issued by ACME (default: default)")
+	fs.BoolVar(&c.ACME.AllowPrivateIPs, "acme-allow-private-ips", c.ACME.AllowPrivateIPs, "Validates the ACME http-01 challenges of the loopback, link-local and private IP identifiers")
+	fs.BoolVar(&c.EST.Enabled, "est-enabled", c.EST.Enabled, "Serves the EST enrollment, authorized by the API authentication")
+	fs.StringVar(&c.EST.Profile, "est-profile", c.EST.Profile, "Certificate profile of the certificates issued by EST")
+	fs.StringVar(&c.SCEP.Profile, "scep-profile", c.SCEP.Profile, "Certificate profile of the certificates issued by SCEP (default: default)")
+
+	fs.StringVar(&c.Audit.File, "audit-file", c.Audit.File, "Hash chained JSON lines audit log of the CA operations (default: no audit log)")
+
+	fs.StringVar(&c.Log.Output, "log-output", c.Log.Output, "Log output: stderr, stdout or a file path (default: stderr)")
+	fs.StringVar(&c.Log.AccessFormat, "log-access-format", c.Log.AccessFormat, "HTTP access log format: text, json or none (default: text)")
+}
+
+// ApplyEnv overrides the configuration with the environment variables
+// returned by lookupEnv:
+//
+//	GOCA_LISTEN, GOCA_SHUTDOWN_TIMEOUT, GOCA_PASSPHRASE_FILE,
+//	GOCA_TLS_CERT, GOCA_TLS_KEY, GOCA_TLS_CA, GOCA_TLS_HOSTS,
+//	GOCA_TLS_CLIENT_CA, GOCA_TLS_CLIENT_CERT_REQUIRED,
+//	GOCA_STORAGE_BACKEND, GOCA_STORAGE_PATH, GOCA_AUTH_CONFIG,
+//	GOCA_CRL_INTERVAL, GOCA_EXPIRY_INTERVAL, GOCA_EXPIRY_WITHIN,
+//	GOCA_EXPIRY_WEBHOOKS, GOCA_ACME_URL, GOCA_ACME_PROFILE,
+//	GOCA_EST_ENABLED, GOCA_EST_PROFILE, GOCA_SCEP_CHALLENGE,
+//	GOCA_SCEP_PROFILE, GOCA_AUDIT_FILE, GOCA_LOG_OUTPUT and
+//	GOCA_LOG_ACCESS_FORMAT
+//
+// The lists are comma separated.
+func (c *Config) ApplyEnv(lookupEnv func(string) (string, bool)) error {
+	var errs []error
+
+	setString := func(name string, field *string) {
+		if value, ok := lookupEnv(name); ok {
+			*field = value
+		}
+	}
+	setList := func(name string, field *[]string) {
+		if value, ok := lookupEnv(name); ok {
+			*field = splitList(value)
+		}
+	}
+	setBool := func(name string, field *bool) {
+		if value, ok := lookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid boolean %q", name, value))
+				return
+			}
+			*field = parsed
+		}
+	}
+	setDuration := func(name string, field *cert.Duration) {
+		if value, ok := lookupEnv(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", name, value))
+				return
+			}
+			*field = cert.Duration(parsed)
+		}
+	}
+
+	setString("GOCA_LISTEN", &c.Listen)
+	setDuration("GOCA_SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	setString("GOCA_PASSPHRASE_FILE", &c.PassphraseFile)
+	setString("GOCA_TLS_CERT", &c.TLS.Cert)
+	setString("GOCA_TLS_KEY", &c.TLS.Key)
+	setString("GOCA_TLS_CA", &c.TLS.CA)
+	setList("GOCA_TLS_HOSTS", &c.TLS.Hosts)
+	setString("GOCA_TLS_CLIENT_CA", &c.TLS.ClientCA)
+	setBool("GOCA_TLS_CLIENT_CERT_REQUIRED", &c.TLS.ClientCertRequired)
+	setString("GOCA_STORAGE_BACKEND", &c.Storage.Backend)
+	setString("GOCA_STORAGE_PATH", &c.Storage.Path)
+	setString("GOCA_AUTH_CONFIG", &c.Auth.ConfigFile)
+	setDuration("GOCA_CRL_INTERVAL", &c.CRL.Interval)
+	setDuration("GOCA_EXPIRY_INTERVAL", &c.Expiry.Interval)
+	setDuration("GOCA_EXPIRY_WITHIN", &c.Expiry.Within)
+	setList("GOCA_EXPIRY_WEBHOOKS", &c.Expiry.Webhooks)
+	setBool("GOCA_ACME_ENABLED", &c.ACME.Enabled)
+	setString("GOCA_ACME_URL", &c.ACME.URL)
+	setString("GOCA_ACME_PROFILE", &c.ACME.Profile)
+	setBool("GOCA_ACME_ALLOW_PRIVATE_IPS", &c.ACME.AllowPrivateIPs)
+	setBool("GOCA_EST_ENABLED", &c.EST.Enabled)
+	setString("GOCA_EST_PROFILE", &c.EST.Profile)
+	setString("GOCA_SCEP_CHALLENGE", &c.SCEP.Challenge)
+	setString("GOCA_SCEP_PROFILE", &c.SCEP.Profile)
+	setString("GOCA_AUDIT_FILE", &c.Audit.File)
+	setString("GOCA_LOG_OUTPUT", &c.Log.Output)
+	setString("GOCA_LOG_ACCESS_FORMAT", &c.Log.AccessFormat)
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the configuration, returning all the invalid settings
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			invalid("listen: %q is not a host:port address", c.Listen)
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		invalid("shutdown_timeout: must not be negative")
+	}
+
+	switch {
+	case (c.TLS.Cert == "") != (c.TLS.Key == ""):
+		invalid("tls: cert and key must be set together")
+	case c.TLS.Cert != "" && c.TLS.CA != "":
+		invalid("tls: cert and ca are exclusive")
+	}
+	if len(c.TLS.Hosts) > 0 && c.TLS.CA == "" {
+		invalid("tls: hosts requires ca")
+	}
+	if c.TLS.ClientCA != "" && !c.TLS.Enabled() {
+		invalid("tls: client_ca requires cert or ca")
+	}
+	if c.TLS.ClientCertRequired && c.TLS.ClientCA == "" {
+		invalid("tls: client_cert_required requires client_ca")
+	}
+
+	switch c.Storage.Backend {
+	case "", BackendFileSystem:
+	case BackendMemory:
+		if c.Storage.Path != "" {
+			invalid("storage: path is not used by the memory backend")
+		}
+	default:
+		invalid("storage: unknown backend %q, use filesystem or memory", c.Storage.Backend)
+	}
+
+	if c.Auth.ConfigFile != "" && len(c.Auth.Users) > 0 {
+		invalid("auth: config_file and users are exclusive")
+	}
+	if len(c.Auth.Users) > 0 {
+		config := auth.Config{Users: c.Auth.Users}
+		if err := config.Validate(); err != nil {
+			invalid("auth: %w", err)
+		}
+	}
+
+	builtinProfiles := cert.BuiltinProfiles()
+	for commonName, ca := range c.CAs {
+		if ca.Policy != nil {
+			if err := ca.Policy.Validate(); err != nil {
+				invalid("cas.%s.policy: %w", commonName, err)
+			}
+		}
+		for i, profile := range ca.Profiles {
+			if _, builtin := builtinProfiles[profile.Name]; builtin {
+				invalid("cas.%s.profiles[%d]: %q is a built-in profile name", commonName, i, profile.Name)
+			}
+			if err := profile.Validate(); err != nil {
+				invalid("cas.%s.profiles[%d]: %w", commonName, i, err)
+			}
+		}
+	}
+
+	if c.CRL.Interval < 0 {
+		invalid("crl: interval must not be negative")
+	}
+	if c.Expiry.Interval < 0 {
+		invalid("expiry: interval must not be negative")
+	}
+	if c.Expiry.Interval > 0 && c.Expiry.Within <= 0 {
+		invalid("expiry: within must be positive")
+	}
+	for _, webhook := range c.Expiry.Webhooks {
+		if !validURL(webhook) {
+			invalid("expiry: webhook %q is not a http(s) URL", webhook)
+		}
+	}
+	if c.ACME.URL != "" && !validURL(c.ACME.URL) {
+		invalid("acme: url %q is not a http(s) URL", c.ACME.URL)
+	}
+	if c.EST.Enabled && c.Auth.ConfigFile == "" && len(c.Auth.Users) == 0 {
+		invalid("est: enabled requires the auth users")
+	}
+	if c.EST.Profile == "" {
+		invalid("est: profile is required")
+	}
+
+	switch c.Log.AccessFormat {
+	case "", AccessFormatText, AccessFormatJSON, AccessFormatNone:
+	default:
+		invalid("log: unknown access_format %q, use text, json or none", c.Log.AccessFormat)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Address returns the address to listen, by default port 80 or 443 with TLS
+func (c *Config) Address() string {
+	switch {
+	case c.Listen != "":
+		return c.Listen
+	case c.TLS.Enabled():
+		return ":443"
+	}
+
+	return ":80"
+}
+
+func validURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// splitList returns the non empty values of the comma separated list
+func splitList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,244 @@
+package config_test
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/rest-api/config"
+)
+
+const configFile = `
+listen: ":8443"
+shutdown_timeout: 10s
+tls:
+  ca: go-config.ca
+  hosts: [goca.example.com, 10.0.0.10]
+  client_ca: go-config.ca
+storage:
+  backend: filesystem
+  path: /var/lib/goca
+auth:
+  users:
+    - name: ci
+      token_sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+      roles: ["issuer:go-config.ca"]
+cas:
+  go-config.ca:
+    policy:
+      default_validity: 2160h
+      crl_distribution_points: [http://goca.example.com/crl/go-config.ca.crl]
+    profiles:
+      - name: short-lived
+        key_usage: [digital_signature]
+        ext_key_usage: [client_auth]
+        max_validity: 24h
+crl:
+  interval: 30m
+expiry:
+  webhooks: [https://hooks.example.com/goca]
+scep:
+  challenge: file-challenge
+log:
+  access_format: json
+`
+
+func parse(t *testing.T, content string, env map[string]string, args ...string) (*config.Config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "goca.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("goca", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	lookupEnv := func(name string) (string, bool) {
+		if name == "GOCA_CONFIG" {
+			return path, true
+		}
+		value, ok := env[name]
+		return value, ok
+	}
+
+	return config.Parse(fs, args, lookupEnv)
+}
+
+func TestConfigFile(t *testing.T) {
+	c, err := parse(t, configFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Address() != ":8443" || time.Duration(c.ShutdownTimeout) != 10*time.Second {
+		t.Errorf("Unexpected listen %s and shutdown timeout %s", c.Address(), time.Duration(c.ShutdownTimeout))
+	}
+	if !c.TLS.Enabled() || c.TLS.CA != "go-config.ca" || len(c.TLS.Hosts) != 2 || c.TLS.ClientCA != "go-config.ca" {
+		t.Errorf("Unexpected TLS configuration %+v", c.TLS)
+	}
+	if c.Storage.Path != "/var/lib/goca" {
+		t.Errorf("Unexpected storage path %s", c.Storage.Path)
+	}
+
+	authConfig, err := c.Auth.Load()
+	if err != nil || authConfig == nil || len(authConfig.Users) != 1 {
+		t.Errorf("Unexpected auth configuration %+v: %v", authConfig, err)
+	}
+
+	ca := c.CAs["go-config.ca"]
+	if ca.Policy == nil || ca.Policy.DefaultValidity != cert.Duration(2160*time.Hour) || len(ca.Policy.CRLDistributionPoints) != 1 {
+		t.Errorf("Unexpected CA policy %+v", ca.Policy)
+	}
+	if len(ca.Profiles) != 1 || ca.Profiles[0].MaxValidity != cert.Duration(24*time.Hour) {
+		t.Errorf("Unexpected CA profiles %+v", ca.Profiles)
+	}
+
+	// the values missing in the file keep the defaults
+	if time.Duration(c.CRL.Interval) != 30*time.Minute || time.Duration(c.Expiry.Interval) != time.Hour ||
+		time.Duration(c.Expiry.Within) != 30*24*time.Hour {
+		t.Errorf("Unexpected CRL %+v and expiry %+v", c.CRL, c.Expiry)
+	}
+	if c.Log.AccessFormat != config.AccessFormatJSON {
+		t.Errorf("Unexpected log configuration %+v", c.Log)
+	}
+	if c.SCEP.Challenge != "file-challenge" {
+		t.Errorf("Unexpected SCEP challenge %q", c.SCEP.Challenge)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	env := map[string]string{
+		"GOCA_LISTEN":          ":9443",
+		"GOCA_CRL_INTERVAL":    "15m",
+		"GOCA_EXPIRY_WEBHOOKS": "https://a.example.com, https://b.example.com",
+		"GOCA_STORAGE_PATH":    "/data",
+		"GOCA_SCEP_CHALLENGE":  "env-challenge",
+	}
+
+	// the environment overrides the file and the flags override both
+	c, err := parse(t, configFile, env, "-crl-interval", "5m", "-tls-hosts", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Address() != ":9443" {
+		t.Errorf("Expected the GOCA_LISTEN address but got %s", c.Address())
+	}
+	if time.Duration(c.CRL.Interval) != 5*time.Minute {
+		t.Errorf("Expected the -crl-interval flag but got %s", time.Duration(c.CRL.Interval))
+	}
+	if len(c.Expiry.Webhooks) != 2 || c.Expiry.Webhooks[1] != "https://b.example.com" {
+		t.Errorf("Unexpected webhooks %v", c.Expiry.Webhooks)
+	}
+	if c.Storage.Path != "/data" || len(c.TLS.Hosts) != 1 || c.TLS.Hosts[0] != "localhost" {
+		t.Errorf("Unexpected storage path %s and TLS hosts %v", c.Storage.Path, c.TLS.Hosts)
+	}
+	if c.SCEP.Challenge != "env-challenge" {
+		t.Errorf("Expected the GOCA_SCEP_CHALLENGE challenge but got %q", c.SCEP.Challenge)
+	}
+
+	// -p keeps working
+	if c, err = parse(t, configFile, nil, "-p", "8080"); err != nil || c.Address() != ":8080" {
+		t.Errorf("Expected the -p port but got %v: %v", c, err)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c, err := parse(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Address() != ":80" || c.TLS.Enabled() {
+		t.Errorf("Unexpected default address %s", c.Address())
+	}
+
+	if c, err = parse(t, "", nil, "-tls-ca", "go-config.ca"); err != nil || c.Address() != ":443" {
+		t.Errorf("Expected the HTTPS default port but got %v: %v", c, err)
+	}
+
+	authConfig, err := c.Auth.Load()
+	if err != nil || authConfig != nil {
+		t.Errorf("Expected no authentication but got %+v: %v", authConfig, err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		env     map[string]string
+		errors  []string
+	}{
+		"unknown field": {
+			content: "listen: \":80\"\ncrl:\n  intervals: 1h\n",
+			errors:  []string{`unknown field "intervals"`},
+		},
+		"invalid duration": {
+			content: "crl:\n  interval: hourly\n",
+			errors:  []string{"invalid duration"},
+		},
+		"EST without authentication": {
+			content: "est:\n  enabled: true\n",
+			errors:  []string{"est: enabled requires the auth users"},
+		},
+		"built-in profile name": {
+			content: "cas:\n  go-config.ca:\n    profiles:\n      - name: sub-ca\n        key_usage: [digital_signature]\n",
+			errors:  []string{`cas.go-config.ca.profiles[0]: "sub-ca" is a built-in profile name`},
+		},
+		"invalid environment": {
+			env:    map[string]string{"GOCA_EXPIRY_WITHIN": "month", "GOCA_TLS_CLIENT_CERT_REQUIRED": "maybe"},
+			errors: []string{"GOCA_EXPIRY_WITHIN: invalid duration", "GOCA_TLS_CLIENT_CERT_REQUIRED: invalid boolean"},
+		},
+		"invalid settings": {
+			content: `
+listen: "8080"
+tls:
+  cert: server.crt
+  client_cert_required: true
+storage:
+  backend: s3
+auth:
+  config_file: auth.json
+  users: [{name: ci, roles: [admin]}]
+cas:
+  go-config.ca:
+    policy:
+      min_validity: 48h
+      max_validity: 24h
+expiry:
+  webhooks: [hooks.example.com]
+log:
+  access_format: xml
+`,
+			errors: []string{
+				`listen: "8080" is not a host:port address`,
+				"tls: cert and key must be set together",
+				"tls: client_cert_required requires client_ca",
+				`storage: unknown backend "s3"`,
+				"auth: config_file and users are exclusive",
+				"auth: user ci has no password_bcrypt, token_sha256 or client_ca",
+				"cas.go-config.ca.policy:",
+				`expiry: webhook "hooks.example.com" is not a http(s) URL`,
+				`log: unknown access_format "xml"`,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parse(t, test.content, test.env)
+			if err == nil {
+				t.Fatal("Expected a configuration error")
+			}
+			for _, expected := range test.errors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected %q in the error: %v", expected, err)
+				}
+			}
+		})
+	}
+}
@@ -1,22 +1,124 @@
 package controllers
 
 import (
+	"crypto"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/kairoaraujo/goca/v2"
 	storage "github.com/kairoaraujo/goca/v2/_storage"
 	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/rest-api/auth"
 	"github.com/kairoaraujo/goca/v2/rest-api/models"
+	"golang.org/x/crypto/ocsp"
 )
 
+const (
+	ocspResponseType   string = "application/ocsp-response"
+	maxOCSPRequestSize int64  = 64 << 10
+	caIssuersMaxAge    int    = 24 * 60 * 60
+)
+
+// caOptions are the options used to create and load the Certificate Authorities
+var caOptions []goca.Option
+
+// SetCAOptions sets the options used by the handlers to create and load the
+// Certificate Authorities, for example goca.WithPassphrase.
+func SetCAOptions(opts ...goca.Option) {
+	caOptions = opts
+}
+
+// responderOptions are the options used to load the Certificate Authorities
+// answering the anonymous OCSP requests
+var responderOptions []goca.Option
+
+// responders caches the Certificate Authorities answering the OCSP requests by
+// common name, their private key is unlocked once
+var responders sync.Map
+
+// SetResponderOptions sets the options used to load the Certificate
+// Authorities answering the OCSP requests, without an audit sink: the
+// responder keys are unlocked on the first request and kept in memory.
+func SetResponderOptions(opts ...goca.Option) {
+	responderOptions = opts
+	responders.Range(func(commonName, _ any) bool {
+		responders.Delete(commonName)
+		return true
+	})
+}
+
+// ocspResponder returns the cached Certificate Authority answering the OCSP
+// requests, loaded again when its certificate was replaced
+func ocspResponder(commonName string) (goca.CA, error) {
+	current, err := goca.LoadCACertificate(commonName, responderOptions...)
+	if err != nil {
+		return goca.CA{}, err
+	}
+
+	if cached, ok := responders.Load(commonName); ok && cached.(*goca.CA).GoCertificate().Equal(current) {
+		return *cached.(*goca.CA), nil
+	}
+
+	ca, err := goca.Load(commonName, responderOptions...)
+	if err != nil {
+		return goca.CA{}, err
+	}
+	responders.Store(commonName, &ca)
+
+	return ca, nil
+}
+
+// requestOptions returns the caOptions with the actor of the request, the
+// authenticated principal or anonymous, recorded by the audit log.
+func requestOptions(c *gin.Context) []goca.Option {
+	actor := "anonymous"
+	if principal := auth.PrincipalFrom(c); principal != nil {
+		actor = principal.Name
+	}
+
+	return append(caOptions[:len(caOptions):len(caOptions)], goca.WithActor(actor))
+}
+
+// allowedProfile reports whether the principal is allowed to use the
+// certificate profile, the CA profiles issuing Certificate Authorities require
+// the admin role. The request is rejected with 403 Forbidden otherwise.
+func allowedProfile(c *gin.Context, ca goca.CA, name string) bool {
+	profile, err := ca.Profile(name)
+	if err != nil || !profile.IsCA || auth.Allowed(c, auth.ActionAdmin) {
+		return true
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{"error": "not allowed to " + string(auth.ActionAdmin) + " with the CA profile " + profile.Name})
+	return false
+}
+
+func loadUploadedFile(c *gin.Context) ([]byte, error) {
+	fileUploaded, err := c.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fileUploaded.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
 func getCAData(ca goca.CA) (body models.CABody) {
 
 	caType := ca.IsIntermediate()
@@ -49,7 +151,16 @@ func getCAData(ca goca.CA) (body models.CABody) {
 		}
 	}
 
-	body.Files = ca.Data
+	if policy, err := ca.Policy(); err == nil {
+		body.Policy = policy
+	}
+
+	body.Files = models.CAFiles{
+		CRL:         ca.Data.CRL,
+		Certificate: ca.Data.Certificate,
+		CSR:         ca.Data.CSR,
+		PublicKey:   ca.Data.PublicKey,
+	}
 
 	return body
 }
@@ -63,7 +174,12 @@ func getCertificateData(certificate goca.Certificate) (body models.CertificateBo
 	body.SerialNumber = cert.SerialNumber.String()
 	body.IssueDate = cert.NotBefore.String()
 	body.ExpireDate = cert.NotAfter.String()
-	body.Files = certificate
+	body.Files = models.CertificateFiles{
+		Certificate:   certificate.Certificate,
+		CSR:           certificate.CSR,
+		PublicKey:     certificate.PublicKey,
+		CACertificate: certificate.CACertificate,
+	}
 
 	return body
 
@@ -81,8 +197,11 @@ func payloadInit(json models.Payload) (commonName, parentCommonName string, iden
 		Province:           json.Identity.Province,
 		DNSNames:           json.Identity.DNSNames,
 		Intermediate:       json.Identity.Intermediate,
+		KeyAlgorithm:       json.Identity.KeyAlgorithm,
 		KeyBitSize:         json.Identity.KeyBitSize,
 		Valid:              json.Identity.Valid,
+		Validity:           json.Identity.Validity,
+		Profile:            json.Identity.Profile,
 	}
 
 	return commonName, parentCommonName, identity
@@ -96,9 +215,13 @@ func payloadInit(json models.Payload) (commonName, parentCommonName string, iden
 // @Success 200 {object} models.ResponseList
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca [get]
 func GetCA(c *gin.Context) {
-	var caList []string = goca.List()
+	var caList []string = goca.List(caOptions...)
 	c.JSON(http.StatusOK, gin.H{"data": caList})
 }
 
@@ -112,6 +235,10 @@ func GetCA(c *gin.Context) {
 // @Success 200 {object} models.ResponseCA
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca [post]
 func AddCA(c *gin.Context) {
 
@@ -128,9 +255,9 @@ func AddCA(c *gin.Context) {
 	commonName, parentCommonName, identity := payloadInit(json)
 
 	if parentCommonName == "" {
-		ca, err = goca.New(commonName, identity)
+		ca, err = goca.New(commonName, identity, requestOptions(c)...)
 	} else {
-		ca, err = goca.NewCA(commonName, parentCommonName, identity)
+		ca, err = goca.NewCA(commonName, parentCommonName, identity, requestOptions(c)...)
 	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -151,12 +278,16 @@ func AddCA(c *gin.Context) {
 // @Success 200 {object} models.ResponseCA
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn} [get]
 func GetCACommonName(c *gin.Context) {
 
 	var body models.CABody
 
-	ca, err := goca.Load(c.Param("cn"))
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -181,12 +312,16 @@ func GetCACommonName(c *gin.Context) {
 // @Success 200 {object} models.ResponseCA
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn}/upload [post]
 func UploadCertificateICA(c *gin.Context) {
 
 	var body models.CABody
 	caCN := c.Param("cn")
-	ca, err := goca.Load(caCN)
+	ca, err := goca.Load(caCN, requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -202,20 +337,28 @@ func UploadCertificateICA(c *gin.Context) {
 		return
 	}
 
-	certUploaded, _ := c.FormFile("file")
-	fileName := uuid.New().String()
-	fileNameFull := filepath.Join(os.Getenv("CAPATH"), fileName)
-	if err := c.SaveUploadedFile(certUploaded, fileNameFull); err != nil {
+	certFile, err := loadUploadedFile(c)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	certFile, err := storage.LoadFile(fileName)
+	// the certificate is stored as DER, the storage does the PEM encoding
+	if block, _ := pem.Decode(certFile); block != nil {
+		certFile = block.Bytes
+	}
+
+	// the certificate must certify the key of the Intermediate CA
+	certificate, err := x509.ParseCertificate(certFile)
 	if err != nil {
-		os.Remove(fileNameFull)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	caPublicKey, ok := ca.GoPublicKey().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !caPublicKey.Equal(certificate.PublicKey) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the certificate public key does not match the Intermediate Certificate Authority key"})
+		return
+	}
 
 	fileData := storage.File{
 		CA:           caCN,
@@ -224,24 +367,20 @@ func UploadCertificateICA(c *gin.Context) {
 		CertData:     certFile,
 		CreationType: storage.CreationTypeCA,
 	}
-	err = storage.SaveFile(fileData)
+	err = storage.SaveFile(ca.Storage(), fileData)
 	if err != nil {
-		os.Remove(fileNameFull)
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
 	}
 
-	ca, err = goca.Load(caCN)
+	ca, err = goca.Load(caCN, requestOptions(c)...)
 	if err != nil {
-		os.Remove(fileNameFull)
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-	os.Remove(fileNameFull)
 
-	// Generate the initial CRL
-	privKey := ca.GoPrivateKey()
-	_, err = cert.RevokeCertificate(ca.CommonName, []x509.RevocationListEntry{}, ca.GoCertificate(), &privKey)
-	if err != nil {
+	// Generate the initial CRL, valid for the CRL NextUpdate of the policy
+	if err := ca.RegenerateCRL(); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
@@ -259,49 +398,52 @@ func UploadCertificateICA(c *gin.Context) {
 // @Produce json
 // @Param file formData file true "Attached CSR file"
 // @Param valid query int false "Number certificate valid days"
+// @Param validity query string false "Certificate validity, overrides valid (example: 12h)"
+// @Param profile query string false "Certificate profile (default: default)"
 // @Success 200 {object} models.ResponseCertificates
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn}/sign [post]
 func SignCSR(c *gin.Context) {
 
 	var body models.CertificateBody
-	var valid int = 0
-
-	csrUploaded, _ := c.FormFile("file")
+	var validity time.Duration
 
 	if c.Query("valid") != "" {
 		valid, err := strconv.Atoi(c.Query("valid"))
 		if err != nil {
-			fmt.Println(valid)
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-
+		validity = time.Duration(valid) * cert.Day
 	}
 
-	fileName := uuid.New().String()
-	fileNameFull := filepath.Join(os.Getenv("CAPATH"), fileName)
-	if err := c.SaveUploadedFile(csrUploaded, fileNameFull); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if c.Query("validity") != "" {
+		var err error
+		validity, err = time.ParseDuration(c.Query("validity"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	csrFile, err := storage.LoadFile(fileName)
+	csrFile, err := loadUploadedFile(c)
 	if err != nil {
-		os.Remove(fileNameFull)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	csr, err := cert.LoadCSR(csrFile)
 	if err != nil {
-		os.Remove(fileNameFull)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	ca, err := goca.Load(c.Param("cn"))
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -311,30 +453,305 @@ func SignCSR(c *gin.Context) {
 
 		return
 	}
-	certificate, err := ca.SignCSR(*csr, valid)
+	if !allowedProfile(c, ca, c.Query("profile")) {
+		return
+	}
+	certificate, err := ca.SignCSRWithProfile(*csr, validity, c.Query("profile"))
 	if err != nil {
-		os.Remove(fileNameFull)
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		if err == cert.ErrCSRSignature || err == cert.ErrCertExists || err == cert.ErrProfileNotFound || err == goca.ErrCSRCertificateAuthority {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		}
+		return
 	}
-	os.Remove(fileNameFull)
 
 	body = getCertificateData(certificate)
 
 	c.JSON(http.StatusOK, gin.H{"data": body})
 }
 
+// GetProfiles is the handler of Certificate Profiles by Authorities endpoint
+// @Summary List the Certificate Profiles of a certain Certificate Authority
+// @Description list the built-in and custom certificate profiles available in the Certificate Authority (cn)
+// @Tags CA
+// @Produce json
+// @Success 200 {object} models.ResponseProfiles
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /api/v1/ca/{cn}/profiles [get]
+func GetProfiles(c *gin.Context) {
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+
+	profiles, err := ca.Profiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": profiles})
+}
+
+// SetPolicy is the handler of Certificate Authority Policy endpoint
+// @Summary Set the Certificate Authority issuance policy
+// @Description store the validity bounds, OCSP responder URLs and delegated OCSP signer of the Certificate Authority (cn)
+// @Tags CA
+// @Accept json
+// @Produce json
+// @Param policy body cert.Policy true "Certificate Authority issuance policy"
+// @Success 200 {object} models.ResponsePolicy
+// @Failure 400 {object} models.ResponseError
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /api/v1/ca/{cn}/policy [put]
+func SetPolicy(c *gin.Context) {
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+
+	var policy cert.Policy
+
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the CA private key export is only allowed with the goca package
+	current, err := ca.Policy()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	policy.AllowCAKeyExport = current.AllowCAKeyExport
+
+	if err := ca.SetPolicy(policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policy})
+}
+
+// OCSP is the handler of the OCSP responder endpoint
+// @Summary OCSP responder (RFC 6960)
+// @Description answers the certificate status from the Certificate Authority (cn) revocation data. The GET request is the base64 encoded DER OCSP request.
+// @Tags OCSP
+// @Accept application/ocsp-request
+// @Produce application/ocsp-response
+// @Param request path string false "Base64 encoded OCSP request (GET)"
+// @Success 200 {string} string "DER encoded OCSP response"
+// @Router /ocsp/{cn} [post]
+// @Router /ocsp/{cn}/{request} [get]
+func OCSP(c *gin.Context) {
+
+	var (
+		request []byte
+		err     error
+	)
+
+	if c.Request.Method == http.MethodGet {
+		request, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(c.Param("request"), "/"))
+	} else {
+		request, err = io.ReadAll(io.LimitReader(c.Request.Body, maxOCSPRequestSize))
+	}
+	if err != nil {
+		c.Data(http.StatusOK, ocspResponseType, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	ca, err := ocspResponder(c.Param("cn"))
+	if err != nil {
+		if err == goca.ErrCALoadNotFound || err == goca.ErrCertLoadNotFound {
+			c.Data(http.StatusOK, ocspResponseType, ocsp.UnauthorizedErrorResponse)
+		} else {
+			c.Data(http.StatusOK, ocspResponseType, ocsp.InternalErrorErrorResponse)
+		}
+
+		return
+	}
+
+	response, err := ca.OCSPResponse(request)
+	switch err {
+	case nil:
+		c.Data(http.StatusOK, ocspResponseType, response)
+	case goca.ErrOCSPRequest:
+		c.Data(http.StatusOK, ocspResponseType, ocsp.MalformedRequestErrorResponse)
+	case goca.ErrOCSPIssuer:
+		c.Data(http.StatusOK, ocspResponseType, ocsp.UnauthorizedErrorResponse)
+	default:
+		c.Data(http.StatusOK, ocspResponseType, ocsp.InternalErrorErrorResponse)
+	}
+}
+
+// GetCRL is the handler of the Certificate Revocation List distribution endpoint
+// @Summary Certificate Revocation List (CRL) distribution
+// @Description the Certificate Authority CRL, DER encoded ({cn}.crl or {cn}) or PEM encoded ({cn}.pem)
+// @Tags CRL
+// @Produce application/pkix-crl
+// @Produce application/x-pem-file
+// @Param file path string true "CA common name with the .crl (DER) or .pem (PEM) extension"
+// @Success 200 {string} string "Certificate Revocation List"
+// @Success 304 {string} string "Not Modified"
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Router /crl/{file} [get]
+func GetCRL(c *gin.Context) {
+
+	commonName := c.Param("file")
+	pemEncoded := strings.HasSuffix(commonName, ".pem")
+	commonName = strings.TrimSuffix(strings.TrimSuffix(commonName, ".pem"), ".crl")
+
+	// the CRL is read from the storage, without unlocking the CA key
+	crl, err := goca.LoadCRL(commonName, caOptions...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+
+	if crl == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the Certificate Authority has no Certificate Revocation List"})
+		return
+	}
+
+	maxAge := int(time.Until(crl.NextUpdate).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	etag := `"` + crl.Number.String() + `"`
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", crl.ThisUpdate.UTC().Format(http.TimeFormat))
+	c.Header("Expires", crl.NextUpdate.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, no-transform", maxAge))
+
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !crl.ThisUpdate.Truncate(time.Second).After(since) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	if pemEncoded {
+		c.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Raw}))
+	} else {
+		c.Data(http.StatusOK, "application/pkix-crl", crl.Raw)
+	}
+}
+
+// GetCAIssuers is the handler of the Authority Information Access CA Issuers endpoint
+// @Summary Certificate Authority (CA) certificate and chain publication
+// @Description the Certificate Authority certificate DER encoded ({cn}.cer) or the PKCS #7 certs-only bundle of the chain up to the root CA ({cn}.p7c)
+// @Tags AIA
+// @Produce application/pkix-cert
+// @Produce application/pkcs7-mime
+// @Param file path string true "CA common name with the .cer (DER certificate) or .p7c (PKCS #7 chain) extension"
+// @Success 200 {string} string "Certificate or PKCS #7 bundle"
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Router /{file} [get]
+func GetCAIssuers(c *gin.Context) {
+
+	file := c.Param("file")
+	if !strings.HasSuffix(file, ".cer") && !strings.HasSuffix(file, ".p7c") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	// the chain is read from the storage, without unlocking the CA key
+	chain, err := goca.LoadChain(file[:len(file)-len(".cer")], caOptions...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound || err == goca.ErrCertLoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", caIssuersMaxAge))
+	c.Header("Last-Modified", chain[0].NotBefore.UTC().Format(http.TimeFormat))
+
+	if strings.HasSuffix(file, ".cer") {
+		c.Data(http.StatusOK, "application/pkix-cert", chain[0].Raw)
+		return
+	}
+
+	bundle, err := cert.PKCS7Certificates(chain)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/pkcs7-mime", bundle)
+}
+
 // GetCertificates is the handler of Certificates by Authorities Certificates endpoint
-// @Summary List all Certificates managed by a certain Certificate Authority
-// @Description list all certificates managed by a certain Certificate Authority (cn)
+// @Summary List the Certificates managed by a certain Certificate Authority
+// @Description search the certificates managed by a certain Certificate Authority (cn), returning one page of certificates summaries and the cursor of the next page
 // @Tags CA/{CN}/Certificates
 // @Produce json
-// @Success 200 {object} models.ResponseCA
+// @Param cn path string true "Common Name"
+// @Param status query string false "Certificate status" Enums(valid, expired, revoked)
+// @Param expiring_within query int false "Valid certificates expiring within the days"
+// @Param san query string false "Subject Alternative Name (DNS name, IP address, email address or URI) substring"
+// @Param serial query string false "Certificate serial number (decimal or 0x prefixed hexadecimal)"
+// @Param profile query string false "Certificate profile"
+// @Param archived query bool false "Includes the certificates archived by renewals"
+// @Param sort query string false "Sort field, prefixed by - for descending order" Enums(common_name, -common_name, serial_number, -serial_number, not_before, -not_before, not_after, -not_after) default(common_name)
+// @Param limit query int false "Certificates per page (default: 100, maximum: 1000)"
+// @Param cursor query string false "Cursor of the page, from the previous page next_cursor"
+// @Success 200 {object} models.ResponseCertificateSummaries
+// @Failure 400 {object} models.ResponseError
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn}/certificates [get]
 func GetCertificates(c *gin.Context) {
 
-	ca, err := goca.Load(c.Param("cn"))
+	query, err := parseCertificatesQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -345,7 +762,165 @@ func GetCertificates(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": ca.ListCertificates()})
+	records, err := ca.CertificateRecords()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	summaries := []models.CertificateSummary{}
+	for _, record := range records {
+		if query.match(record, now) {
+			summaries = append(summaries, models.CertificateSummary{
+				CommonName:   record.CommonName,
+				SerialNumber: record.SerialNumber,
+				NotBefore:    record.NotBefore,
+				NotAfter:     record.NotAfter,
+				Status:       record.StatusAt(now),
+				Profile:      record.Profile,
+				DNSNames:     record.DNSNames,
+				Archived:     record.Archived(),
+			})
+		}
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if query.descending {
+			i, j = j, i
+		}
+		return query.less(summaries[i], summaries[j])
+	})
+
+	response := models.ResponseCertificateSummaries{Data: summaries[min(query.offset, len(summaries)):]}
+	if len(response.Data) > query.limit {
+		response.Data = response.Data[:query.limit]
+		response.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(query.offset + query.limit)))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// maxCertificatesLimit is the maximum page size of the certificates search
+const maxCertificatesLimit = 1000
+
+// certificatesQuery is the certificates search of GetCertificates
+type certificatesQuery struct {
+	status         goca.CertificateStatus
+	expiringWithin time.Duration
+	san            string
+	serial         string
+	profile        string
+	archived       bool
+	less           func(a, b models.CertificateSummary) bool
+	descending     bool
+	limit          int
+	offset         int
+}
+
+func parseCertificatesQuery(c *gin.Context) (query certificatesQuery, err error) {
+	query.status = goca.CertificateStatus(c.Query("status"))
+	switch query.status {
+	case "", goca.CertificateValid, goca.CertificateExpired, goca.CertificateRevoked:
+	default:
+		return query, fmt.Errorf("invalid status %q, use valid, expired or revoked", query.status)
+	}
+
+	if c.Query("expiring_within") != "" {
+		days, err := strconv.Atoi(c.Query("expiring_within"))
+		if err != nil || days < 0 {
+			return query, fmt.Errorf("invalid expiring_within %q, use a number of days", c.Query("expiring_within"))
+		}
+		query.expiringWithin = time.Duration(days) * cert.Day
+	}
+
+	query.san = strings.ToLower(c.Query("san"))
+	query.profile = c.Query("profile")
+
+	if c.Query("serial") != "" {
+		serial, ok := new(big.Int).SetString(c.Query("serial"), 0)
+		if !ok {
+			return query, fmt.Errorf("invalid serial %q", c.Query("serial"))
+		}
+		query.serial = serial.String()
+	}
+
+	if c.Query("archived") != "" {
+		if query.archived, err = strconv.ParseBool(c.Query("archived")); err != nil {
+			return query, fmt.Errorf("invalid archived %q", c.Query("archived"))
+		}
+	}
+
+	field, descending := strings.CutPrefix(c.DefaultQuery("sort", "common_name"), "-")
+	query.descending = descending
+	switch field {
+	case "common_name":
+		query.less = func(a, b models.CertificateSummary) bool { return a.CommonName < b.CommonName }
+	case "serial_number":
+		query.less = func(a, b models.CertificateSummary) bool {
+			x, _ := new(big.Int).SetString(a.SerialNumber, 10)
+			y, _ := new(big.Int).SetString(b.SerialNumber, 10)
+			return x.Cmp(y) < 0
+		}
+	case "not_before":
+		query.less = func(a, b models.CertificateSummary) bool { return a.NotBefore.Before(b.NotBefore) }
+	case "not_after":
+		query.less = func(a, b models.CertificateSummary) bool { return a.NotAfter.Before(b.NotAfter) }
+	default:
+		return query, fmt.Errorf("invalid sort %q, use common_name, serial_number, not_before or not_after", field)
+	}
+
+	query.limit = 100
+	if c.Query("limit") != "" {
+		query.limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || query.limit < 1 || query.limit > maxCertificatesLimit {
+			return query, fmt.Errorf("invalid limit %q, use 1 to %d", c.Query("limit"), maxCertificatesLimit)
+		}
+	}
+
+	if c.Query("cursor") != "" {
+		offset, err := base64.RawURLEncoding.DecodeString(c.Query("cursor"))
+		if err == nil {
+			query.offset, err = strconv.Atoi(string(offset))
+		}
+		if err != nil || query.offset < 0 {
+			return query, fmt.Errorf("invalid cursor %q", c.Query("cursor"))
+		}
+	}
+
+	return query, nil
+}
+
+// match reports whether the certificate record matches the search at now
+func (q certificatesQuery) match(record goca.CertificateRecord, now time.Time) bool {
+	status := record.StatusAt(now)
+
+	switch {
+	case !q.archived && record.Archived():
+		return false
+	case q.status != "" && status != q.status:
+		return false
+	case q.expiringWithin > 0 && (status != goca.CertificateValid || record.NotAfter.After(now.Add(q.expiringWithin))):
+		return false
+	case q.serial != "" && record.SerialNumber != q.serial:
+		return false
+	case q.profile != "" && record.Profile != q.profile:
+		return false
+	}
+
+	if q.san == "" {
+		return true
+	}
+
+	for _, names := range [][]string{record.DNSNames, record.IPAddresses, record.EmailAddresses, record.URIs} {
+		for _, name := range names {
+			if strings.Contains(strings.ToLower(name), q.san) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 // AddCertificates is the handler of Certificates by Authorities Certificates endpoint
@@ -355,13 +930,18 @@ func GetCertificates(c *gin.Context) {
 // @Produce json
 // @Accept json
 // @Param ca body models.Payload true "Add new Certificate Authority or Intermediate Certificate Authority"
+// @Param profile query string false "Certificate profile, overrides the identity profile (default: default)"
 // @Success 200 {object} models.ResponseCertificates
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn}/certificates [post]
 func IssueCertificates(c *gin.Context) {
 
-	ca, err := goca.Load(c.Param("cn"))
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -385,6 +965,12 @@ func IssueCertificates(c *gin.Context) {
 	}
 
 	commonName, _, identity := payloadInit(json)
+	if c.Query("profile") != "" {
+		identity.Profile = c.Query("profile")
+	}
+	if !allowedProfile(c, ca, identity.Profile) {
+		return
+	}
 
 	certificate, err := ca.IssueCertificate(commonName, identity)
 	if err != nil {
@@ -405,10 +991,14 @@ func IssueCertificates(c *gin.Context) {
 // @Success 200 {object} models.ResponseCertificates
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn}/certificates/{certificate_cn} [get]
 func GetCertificatesCommonName(c *gin.Context) {
 
-	ca, err := goca.Load(c.Param("cn"))
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -431,19 +1021,264 @@ func GetCertificatesCommonName(c *gin.Context) {
 
 }
 
+// RenewCertificate is the handler of Certificates by Authorities Certificates Renew endpoint
+// @Summary CA renew a existent certificate managed by CA
+// @Description the Certificate Authority issues a new certificate for the common name, archiving the previous one. Without rekey or csr the same key is certified again.
+// @Tags CA/{CN}/Certificates
+// @Produce json
+// @Accept json
+// @Param renewal body models.RenewBody false "Renewal options: rekey, a new PEM CSR, validity (example: 12h), profile and revoke the previous certificate as superseded"
+// @Success 200 {object} models.ResponseCertificates
+// @Failure 400 {object} models.ResponseError
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /api/v1/ca/{cn}/certificates/{certificate_cn}/renew [post]
+func RenewCertificate(c *gin.Context) {
+
+	var renewal models.RenewBody
+
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&renewal); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	opts := goca.RenewOptions{
+		Rekey:   renewal.Rekey,
+		Profile: renewal.Profile,
+		Revoke:  renewal.Revoke,
+	}
+
+	if renewal.Validity != "" {
+		var err error
+		if opts.Validity, err = time.ParseDuration(renewal.Validity); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if renewal.CSR != "" {
+		csr, err := cert.LoadCSR([]byte(renewal.CSR))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.CSR = csr
+	}
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+	// the renewal keeps the profile of the current certificate by default
+	profile := opts.Profile
+	if current, err := ca.LoadCertificate(c.Param("cert_cn")); profile == "" && err == nil {
+		if record, err := ca.FindBySerial(current.GoCert().SerialNumber); err == nil {
+			profile = record.Profile
+		}
+	}
+	if !allowedProfile(c, ca, profile) {
+		return
+	}
+
+	certificate, err := ca.RenewCertificate(c.Param("cert_cn"), opts)
+	if err != nil {
+		switch {
+		case errors.Is(err, goca.ErrCertLoadNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, goca.ErrRenewRekeyCSR), errors.Is(err, goca.ErrRenewCommonName), errors.Is(err, goca.ErrRenewCSRNotFound),
+			errors.Is(err, cert.ErrCSRSignature), errors.Is(err, cert.ErrProfileNotFound):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	body := getCertificateData(certificate)
+
+	c.JSON(http.StatusOK, gin.H{"data": body})
+}
+
+// ExportCertificateKey is the handler of the Certificates private key export endpoint
+// @Summary Export the private key of a certificate managed by CA
+// @Description export the private key of the certificate as PEM, encrypted PKCS #8 (pkcs8) or PKCS #12 (pkcs12) with the certificate and the CA chain, both protected by the password
+// @Tags CA/{CN}/Certificates
+// @Accept json
+// @Produce application/x-pem-file,application/x-pkcs12
+// @Param export body models.KeyExportBody true "Export format and password"
+// @Success 200 {string} string "Exported private key"
+// @Failure 400 {object} models.ResponseError
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /api/v1/ca/{cn}/certificates/{certificate_cn}/key [post]
+func ExportCertificateKey(c *gin.Context) {
+
+	var export models.KeyExportBody
+
+	if err := c.ShouldBindJSON(&export); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+
+	commonName := c.Param("cert_cn")
+	exported, err := ca.ExportCertificateKey(commonName, export.Format, []byte(export.Password))
+	if err != nil {
+		exportError(c, err)
+		return
+	}
+
+	writeExportedKey(c, commonName, export.Format, exported)
+}
+
+// ExportCAKey is the handler of the Certificate Authority private key export endpoint
+// @Summary Export the private key of the Certificate Authority (CA)
+// @Description export the private key of the Certificate Authority (cn), only allowed when the CA policy allow_ca_key_export is set with the goca package
+// @Tags CA
+// @Accept json
+// @Produce application/x-pem-file,application/x-pkcs12
+// @Param export body models.KeyExportBody true "Export format and password"
+// @Success 200 {string} string "Exported private key"
+// @Failure 400 {object} models.ResponseError
+// @Failure 404 {object} models.ResponseError
+// @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /api/v1/ca/{cn}/key [post]
+func ExportCAKey(c *gin.Context) {
+
+	var export models.KeyExportBody
+
+	if err := c.ShouldBindJSON(&export); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
+	if err != nil {
+		if err == goca.ErrCALoadNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+
+		return
+	}
+
+	exported, err := ca.ExportPrivateKey(export.Format, []byte(export.Password))
+	if err != nil {
+		exportError(c, err)
+		return
+	}
+
+	writeExportedKey(c, ca.CommonName, export.Format, exported)
+}
+
+func exportError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, goca.ErrCertLoadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, goca.ErrKeyExportNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, goca.ErrKeyNotAvailable), errors.Is(err, goca.ErrKeyExportFormat), errors.Is(err, goca.ErrKeyExportPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// writeExportedKey writes the exported key as attachment
+func writeExportedKey(c *gin.Context, commonName string, format goca.KeyFormat, exported []byte) {
+	contentType, extension := "application/x-pem-file", ".key"
+	if format == goca.KeyFormatPKCS12 {
+		contentType, extension = "application/x-pkcs12", ".p12"
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", commonName+extension))
+	c.Data(http.StatusOK, contentType, exported)
+}
+
 // RevokeCertificate is the handler of Certificates by Authorities Certificates endpoint
 // @Summary CA revoke a existent certificate managed by CA
-// @Description the Certificate Authority revokes a managed Certificate
+// @Description the Certificate Authority revokes a managed Certificate with an optional RFC 5280 reason and invalidity date. The reason remove_from_crl releases a certificate on hold (certificate_hold).
 // @Tags CA/{CN}/Certificates
 // @Produce json
 // @Accept json
+// @Param reason query string false "Revocation reason: unspecified, key_compromise, ca_compromise, affiliation_changed, superseded, cessation_of_operation, certificate_hold, remove_from_crl, privilege_withdrawn or aa_compromise"
+// @Param invalidity_date query string false "Invalidity date (RFC 3339)"
+// @Param revocation body models.RevokeBody false "Revocation reason and invalidity date, the query parameters take precedence"
 // @Success 200 {object} models.CABody
+// @Failure 400 {object} models.ResponseError
 // @Failure 404 {object} models.ResponseError
 // @Failure 500 Internal Server Error
+// @Failure 401 {object} models.ResponseError
+// @Failure 403 {object} models.ResponseError
+// @Security BasicAuth
+// @Security BearerAuth
 // @Router /api/v1/ca/{cn}/certificates/{certificate_cn} [delete]
 func RevokeCertificate(c *gin.Context) {
 
-	ca, err := goca.Load(c.Param("cn"))
+	var revocation models.RevokeBody
+
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&revocation); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if c.Query("reason") != "" {
+		revocation.Reason = c.Query("reason")
+	}
+
+	if c.Query("invalidity_date") != "" {
+		invalidityDate, err := time.Parse(time.RFC3339, c.Query("invalidity_date"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		revocation.InvalidityDate = invalidityDate
+	}
+
+	reason := cert.Unspecified
+	if revocation.Reason != "" {
+		var err error
+		if reason, err = cert.ParseRevocationReason(revocation.Reason); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ca, err := goca.Load(c.Param("cn"), requestOptions(c)...)
 	if err != nil {
 		if err == goca.ErrCALoadNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -454,11 +1289,18 @@ func RevokeCertificate(c *gin.Context) {
 		return
 	}
 
-	err = ca.RevokeCertificate(c.Param("cert_cn"))
+	if reason == cert.RemoveFromCRL {
+		err = ca.ReleaseCertificateHold(c.Param("cert_cn"))
+	} else {
+		err = ca.RevokeCertificateWithReason(c.Param("cert_cn"), reason, revocation.InvalidityDate)
+	}
 	if err != nil {
-		if err == goca.ErrCertRevoked {
+		switch err {
+		case goca.ErrCertRevoked, goca.ErrCertNotOnHold, cert.ErrRevocationReason:
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		} else {
+		case goca.ErrCertLoadNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		}
 		return
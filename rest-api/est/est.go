@@ -0,0 +1,351 @@
+// Package est provides EST (Enrollment over Secure Transport, RFC 7030)
+// enrollment endpoints for the GoCA Certificate Authorities, for the network
+// devices that only support EST.
+//
+// Each Certificate Authority is an EST label:
+//
+//	/.well-known/est/<CA Common Name>/cacerts
+//	/.well-known/est/<CA Common Name>/simpleenroll
+//	/.well-known/est/<CA Common Name>/simplereenroll
+//	/.well-known/est/<CA Common Name>/csrattrs
+//
+// The responses are base64 encoded PKCS #7 certs-only bundles. The
+// enrollments are authorized by Server.Authorize, without it they are
+// rejected. The re-enrollments are authenticated by the client certificate
+// (TLS client authentication), which must be the current certificate of its
+// common name issued by the Certificate Authority.
+package est
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+)
+
+// Defaults of the Server
+const (
+	defaultPrefix  = "/.well-known/est"
+	maxRequestSize = 64 << 10
+)
+
+// Server provides the EST endpoints of the Certificate Authorities returned by
+// LoadCA.
+//
+// The CA certificates and the client certificates are read with the CAOptions
+// without loading the Certificate Authority private key, LoadCA is only called
+// to issue the certificates. The certificates are issued with
+// CA.SignCSRWithProfile. A re-enrollment
+// renews the certificate with CA.RenewCertificate, revoking the previous
+// certificate of the common name as superseded.
+type Server struct {
+	LoadCA        func(commonName string) (goca.CA, error)                                       // Loads the Certificate Authority of the label to issue the certificates
+	CAOptions     []goca.Option                                                                  // Options reading the Certificate Authorities without their private key
+	Prefix        string                                                                         // Path where the Server is mounted (default: /.well-known/est)
+	Profile       string                                                                         // Certificate profile of the issued certificates (default: cert.DefaultProfile)
+	Authorize     func(r *http.Request, caCommonName string, csr *x509.CertificateRequest) error // Authorizes the enrollments (not the re-enrollments), an error is returned as 401 (default: all rejected)
+	CSRAttributes []asn1.ObjectIdentifier                                                        // Attributes returned by csrattrs (default: none)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.EscapedPath(), s.prefix()+"/")
+	parts := strings.Split(path, "/")
+	if !ok || len(parts) != 2 {
+		http.Error(w, "unknown EST operation", http.StatusNotFound)
+		return
+	}
+
+	commonName, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, "unknown EST operation", http.StatusNotFound)
+		return
+	}
+
+	caCertificate, err := goca.LoadCACertificate(commonName, s.CAOptions...)
+	if err != nil {
+		http.Error(w, "unknown Certificate Authority", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case parts[1] == "cacerts" && r.Method == http.MethodGet:
+		err = s.caCerts(w, commonName)
+	case parts[1] == "csrattrs" && r.Method == http.MethodGet:
+		err = s.csrAttrs(w)
+	case parts[1] == "simpleenroll" && r.Method == http.MethodPost:
+		err = s.enroll(w, r, commonName, caCertificate, false)
+	case parts[1] == "simplereenroll" && r.Method == http.MethodPost:
+		err = s.enroll(w, r, commonName, caCertificate, true)
+	default:
+		http.Error(w, "unknown EST operation", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		var estErr *estError
+		if errors.As(err, &estErr) {
+			http.Error(w, estErr.message, estErr.status)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// estError is an error returned to the EST client with the HTTP status
+type estError struct {
+	status  int
+	message string
+}
+
+func (e *estError) Error() string {
+	return e.message
+}
+
+func (s *Server) prefix() string {
+	if s.Prefix == "" {
+		return defaultPrefix
+	}
+
+	return strings.TrimSuffix(s.Prefix, "/")
+}
+
+func (s *Server) profile() string {
+	if s.Profile == "" {
+		return cert.DefaultProfile
+	}
+
+	return s.Profile
+}
+
+// writeBase64 writes the base64 encoded body (RFC 7030, section 4)
+func writeBase64(w http.ResponseWriter, contentType string, body []byte) {
+	encoded := base64.StdEncoding.EncodeToString(body)
+
+	var wrapped strings.Builder
+	for len(encoded) > 64 {
+		wrapped.WriteString(encoded[:64] + "\n")
+		encoded = encoded[64:]
+	}
+	wrapped.WriteString(encoded + "\n")
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, wrapped.String())
+}
+
+// caCerts returns the Certificate Authority chain (RFC 7030, section 4.1)
+func (s *Server) caCerts(w http.ResponseWriter, caCommonName string) error {
+	chain, err := goca.LoadChain(caCommonName, s.CAOptions...)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := cert.PKCS7Certificates(chain)
+	if err != nil {
+		return err
+	}
+
+	writeBase64(w, "application/pkcs7-mime", bundle)
+
+	return nil
+}
+
+// csrAttrs returns the CSR attributes (RFC 7030, section 4.5)
+func (s *Server) csrAttrs(w http.ResponseWriter) error {
+	if len(s.CSRAttributes) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	attributes, err := asn1.Marshal(s.CSRAttributes)
+	if err != nil {
+		return err
+	}
+
+	writeBase64(w, "application/csrattrs", attributes)
+
+	return nil
+}
+
+// readCSR reads the base64 encoded PKCS #10 request body, PEM is also
+// accepted
+func readCSR(r *http.Request) (*x509.CertificateRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(body) > maxRequestSize {
+		return nil, &estError{http.StatusRequestEntityTooLarge, "the request is too large"}
+	}
+
+	var der []byte
+	if block, _ := pem.Decode(body); block != nil {
+		der = block.Bytes
+	} else {
+		der, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+		if err != nil {
+			return nil, &estError{http.StatusBadRequest, "the request must be a base64 encoded PKCS #10"}
+		}
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, &estError{http.StatusBadRequest, "invalid PKCS #10: " + err.Error()}
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, &estError{http.StatusBadRequest, cert.ErrCSRSignature.Error()}
+	}
+
+	// the certificates are kept by common name
+	if csr.Subject.CommonName == "" {
+		return nil, &estError{http.StatusBadRequest, "the PKCS #10 subject common name is required"}
+	}
+
+	return csr, nil
+}
+
+// enroll issues a certificate for the CSR (RFC 7030, sections 4.2.1 and
+// 4.2.2), re-enrollments replace the client certificate
+func (s *Server) enroll(w http.ResponseWriter, r *http.Request, caCommonName string, caCertificate *x509.Certificate, reenroll bool) error {
+	csr, err := readCSR(r)
+	if err != nil {
+		return err
+	}
+
+	var current *x509.Certificate
+	if reenroll {
+		if current, err = s.clientCertificate(r, caCommonName, caCertificate); err != nil {
+			return err
+		}
+
+		if csr.Subject.String() != current.Subject.String() || !sameSubjectAltNames(csr, current) {
+			return &estError{http.StatusBadRequest, "the re-enrollment subject and subject alternative names must match the current certificate"}
+		}
+	}
+
+	if !reenroll {
+		if err := s.authorize(r, caCommonName, csr); err != nil {
+			return err
+		}
+	}
+
+	ca, err := s.LoadCA(caCommonName)
+	if err != nil {
+		return err
+	}
+
+	// the enrollments do not issue Certificate Authorities
+	profile, err := ca.Profile(s.profile())
+	if err != nil {
+		return &estError{http.StatusBadRequest, err.Error()}
+	} else if profile.IsCA {
+		return &estError{http.StatusForbidden, fmt.Sprintf("the profile %s issues CA certificates, it cannot be used by EST", profile.Name)}
+	}
+
+	var certificate goca.Certificate
+	if current != nil {
+		certificate, err = ca.RenewCertificate(current.Subject.CommonName, goca.RenewOptions{CSR: csr, Profile: s.profile(), Revoke: true})
+	} else {
+		certificate, err = ca.SignCSRWithProfile(*csr, 0, s.profile())
+	}
+	if errors.Is(err, cert.ErrCertExists) {
+		return &estError{http.StatusConflict, fmt.Sprintf("a certificate for %s already exists, use simplereenroll", csr.Subject.CommonName)}
+	} else if err != nil {
+		return &estError{http.StatusBadRequest, err.Error()}
+	}
+
+	issued := certificate.GoCert()
+	bundle, err := cert.PKCS7Certificates([]*x509.Certificate{&issued})
+	if err != nil {
+		return err
+	}
+
+	writeBase64(w, "application/pkcs7-mime; smime-type=certs-only", bundle)
+
+	return nil
+}
+
+func (s *Server) authorize(r *http.Request, caCommonName string, csr *x509.CertificateRequest) error {
+	if s.Authorize == nil {
+		return &estError{http.StatusUnauthorized, "the EST enrollment is not authorized by the server"}
+	}
+
+	if err := s.Authorize(r, caCommonName, csr); err != nil {
+		return &estError{http.StatusUnauthorized, err.Error()}
+	}
+
+	return nil
+}
+
+// clientCertificate returns the TLS client certificate when it is the current,
+// not revoked, certificate of its common name issued by the Certificate
+// Authority
+func (s *Server) clientCertificate(r *http.Request, caCommonName string, caCertificate *x509.Certificate) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, &estError{http.StatusUnauthorized, "the re-enrollment requires the TLS client certificate"}
+	}
+
+	peer := r.TLS.PeerCertificates[0]
+	now := time.Now()
+	if peer.CheckSignatureFrom(caCertificate) != nil || now.Before(peer.NotBefore) || now.After(peer.NotAfter) {
+		return nil, &estError{http.StatusUnauthorized, "the client certificate is not valid for the Certificate Authority"}
+	}
+
+	record, err := goca.LoadCertificateRecord(caCommonName, peer.SerialNumber, s.CAOptions...)
+	if err != nil {
+		return nil, &estError{http.StatusUnauthorized, "the client certificate is not issued by the Certificate Authority"}
+	} else if record.Status == goca.CertificateRevoked {
+		return nil, &estError{http.StatusUnauthorized, "the client certificate is revoked"}
+	}
+
+	commonName := peer.Subject.CommonName
+	if record.Path != filepath.Join(caCommonName, "certs", commonName, commonName+".crt") {
+		return nil, &estError{http.StatusUnauthorized, "the client certificate is not the current certificate of " + commonName}
+	}
+
+	return peer, nil
+}
+
+// sameSubjectAltNames returns if the CSR requests the certificate Subject
+// Alternative Names
+func sameSubjectAltNames(csr *x509.CertificateRequest, certificate *x509.Certificate) bool {
+	sameSet := func(a, b []string) bool {
+		a, b = slices.Clone(a), slices.Clone(b)
+		slices.Sort(a)
+		slices.Sort(b)
+		return slices.Equal(slices.Compact(a), slices.Compact(b))
+	}
+
+	var csrIPs, certIPs, csrURIs, certURIs []string
+	for _, ip := range csr.IPAddresses {
+		csrIPs = append(csrIPs, ip.String())
+	}
+	for _, ip := range certificate.IPAddresses {
+		certIPs = append(certIPs, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		csrURIs = append(csrURIs, uri.String())
+	}
+	for _, uri := range certificate.URIs {
+		certURIs = append(certURIs, uri.String())
+	}
+
+	return sameSet(csr.DNSNames, certificate.DNSNames) &&
+		sameSet(csr.EmailAddresses, certificate.EmailAddresses) &&
+		sameSet(csrIPs, certIPs) &&
+		sameSet(csrURIs, certURIs)
+}
@@ -0,0 +1,259 @@
+package est_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/rest-api/est"
+)
+
+func newCSR(t *testing.T, commonName string) (crypto.Signer, string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName, Organization: []string{"Lab"}},
+		DNSNames: []string{commonName},
+	}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey, base64.StdEncoding.EncodeToString(csr)
+}
+
+func estRequest(t *testing.T, client *http.Client, method, url, body string) (int, []byte) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/pkcs10")
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode == http.StatusOK {
+		if data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return response.StatusCode, data
+}
+
+// withClientCertificate returns a copy of the client using the certificate for
+// TLS client authentication
+func withClientCertificate(client *http.Client, certificate x509.Certificate, privateKey crypto.Signer) *http.Client {
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{certificate.Raw},
+		PrivateKey:  privateKey,
+	}}
+
+	return &http.Client{Transport: transport}
+}
+
+func TestFunctionalEST(t *testing.T) {
+	store := goca.NewMemoryStorage()
+	caIdentity := goca.Identity{
+		Organization:       "GO CA EST Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}
+	rootCA, err := goca.New("go-est.ca", caIdentity, goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA key is only loaded to issue the certificates
+	var keyLoads atomic.Int32
+	server := httptest.NewUnstartedServer(&est.Server{
+		LoadCA: func(commonName string) (goca.CA, error) {
+			keyLoads.Add(1)
+			return goca.Load(commonName, goca.WithStorage(store))
+		},
+		CAOptions: []goca.Option{goca.WithStorage(store)},
+		Authorize: func(r *http.Request, caCommonName string, csr *x509.CertificateRequest) error {
+			if caCommonName != "go-est.ca" {
+				return errors.New("unexpected CA " + caCommonName)
+			}
+			if csr.Subject.CommonName == "forbidden.lab" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	})
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	estURL := server.URL + "/.well-known/est/go-est.ca/"
+
+	status, cacerts := estRequest(t, client, http.MethodGet, estURL+"cacerts", "")
+	if status != http.StatusOK || !bytes.Contains(cacerts, rootCA.GoCertificate().Raw) {
+		t.Errorf("cacerts should return the CA certificate, got %d", status)
+	}
+
+	if status, _ := estRequest(t, client, http.MethodGet, server.URL+"/.well-known/est/unknown.ca/cacerts", ""); status != http.StatusNotFound {
+		t.Errorf("cacerts of an unknown CA should return 404, got %d", status)
+	}
+
+	if status, _ := estRequest(t, client, http.MethodGet, estURL+"csrattrs", ""); status != http.StatusNoContent {
+		t.Errorf("csrattrs without attributes should return 204, got %d", status)
+	}
+	if loads := keyLoads.Load(); loads != 0 {
+		t.Errorf("cacerts and csrattrs should not load the CA key, got %d loads", loads)
+	}
+
+	routerKey, routerCSR := newCSR(t, "router.lab")
+	status, enrolled := estRequest(t, client, http.MethodPost, estURL+"simpleenroll", routerCSR)
+	if status != http.StatusOK {
+		t.Fatalf("simpleenroll failed with %d: %s", status, enrolled)
+	}
+
+	ca, err := goca.Load("go-est.ca", goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerCert, err := ca.LoadCertificate("router.lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := routerCert.GoCert()
+	if !bytes.Contains(enrolled, first.Raw) {
+		t.Error("simpleenroll should return the issued certificate")
+	}
+
+	if status, _ := estRequest(t, client, http.MethodPost, estURL+"simpleenroll", routerCSR); status != http.StatusConflict {
+		t.Errorf("simpleenroll of an existent certificate should return 409, got %d", status)
+	}
+
+	_, forbiddenCSR := newCSR(t, "forbidden.lab")
+	if status, _ := estRequest(t, client, http.MethodPost, estURL+"simpleenroll", forbiddenCSR); status != http.StatusUnauthorized {
+		t.Errorf("simpleenroll not authorized should return 401, got %d", status)
+	}
+	if loads := keyLoads.Load(); loads != 2 {
+		t.Errorf("the unauthorized enrollment should not load the CA key, got %d loads", loads)
+	}
+
+	// re-enrollment requires the current certificate
+	newKey, renewalCSR := newCSR(t, "router.lab")
+	if status, _ := estRequest(t, client, http.MethodPost, estURL+"simplereenroll", renewalCSR); status != http.StatusUnauthorized {
+		t.Errorf("simplereenroll without client certificate should return 401, got %d", status)
+	}
+
+	mtlsClient := withClientCertificate(client, first, routerKey)
+	status, reenrolled := estRequest(t, mtlsClient, http.MethodPost, estURL+"simplereenroll", renewalCSR)
+	if status != http.StatusOK {
+		t.Fatalf("simplereenroll failed with %d: %s", status, reenrolled)
+	}
+
+	ca, err = goca.Load("go-est.ca", goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerCert, err = ca.LoadCertificate("router.lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := routerCert.GoCert()
+	if second.SerialNumber.Cmp(first.SerialNumber) == 0 || !bytes.Contains(reenrolled, second.Raw) {
+		t.Error("simplereenroll should issue a new certificate")
+	}
+	if !second.PublicKey.(*ecdsa.PublicKey).Equal(newKey.Public()) {
+		t.Error("simplereenroll should certify the new key")
+	}
+
+	revoked := ca.GoCRL().RevokedCertificateEntries
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(first.SerialNumber) != 0 || revoked[0].ReasonCode != int(cert.Superseded) {
+		t.Errorf("The previous certificate should be revoked as superseded, got %v", revoked)
+	}
+
+	archived, err := ca.ArchivedCertificates("router.lab")
+	if err != nil || len(archived) != 1 || !archived[0].Equal(&first) {
+		t.Errorf("The previous certificate should be archived, got %d certificates: %v", len(archived), err)
+	}
+
+	// the superseded certificate cannot re-enroll
+	if status, _ := estRequest(t, mtlsClient, http.MethodPost, estURL+"simplereenroll", renewalCSR); status != http.StatusUnauthorized {
+		t.Errorf("simplereenroll with a revoked certificate should return 401, got %d", status)
+	}
+
+	// the subject must not change
+	_, otherCSR := newCSR(t, "switch.lab")
+	mtlsClient = withClientCertificate(client, second, newKey)
+	if status, _ := estRequest(t, mtlsClient, http.MethodPost, estURL+"simplereenroll", otherCSR); status != http.StatusBadRequest {
+		t.Errorf("simplereenroll with another subject should return 400, got %d", status)
+	}
+}
+
+func TestFunctionalESTAuthorization(t *testing.T) {
+	store := goca.NewMemoryStorage()
+	if _, err := goca.New("go-est-auth.ca", goca.Identity{
+		Organization:       "GO CA EST Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}, goca.WithStorage(store)); err != nil {
+		t.Fatal(err)
+	}
+
+	loadCA := func(commonName string) (goca.CA, error) {
+		return goca.Load(commonName, goca.WithStorage(store))
+	}
+	_, csr := newCSR(t, "router.lab")
+
+	// the enrollments are rejected without Authorize
+	caOptions := []goca.Option{goca.WithStorage(store)}
+	server := httptest.NewTLSServer(&est.Server{LoadCA: loadCA, CAOptions: caOptions})
+	defer server.Close()
+	estURL := server.URL + "/.well-known/est/go-est-auth.ca/"
+	if status, _ := estRequest(t, server.Client(), http.MethodPost, estURL+"simpleenroll", csr); status != http.StatusUnauthorized {
+		t.Errorf("simpleenroll without Authorize should return 401, got %d", status)
+	}
+
+	// the CA profiles cannot be used
+	caProfileServer := httptest.NewTLSServer(&est.Server{
+		LoadCA:    loadCA,
+		CAOptions: caOptions,
+		Profile:   cert.SubCAProfile,
+		Authorize: func(*http.Request, string, *x509.CertificateRequest) error {
+			return nil
+		},
+	})
+	defer caProfileServer.Close()
+	estURL = caProfileServer.URL + "/.well-known/est/go-est-auth.ca/"
+	if status, _ := estRequest(t, caProfileServer.Client(), http.MethodPost, estURL+"simpleenroll", csr); status != http.StatusForbidden {
+		t.Errorf("simpleenroll with a CA profile should return 403, got %d", status)
+	}
+}
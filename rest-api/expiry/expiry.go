@@ -0,0 +1,106 @@
+// Package expiry provides the sinks of the certificates expiration events of
+// the GoCA REST API, notified by the goca.ExpiryMonitor.
+package expiry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+)
+
+// Event types
+const (
+	EventExpiring = "certificate.expiring"
+	EventExpired  = "certificate.expired"
+)
+
+// Event is the expiration event sent by the sinks
+type Event struct {
+	Type string `json:"type" example:"certificate.expiring"`
+	goca.Expiration
+}
+
+// NewEvent returns the event of the expiration
+func NewEvent(expiration goca.Expiration) Event {
+	event := Event{Type: EventExpiring, Expiration: expiration}
+	if expiration.Expired {
+		event.Type = EventExpired
+	}
+
+	return event
+}
+
+// defaultWebhookTimeout is the timeout of the webhook requests without a
+// WebhookSink Client
+const defaultWebhookTimeout = 10 * time.Second
+
+// WebhookSink posts the expiration events as JSON to the URL, failing on non
+// 2xx responses.
+type WebhookSink struct {
+	URL    string       // Webhook URL
+	Client *http.Client // HTTP client of the requests (default: 10 seconds timeout)
+}
+
+// Notify posts the event of the expiration.
+func (s *WebhookSink) Notify(ctx context.Context, expiration goca.Expiration) error {
+	body, err := json.Marshal(NewEvent(expiration))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", s.URL, resp.Status)
+	}
+
+	return nil
+}
+
+// LogSink logs the expiration events.
+type LogSink struct {
+	Logger *log.Logger // Logger of the events (default: the standard logger)
+}
+
+// Notify logs the event of the expiration.
+func (s *LogSink) Notify(_ context.Context, expiration goca.Expiration) error {
+	logger := s.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	kind := "certificate"
+	if expiration.IsCA {
+		kind = "CA certificate"
+	}
+	verb := "expires"
+	if expiration.Expired {
+		verb = "expired"
+	}
+
+	logger.Printf("%s: %s %s (serial %s) of %s %s at %s", NewEvent(expiration).Type, kind, expiration.CommonName,
+		expiration.SerialNumber, expiration.CA, verb, expiration.NotAfter.Format(time.RFC3339))
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package expiry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/key"
+	"github.com/kairoaraujo/goca/v2/rest-api/expiry"
+)
+
+func TestFunctionalExpiryWebhook(t *testing.T) {
+	store := goca.NewMemoryStorage()
+
+	ca, err := goca.New("go-expiry.ca", goca.Identity{
+		Organization:       "Expiry Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+		Valid:              20,
+	}, goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.IssueCertificate("week.go-expiry.ca", goca.Identity{KeyAlgorithm: key.ECDSAP256, Valid: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		events   []expiry.Event
+		failures = 1
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected webhook request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event expiry.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	var logs bytes.Buffer
+	monitor := &goca.ExpiryMonitor{
+		Within:  30 * 24 * time.Hour,
+		Options: []goca.Option{goca.WithStorage(store)},
+		Sinks: []goca.ExpirySink{
+			&expiry.WebhookSink{URL: receiver.URL},
+			&expiry.LogSink{Logger: log.New(&logs, "", 0)},
+		},
+	}
+
+	// the failed webhook notification is sent again in the next check
+	if err := monitor.CheckOnce(context.Background()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected the webhook error but got: %v", err)
+	}
+	if err := monitor.CheckOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 webhook events but got: %+v", events)
+	}
+	// the certificate event failed, the CA certificate event did not
+	if events[0].Type != expiry.EventExpiring || events[0].CommonName != "go-expiry.ca" || !events[0].IsCA {
+		t.Errorf("Unexpected CA certificate event %+v", events[0])
+	}
+	if events[1].CommonName != "week.go-expiry.ca" || events[1].CA != "go-expiry.ca" || events[1].IsCA {
+		t.Errorf("Unexpected certificate event %+v", events[1])
+	}
+
+	if lines := strings.Split(strings.TrimSpace(logs.String()), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[1], "certificate.expiring: CA certificate go-expiry.ca") {
+		t.Errorf("Unexpected logged events:\n%s", logs.String())
+	}
+
+	if event := expiry.NewEvent(goca.Expiration{Expired: true}); event.Type != expiry.EventExpired {
+		t.Errorf("Expected %s but got: %s", expiry.EventExpired, event.Type)
+	}
+}
@@ -1,21 +1,48 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 
+	"github.com/kairoaraujo/goca/v2"
 	_ "github.com/kairoaraujo/goca/v2/docs"
+	"github.com/kairoaraujo/goca/v2/rest-api/acme"
+	"github.com/kairoaraujo/goca/v2/rest-api/auth"
+	"github.com/kairoaraujo/goca/v2/rest-api/config"
 	"github.com/kairoaraujo/goca/v2/rest-api/controllers"
+	"github.com/kairoaraujo/goca/v2/rest-api/est"
+	"github.com/kairoaraujo/goca/v2/rest-api/expiry"
+	"github.com/kairoaraujo/goca/v2/rest-api/metrics"
+	"github.com/kairoaraujo/goca/v2/rest-api/scep"
+	"github.com/kairoaraujo/goca/v2/rest-api/tlsserver"
 )
 
 // @title GoCA API
 // @description GoCA Certificate Authority Management API.
 // @schemes http https
 // @securityDefinitions.basic BasicAuth
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
 
 // @contact.name GoCA API Issues Report
 // @contact.url http://github.com/kairoaraujo/goca/issues
@@ -24,34 +51,398 @@ import (
 // @license.url https://opensource.org/licenses/MIT
 func main() {
 
-	var port int
+	cfg, err := config.Parse(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logOutput, err := openLogOutput(cfg.Log.Output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(logOutput)
+	gin.DefaultWriter = logOutput
+	gin.DefaultErrorWriter = logOutput
+
+	passphrase, err := loadPassphrase(cfg.PassphraseFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the operations out of the API requests are done by the system actor
+	caOptions := []goca.Option{goca.WithStorage(cfg.Storage.Open()), goca.WithActor("system")}
+	if len(passphrase) > 0 {
+		caOptions = append(caOptions, goca.WithPassphrase(passphrase))
+	}
+
+	// the metrics scrapes and the OCSP responders, loaded once, are not audited
+	apiMetrics := metrics.New(caOptions...)
+	controllers.SetResponderOptions(caOptions...)
+
+	if cfg.Audit.File != "" {
+		auditFile, err := goca.OpenAuditFile(cfg.Audit.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer auditFile.Close()
 
-	flag.IntVar(&port, "p", 80, "Port to listen, default is 80")
-	flag.Parse()
+		caOptions = append(caOptions, goca.WithAuditSink(auditFile, func(err error) {
+			log.Printf("Audit log: %v", err)
+		}))
+	}
+
+	if err := unlockCAs(caOptions...); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := configureCAs(cfg.CAs, caOptions...); err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGTERM and SIGINT stop the server and the background jobs
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	router := gin.Default()
+	// the CA operations are counted by the metrics and the key exports logged
+	caOptions = append(caOptions, goca.WithObserver(apiMetrics.Observe), goca.WithObserver(logKeyExport))
+	controllers.SetCAOptions(caOptions...)
+
+	if cfg.CRL.Interval > 0 {
+		publisher := &goca.CRLPublisher{
+			Interval: time.Duration(cfg.CRL.Interval),
+			Options:  caOptions,
+			OnError: func(err error) {
+				log.Printf("CRL publisher: %v", err)
+			},
+		}
+		go publisher.Run(ctx)
+	}
+
+	if cfg.Expiry.Interval > 0 {
+		monitor := &goca.ExpiryMonitor{
+			Interval: time.Duration(cfg.Expiry.Interval),
+			Within:   time.Duration(cfg.Expiry.Within),
+			Options:  caOptions,
+			Sinks:    []goca.ExpirySink{&expiry.LogSink{}},
+			OnError: func(err error) {
+				log.Printf("Expiry monitor: %v", err)
+			},
+		}
+		for _, url := range cfg.Expiry.Webhooks {
+			monitor.Sinks = append(monitor.Sinks, &expiry.WebhookSink{URL: url})
+		}
+		go monitor.Run(ctx)
+	}
+
+	loadCA := func(commonName string) (goca.CA, error) {
+		return goca.Load(commonName, caOptions...)
+	}
+	// loadCAAs loads the Certificate Authorities of the enrollment protocols
+	// with their actor
+	loadCAAs := func(actor string) func(string) (goca.CA, error) {
+		return func(commonName string) (goca.CA, error) {
+			return goca.Load(commonName, append(caOptions[:len(caOptions):len(caOptions)], goca.WithActor(actor))...)
+		}
+	}
+
+	guard := &auth.Guard{}
+	authConfig, err := cfg.Auth.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if authConfig != nil {
+		guard.Authenticators = authConfig.Authenticators(caOptions...)
+	} else {
+		log.Print("WARNING: no authentication is configured, the API accepts unauthenticated requests")
+	}
+
+	router := gin.New()
 	// Set a lower memory limit for multipart forms (default is 32 MiB)
 	router.MaxMultipartMemory = 8 << 20 // 8 MiB
-	router.Use(gin.Logger())
+	switch cfg.Log.AccessFormat {
+	case config.AccessFormatJSON:
+		router.Use(gin.LoggerWithFormatter(jsonAccessLog))
+	case config.AccessFormatNone:
+	default:
+		router.Use(gin.Logger())
+	}
+	router.Use(gin.Recovery())
+	router.Use(apiMetrics.Middleware())
+	router.GET("/metrics", guard.Authenticate(), guard.Require(auth.ActionRead), gin.WrapH(apiMetrics.Handler()))
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	api := router.Group("/api")
 	v1 := api.Group("/v1")
+	v1.Use(guard.Authenticate())
+
+	read := guard.Require(auth.ActionRead)
+	issue := guard.Require(auth.ActionIssue)
+	exportKey := guard.Require(auth.ActionExportKey)
+	admin := guard.Require(auth.ActionAdmin)
 
 	// Routes
-	v1.GET("/ca", controllers.GetCA)
-	v1.POST("/ca", controllers.AddCA)
-	v1.GET("/ca/:cn", controllers.GetCACommonName)
-	v1.POST("/ca/:cn/sign", controllers.SignCSR)
-	v1.POST("/ca/:cn/upload", controllers.UploadCertificateICA)
-	v1.GET("/ca/:cn/certificates", controllers.GetCertificates)
-	v1.POST("/ca/:cn/certificates", controllers.IssueCertificates)
-	v1.DELETE("/ca/:cn/certificates/:cert_cn", controllers.RevokeCertificate)
-	v1.GET("/ca/:cn/certificates/:cert_cn", controllers.GetCertificatesCommonName)
+	v1.GET("/ca", read, controllers.GetCA)
+	v1.POST("/ca", admin, controllers.AddCA)
+	v1.GET("/ca/:cn", read, controllers.GetCACommonName)
+	v1.POST("/ca/:cn/sign", issue, controllers.SignCSR)
+	v1.POST("/ca/:cn/upload", admin, controllers.UploadCertificateICA)
+	v1.GET("/ca/:cn/profiles", read, controllers.GetProfiles)
+	v1.PUT("/ca/:cn/policy", admin, controllers.SetPolicy)
+	v1.POST("/ca/:cn/key", admin, exportKey, controllers.ExportCAKey)
+	v1.GET("/ca/:cn/certificates", read, controllers.GetCertificates)
+	v1.POST("/ca/:cn/certificates", issue, controllers.IssueCertificates)
+	v1.DELETE("/ca/:cn/certificates/:cert_cn", issue, controllers.RevokeCertificate)
+	v1.GET("/ca/:cn/certificates/:cert_cn", read, controllers.GetCertificatesCommonName)
+	v1.POST("/ca/:cn/certificates/:cert_cn/renew", issue, controllers.RenewCertificate)
+	v1.POST("/ca/:cn/certificates/:cert_cn/key", exportKey, controllers.ExportCertificateKey)
+
+	router.GET("/crl/:file", controllers.GetCRL)
+	router.GET("/:file", controllers.GetCAIssuers)
+	router.GET("/ocsp/:cn/*request", controllers.OCSP)
+	router.POST("/ocsp/:cn", controllers.OCSP)
+
+	// the ACME directories are disabled unless they are enabled
+	if cfg.ACME.Enabled {
+		acmeServer := &acme.Server{
+			LoadCA:    loadCAAs("acme"),
+			CAOptions: caOptions,
+			BaseURL:   cfg.ACME.URL,
+			Profile:   cfg.ACME.Profile,
+			Validator: acme.NetValidator{AllowPrivateIPs: cfg.ACME.AllowPrivateIPs},
+		}
+		router.Any("/acme/*path", gin.WrapH(acmeServer))
+	}
+
+	// the EST enrollment is disabled unless it is enabled with authentication
+	if cfg.EST.Enabled {
+		estServer := &est.Server{
+			LoadCA:    loadCAAs("est"),
+			CAOptions: caOptions,
+			Profile:   cfg.EST.Profile,
+			Authorize: estAuthorize(guard),
+		}
+		router.Any("/.well-known/est/*path", gin.WrapH(estServer))
+	}
+
+	scepServer := &scep.Server{
+		LoadCA:          loadCAAs("scep"),
+		Profile:         cfg.SCEP.Profile,
+		VerifyChallenge: scepChallenge(cfg.SCEP.Challenge),
+	}
+	router.Any("/scep/*path", gin.WrapH(scepServer))
+
+	server := &http.Server{
+		Addr:    cfg.Address(),
+		Handler: router,
+	}
+
+	if cfg.TLS.Enabled() {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if cfg.TLS.CA != "" {
+			manager, err := serverCertificate(loadCA, cfg.TLS.CA, cfg.TLS.Hosts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go manager.Run(ctx)
+			server.TLSConfig.GetCertificate = manager.GetCertificate
+		}
+
+		if cfg.TLS.ClientCA != "" {
+			if err := tlsserver.ClientAuth(server.TLSConfig, cfg.TLS.ClientCA, cfg.TLS.ClientCertRequired, caOptions...); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// done is closed when the in-flight requests are finished, before the
+	// deferred closing of the audit log
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		<-ctx.Done()
+		log.Print("Shutting down the server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Server shutdown: %v", err)
+		}
+	}()
 
 	// Run the server
-	err := router.Run(fmt.Sprintf(":%d", port))
-	if err != nil {
-		panic(err)
+	if cfg.TLS.Enabled() {
+		err = server.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	<-done
+}
+
+// openLogOutput returns the log output: stderr, stdout or the file appended
+func openLogOutput(output string) (io.Writer, error) {
+	switch output {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	}
+
+	return os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+}
+
+// jsonAccessLog formats the HTTP access log entries as JSON lines
+func jsonAccessLog(params gin.LogFormatterParams) string {
+	entry, _ := json.Marshal(map[string]any{
+		"time":       params.TimeStamp.Format(time.RFC3339Nano),
+		"status":     params.StatusCode,
+		"latency_ms": float64(params.Latency.Microseconds()) / 1000,
+		"client_ip":  params.ClientIP,
+		"method":     params.Method,
+		"path":       params.Path,
+		"error":      params.ErrorMessage,
+	})
+
+	return string(entry) + "\n"
+}
+
+// configureCAs stores the policies and the custom profiles of the
+// configuration in the Certificate Authorities
+func configureCAs(cas map[string]config.CA, opts ...goca.Option) error {
+	for commonName, caConfig := range cas {
+		ca, err := goca.Load(commonName, opts...)
+		if err != nil {
+			return fmt.Errorf("configuration of Certificate Authority %s: %w", commonName, err)
+		}
+
+		if caConfig.Policy != nil {
+			if err := ca.SetPolicy(*caConfig.Policy); err != nil {
+				return fmt.Errorf("configuration of Certificate Authority %s policy: %w", commonName, err)
+			}
+		}
+		for _, profile := range caConfig.Profiles {
+			if err := ca.SetProfile(profile); err != nil {
+				return fmt.Errorf("configuration of Certificate Authority %s profile %s: %w", commonName, profile.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// serverCertificate returns the manager of the server certificate issued by
+// the Certificate Authority ca for the hosts, the certificate is issued or
+// renewed before returning.
+func serverCertificate(loadCA func(string) (goca.CA, error), ca string, hosts []string) (*tlsserver.CertificateManager, error) {
+	manager := &tlsserver.CertificateManager{
+		LoadCA: loadCA,
+		CA:     ca,
+		OnError: func(err error) {
+			log.Printf("Server certificate: %v", err)
+		},
+	}
+
+	for _, host := range hosts {
+		if manager.CommonName == "" {
+			manager.CommonName = host
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			manager.IPAddresses = append(manager.IPAddresses, ip)
+		} else {
+			manager.DNSNames = append(manager.DNSNames, host)
+		}
 	}
+
+	if manager.CommonName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		manager.CommonName = hostname
+	}
+
+	if err := manager.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return manager, nil
+}
+
+// loadPassphrase returns the CA private keys passphrase from the file or from
+// the GOCA_PASSPHRASE environment variable.
+func loadPassphrase(passphraseFile string) ([]byte, error) {
+	if passphraseFile != "" {
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(passphrase), "\r\n")), nil
+	}
+
+	return []byte(os.Getenv("GOCA_PASSPHRASE")), nil
+}
+
+// scepChallenge returns the verification of the SCEP challenge password, the
+// SCEP enrollment is disabled without a challenge password.
+func scepChallenge(challengePassword string) func(string, string, *x509.CertificateRequest) error {
+	return func(_, password string, _ *x509.CertificateRequest) error {
+		if challengePassword == "" {
+			return errors.New("the SCEP enrollment is disabled, set scep.challenge")
+		}
+		if subtle.ConstantTimeCompare([]byte(password), []byte(challengePassword)) != 1 {
+			return errors.New("invalid challenge password")
+		}
+
+		return nil
+	}
+}
+
+// estAuthorize authorizes the EST enrollments of the principals authenticated
+// by the guard (API token, HTTP Basic or TLS client certificate, RFC 7030
+// section 3.2.3) with the issuer role of the Certificate Authority.
+func estAuthorize(guard *auth.Guard) func(*http.Request, string, *x509.CertificateRequest) error {
+	return func(r *http.Request, caCommonName string, _ *x509.CertificateRequest) error {
+		principal, err := guard.Principal(r)
+		if err != nil {
+			return err
+		}
+		if principal == nil {
+			return errors.New("the EST enrollment requires authentication")
+		}
+		if !principal.Allowed(auth.ActionIssue, caCommonName) {
+			return errors.New("not allowed to " + string(auth.ActionIssue))
+		}
+
+		return nil
+	}
+}
+
+// logKeyExport logs the private key exports
+func logKeyExport(event goca.Event) {
+	if event.Operation != goca.OperationExportKey {
+		return
+	}
+
+	if event.Err != nil {
+		log.Printf("Key export of %s (serial %s) in %s failed: %v", event.CommonName, event.SerialNumber, event.CA, event.Err)
+	} else {
+		log.Printf("Key export of %s (serial %s) in %s", event.CommonName, event.SerialNumber, event.CA)
+	}
+}
+
+// unlockCAs loads all the Certificate Authorities, failing when a private key
+// cannot be decrypted.
+func unlockCAs(opts ...goca.Option) error {
+	for _, commonName := range goca.List(opts...) {
+		if _, err := goca.Load(commonName, opts...); err != nil {
+			return fmt.Errorf("failed to unlock Certificate Authority %s: %w", commonName, err)
+		}
+	}
+
+	return nil
 }
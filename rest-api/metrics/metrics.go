@@ -0,0 +1,200 @@
+// Package metrics provides the Prometheus metrics of the GoCA REST API: the
+// HTTP requests, the Certificate Authority operations reported by
+// goca.WithObserver and the certificates of the Certificate Authorities.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/kairoaraujo/goca/v2"
+)
+
+// namespace of the metrics
+const namespace = "goca"
+
+// Metrics keeps the metrics of the REST API in its own registry.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	issued          *prometheus.CounterVec
+	revoked         *prometheus.CounterVec
+	signingErrors   *prometheus.CounterVec
+}
+
+// New returns the metrics of the REST API, the certificates metrics are
+// collected on each scrape from the Certificate Authorities listed and loaded
+// with the options.
+func New(opts ...goca.Option) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP requests latency by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		issued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificates_issued_total",
+			Help:      "Certificates issued by Certificate Authority and operation (issue, sign or renew).",
+		}, []string{"ca", "operation"}),
+		revoked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificates_revoked_total",
+			Help:      "Certificates revoked by Certificate Authority.",
+		}, []string{"ca"}),
+		signingErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signing_errors_total",
+			Help:      "Failed Certificate Authority operations by Certificate Authority and operation.",
+		}, []string{"ca", "operation"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.issued,
+		m.revoked,
+		m.signingErrors,
+		&caCollector{options: opts},
+	)
+
+	return m
+}
+
+// Observe counts the Certificate Authority operation, it is the goca.Observer
+// given to goca.WithObserver.
+func (m *Metrics) Observe(event goca.Event) {
+	// the key loads and exports are not signing operations
+	if event.Operation == goca.OperationLoadKey || event.Operation == goca.OperationExportKey {
+		return
+	}
+
+	if event.Err != nil {
+		m.signingErrors.WithLabelValues(event.CA, string(event.Operation)).Inc()
+		return
+	}
+
+	switch event.Operation {
+	case goca.OperationIssue, goca.OperationSign, goca.OperationRenew:
+		m.issued.WithLabelValues(event.CA, string(event.Operation)).Inc()
+	case goca.OperationRevoke:
+		m.revoked.WithLabelValues(event.CA).Inc()
+	}
+}
+
+// Middleware counts and times the HTTP requests by route. The requests
+// without route are counted as "unmatched".
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		m.requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.requestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler returns the HTTP handler of the metrics in the Prometheus exposition
+// format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	caUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "ca", "up"),
+		"Whether the Certificate Authority and its certificates database were loaded.",
+		[]string{"ca"}, nil,
+	)
+	certificatesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "certificates"),
+		"Certificates issued by Certificate Authority and status (valid, expired or revoked), renewed certificates included.",
+		[]string{"ca", "status"}, nil,
+	)
+	caExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "ca", "certificate_expiry_seconds"),
+		"Seconds until the Certificate Authority certificate expires, negative when expired.",
+		[]string{"ca"}, nil,
+	)
+	crlNextUpdateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "crl", "next_update_seconds"),
+		"Seconds until the Certificate Revocation List NextUpdate, negative when outdated.",
+		[]string{"ca"}, nil,
+	)
+)
+
+// caCollector collects the certificates metrics of the Certificate
+// Authorities
+type caCollector struct {
+	options []goca.Option
+}
+
+// Describe implements prometheus.Collector
+func (c *caCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- caUpDesc
+	ch <- certificatesDesc
+	ch <- caExpiryDesc
+	ch <- crlNextUpdateDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *caCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	for _, commonName := range goca.List(c.options...) {
+		ca, err := goca.Load(commonName, c.options...)
+		if err != nil {
+			ch <- prometheus.MustNewConstMetric(caUpDesc, prometheus.GaugeValue, 0, commonName)
+			continue
+		}
+
+		records, err := ca.CertificateRecords()
+		if err != nil {
+			ch <- prometheus.MustNewConstMetric(caUpDesc, prometheus.GaugeValue, 0, commonName)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(caUpDesc, prometheus.GaugeValue, 1, commonName)
+
+		statuses := map[goca.CertificateStatus]int{
+			goca.CertificateValid:   0,
+			goca.CertificateExpired: 0,
+			goca.CertificateRevoked: 0,
+		}
+		for _, record := range records {
+			statuses[record.StatusAt(now)]++
+		}
+		for status, count := range statuses {
+			ch <- prometheus.MustNewConstMetric(certificatesDesc, prometheus.GaugeValue, float64(count), commonName, string(status))
+		}
+
+		// an intermediate CA waiting for the signed certificate has none
+		if certificate := ca.GoCertificate(); certificate != nil {
+			ch <- prometheus.MustNewConstMetric(caExpiryDesc, prometheus.GaugeValue, certificate.NotAfter.Sub(now).Seconds(), commonName)
+		}
+		if crl := ca.GoCRL(); crl != nil {
+			ch <- prometheus.MustNewConstMetric(crlNextUpdateDesc, prometheus.GaugeValue, crl.NextUpdate.Sub(now).Seconds(), commonName)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/key"
+	"github.com/kairoaraujo/goca/v2/rest-api/metrics"
+)
+
+func TestFunctionalMetrics(t *testing.T) {
+	store := goca.NewMemoryStorage()
+	apiMetrics := metrics.New(goca.WithStorage(store))
+	opts := []goca.Option{goca.WithStorage(store), goca.WithObserver(apiMetrics.Observe)}
+
+	ca, err := goca.New("go-metrics.ca", goca.Identity{
+		Organization:       "Metrics Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, commonName := range []string{"web.go-metrics.ca", "mail.go-metrics.ca"} {
+		if _, err := ca.IssueCertificate(commonName, goca.Identity{KeyAlgorithm: key.ECDSAP256}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ca.RevokeCertificate("mail.go-metrics.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.IssueCertificate("web.go-metrics.ca", goca.Identity{KeyAlgorithm: key.ECDSAP256}); err == nil {
+		t.Fatal("Expected the issuance of an existent certificate to fail")
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(apiMetrics.Middleware())
+	router.GET("/metrics", gin.WrapH(apiMetrics.Handler()))
+	router.GET("/api/v1/ca/:cn", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, path := range []string{"/api/v1/ca/go-metrics.ca", "/api/v1/ca/other.ca", "/missing"} {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	response, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`goca_http_requests_total{code="204",method="GET",route="/api/v1/ca/:cn"} 2`,
+		`goca_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`goca_http_request_duration_seconds_count{method="GET",route="/api/v1/ca/:cn"} 2`,
+		`goca_certificates_issued_total{ca="go-metrics.ca",operation="issue"} 2`,
+		`goca_certificates_revoked_total{ca="go-metrics.ca"} 1`,
+		`goca_signing_errors_total{ca="go-metrics.ca",operation="issue"} 1`,
+		`goca_ca_up{ca="go-metrics.ca"} 1`,
+		`goca_certificates{ca="go-metrics.ca",status="valid"} 1`,
+		`goca_certificates{ca="go-metrics.ca",status="revoked"} 1`,
+		`goca_certificates{ca="go-metrics.ca",status="expired"} 0`,
+		`goca_ca_certificate_expiry_seconds{ca="go-metrics.ca"} `,
+		`goca_crl_next_update_seconds{ca="go-metrics.ca"} `,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected the metric %s in:\n%s", expected, body)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"time"
+
 	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
 )
 
 type ResponseError struct {
@@ -16,6 +19,14 @@ type ResponseCertificates struct {
 	Data CertificateBody `json:"data"`
 }
 
+type ResponseProfiles struct {
+	Data map[string]cert.Profile `json:"data"`
+}
+
+type ResponsePolicy struct {
+	Data cert.Policy `json:"data"`
+}
+
 type ResponseList struct {
 	Data []string `json:"data" example:"cn1,cn2,cn3"`
 }
@@ -26,6 +37,19 @@ type Payload struct {
 	Identity         goca.Identity `json:"identity" binding:"required"`
 }
 
+type RevokeBody struct {
+	Reason         string    `json:"reason" example:"key_compromise"`
+	InvalidityDate time.Time `json:"invalidity_date" example:"2021-01-06T10:31:43Z"`
+}
+
+type RenewBody struct {
+	Rekey    bool   `json:"rekey" example:"false"`
+	CSR      string `json:"csr" example:"-----BEGIN CERTIFICATE REQUEST-----...-----END CERTIFICATE REQUEST-----\n"`
+	Validity string `json:"validity" example:"8760h"`
+	Profile  string `json:"profile" example:"tls-server"`
+	Revoke   bool   `json:"revoke" example:"true"`
+}
+
 type CABody struct {
 	CommonName                string      `json:"common_name" example:"root-ca"`
 	Intermediate              bool        `json:"intermediate"`
@@ -37,7 +61,16 @@ type CABody struct {
 	CSR                       bool        `json:"csr" example:"false"`
 	Certificates              []string    `json:"certificates" example:"intranet.example.com,w3.example.com"`
 	CertificateRevocationList []string    `json:"revoked_certificates" example:"38188836191244388427366318074605547405,338255903472757769326153358304310617728"`
-	Files                     goca.CAData `json:"files"`
+	Policy                    cert.Policy `json:"policy"`
+	Files                     CAFiles     `json:"files"`
+}
+
+// CAFiles are the Certificate Authority files, without the private key
+type CAFiles struct {
+	CRL         string `json:"crl" example:"-----BEGIN X509 CRL-----...-----END X509 CRL-----\n"`
+	Certificate string `json:"certificate" example:"-----BEGIN CERTIFICATE-----...-----END CERTIFICATE-----\n"`
+	CSR         string `json:"csr" example:"-----BEGIN CERTIFICATE REQUEST-----...-----END CERTIFICATE REQUEST-----\n"`
+	PublicKey   string `json:"public_key" example:"-----BEGIN PUBLIC KEY-----...-----END PUBLIC KEY-----\n"`
 }
 
 type CertificateBody struct {
@@ -46,5 +79,35 @@ type CertificateBody struct {
 	IssueDate    string           `json:"issue_date" example:"2021-01-06 10:31:43 +0000 UTC"`
 	ExpireDate   string           `json:"expire_date" example:"2022-01-06 10:31:43 +0000 UTC"`
 	DNSNames     []string         `json:"dns_names" example:"w3.intranet.go-root.ca,intranet.go-root.ca"`
-	Files        goca.Certificate `json:"files"`
+	Files        CertificateFiles `json:"files"`
+}
+
+// CertificateFiles are the certificate files, without the private key
+type CertificateFiles struct {
+	Certificate   string `json:"certificate" example:"-----BEGIN CERTIFICATE-----...-----END CERTIFICATE-----\n"`
+	CSR           string `json:"csr" example:"-----BEGIN CERTIFICATE REQUEST-----...-----END CERTIFICATE REQUEST-----\n"`
+	PublicKey     string `json:"public_key" example:"-----BEGIN PUBLIC KEY-----...-----END PUBLIC KEY-----\n"`
+	CACertificate string `json:"ca_certificate" example:"-----BEGIN CERTIFICATE-----...-----END CERTIFICATE-----\n"`
+}
+
+// KeyExportBody requests the export of a private key
+type KeyExportBody struct {
+	Format   goca.KeyFormat `json:"format" example:"pkcs12" binding:"required"` // Export format: pem, pkcs8 (encrypted) or pkcs12
+	Password string         `json:"password" example:"changeit"`                // Password of the pkcs8 and pkcs12 formats
+}
+
+type ResponseCertificateSummaries struct {
+	Data       []CertificateSummary `json:"data"`
+	NextCursor string               `json:"next_cursor,omitempty" example:"MTAw"`
+}
+
+type CertificateSummary struct {
+	CommonName   string                 `json:"common_name" example:"intranet.go-root"`
+	SerialNumber string                 `json:"serial_number" example:"338255903472757769326153358304310617728"`
+	NotBefore    time.Time              `json:"not_before"`
+	NotAfter     time.Time              `json:"not_after"`
+	Status       goca.CertificateStatus `json:"status" example:"valid"`
+	Profile      string                 `json:"profile,omitempty" example:"tls-server"`
+	DNSNames     []string               `json:"dns_names,omitempty"`
+	Archived     bool                   `json:"archived"`
 }
@@ -0,0 +1,316 @@
+// Package scep provides SCEP (Simple Certificate Enrollment Protocol, RFC 8894)
+// enrollment endpoints for the GoCA Certificate Authorities, for the printers
+// and MDM managed devices that only support SCEP.
+//
+// Each Certificate Authority has a SCEP URL, optionally followed by the CGI path
+// some clients append:
+//
+//	/scep/<CA Common Name>?operation=GetCACaps
+//	/scep/<CA Common Name>/pkiclient.exe?operation=GetCACert
+//	/scep/<CA Common Name>?operation=PKIOperation
+//
+// The PKCSReq and RenewalReq messages are encrypted to the Certificate
+// Authority certificate, so the Certificate Authority must have a RSA private
+// key that can decrypt (crypto.Decrypter). The challenge password of the
+// PKCSReq requests is verified by Server.VerifyChallenge, the RenewalReq
+// requests are signed by the current certificate of the common name.
+package scep
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+	"github.com/smallstep/scep"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+)
+
+// Defaults of the Server
+const (
+	defaultPrefix  = "/scep"
+	maxRequestSize = 64 << 10
+)
+
+// SCEP operations (RFC 8894, section 4)
+const (
+	operationGetCACaps    = "GetCACaps"
+	operationGetCACert    = "GetCACert"
+	operationPKIOperation = "PKIOperation"
+)
+
+// capabilities are the Certificate Authority capabilities returned by GetCACaps
+// (RFC 8894, section 3.5.2)
+var capabilities = []string{"POSTPKIOperation", "Renewal", "SHA-1", "SHA-256", "SHA-512", "AES", "DES3", "SCEPStandard"}
+
+// Server provides the SCEP endpoints of the Certificate Authorities returned by
+// LoadCA.
+//
+// The certificates are issued with CA.SignCSRWithProfile and stored with the
+// other certificates of the Certificate Authority, a PKCSReq for an existent
+// common name fails. A RenewalReq renews the certificate with
+// CA.RenewCertificate, the previous certificate stays valid until it expires
+// or is revoked.
+type Server struct {
+	LoadCA          func(commonName string) (goca.CA, error)                                         // Loads the Certificate Authority of the SCEP URL
+	Prefix          string                                                                           // Path where the Server is mounted (default: /scep)
+	Profile         string                                                                           // Certificate profile of the issued certificates (default: cert.DefaultProfile)
+	VerifyChallenge func(caCommonName, challengePassword string, csr *x509.CertificateRequest) error // Verifies the challenge password of the requests, an error fails the request (default: all accepted)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.EscapedPath(), s.prefix()+"/")
+	parts := strings.Split(path, "/")
+	if !ok || len(parts) > 2 || parts[0] == "" {
+		http.Error(w, "unknown SCEP operation", http.StatusNotFound)
+		return
+	}
+
+	commonName, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, "unknown SCEP operation", http.StatusNotFound)
+		return
+	}
+
+	ca, err := s.LoadCA(commonName)
+	if err != nil || ca.GoCertificate() == nil {
+		http.Error(w, "unknown Certificate Authority", http.StatusNotFound)
+		return
+	}
+
+	operation := r.URL.Query().Get("operation")
+	switch {
+	case operation == operationGetCACaps && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, strings.Join(capabilities, "\n")+"\n")
+	case operation == operationGetCACert && r.Method == http.MethodGet:
+		err = s.caCert(w, &ca)
+	case operation == operationPKIOperation && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		err = s.pkiOperation(w, r, &ca)
+	default:
+		http.Error(w, "unknown SCEP operation", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		var scepErr *scepError
+		if errors.As(err, &scepErr) {
+			http.Error(w, scepErr.message, scepErr.status)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// scepError is an error returned to the SCEP client with the HTTP status
+type scepError struct {
+	status  int
+	message string
+}
+
+func (e *scepError) Error() string {
+	return e.message
+}
+
+func (s *Server) prefix() string {
+	if s.Prefix == "" {
+		return defaultPrefix
+	}
+
+	return strings.TrimSuffix(s.Prefix, "/")
+}
+
+func (s *Server) profile() string {
+	if s.Profile == "" {
+		return cert.DefaultProfile
+	}
+
+	return s.Profile
+}
+
+// caCert returns the Certificate Authority certificate, or its chain for the
+// intermediate Certificate Authorities (RFC 8894, section 4.2)
+func (s *Server) caCert(w http.ResponseWriter, ca *goca.CA) error {
+	chain, err := ca.Chain()
+	if err != nil {
+		return err
+	}
+
+	if len(chain) == 1 {
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		_, _ = w.Write(chain[0].Raw)
+		return nil
+	}
+
+	bundle, err := cert.PKCS7Certificates(chain)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+	_, _ = w.Write(bundle)
+
+	return nil
+}
+
+// readMessage reads the PKI message of the POST body or of the GET message
+// parameter (RFC 8894, section 4.1)
+func readMessage(r *http.Request) ([]byte, error) {
+	if r.Method == http.MethodGet {
+		message, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+		if err != nil || len(message) == 0 {
+			return nil, &scepError{http.StatusBadRequest, "the message parameter must be a base64 encoded PKI message"}
+		}
+		return message, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(body) > maxRequestSize {
+		return nil, &scepError{http.StatusRequestEntityTooLarge, "the request is too large"}
+	}
+
+	return body, nil
+}
+
+// pkiOperation issues a certificate for the PKCSReq or RenewalReq message (RFC
+// 8894, section 3.3.1), replying with a CertRep message
+func (s *Server) pkiOperation(w http.ResponseWriter, r *http.Request, ca *goca.CA) error {
+	data, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+
+	message, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		return &scepError{http.StatusBadRequest, "invalid PKI message: " + err.Error()}
+	}
+
+	if message.MessageType != scep.PKCSReq && message.MessageType != scep.RenewalReq {
+		return &scepError{http.StatusBadRequest, fmt.Sprintf("the message type %s is not supported", message.MessageType)}
+	}
+
+	caCertificate := ca.GoCertificate()
+	caKey := ca.GoPrivateKey()
+	if _, ok := caKey.(crypto.Decrypter); !ok {
+		return fmt.Errorf("the private key of %s cannot decrypt the SCEP messages", ca.CommonName)
+	} else if _, ok := caKey.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("the SCEP messages require a RSA key, %s has a %T", ca.CommonName, caKey.Public())
+	}
+
+	if err := message.DecryptPKIEnvelope(caCertificate, caKey); err != nil {
+		return &scepError{http.StatusBadRequest, "invalid PKI message envelope: " + err.Error()}
+	}
+
+	var reply *scep.PKIMessage
+	if issued, failInfo := s.issue(ca, message); failInfo != "" {
+		reply, err = message.Fail(caCertificate, caKey, failInfo)
+	} else {
+		reply, err = message.Success(caCertificate, caKey, issued)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/x-pki-message")
+	_, _ = w.Write(reply.Raw)
+
+	return nil
+}
+
+// issue verifies the request and issues the certificate, returning the failure
+// reason when it is not issued
+func (s *Server) issue(ca *goca.CA, message *scep.PKIMessage) (*x509.Certificate, scep.FailInfo) {
+	request := message.CSRReqMessage
+	csr := request.CSR
+	if err := csr.CheckSignature(); err != nil {
+		return nil, scep.BadMessageCheck
+	}
+
+	// the certificates are kept by common name
+	if csr.Subject.CommonName == "" {
+		return nil, scep.BadRequest
+	}
+
+	var (
+		certificate goca.Certificate
+		err         error
+	)
+	if message.MessageType == scep.RenewalReq {
+		current, err := renewedCertificate(ca, message)
+		if err != nil {
+			return nil, scep.BadMessageCheck
+		}
+
+		if csr.Subject.String() != current.Subject.String() {
+			return nil, scep.BadRequest
+		}
+
+		certificate, err = ca.RenewCertificate(current.Subject.CommonName, goca.RenewOptions{CSR: csr, Profile: s.profile()})
+		if err != nil {
+			return nil, scep.BadRequest
+		}
+	} else {
+		if s.VerifyChallenge != nil {
+			if err := s.VerifyChallenge(ca.CommonName, request.ChallengePassword, csr); err != nil {
+				return nil, scep.BadRequest
+			}
+		}
+
+		// the certificate of an existent common name is only renewed by a
+		// RenewalReq signed by its key
+		if certificate, err = ca.SignCSRWithProfile(*csr, 0, s.profile()); err != nil {
+			return nil, scep.BadRequest
+		}
+	}
+	issued := certificate.GoCert()
+
+	return &issued, ""
+}
+
+// renewedCertificate returns the certificate signing the RenewalReq message
+// when it is the current, not revoked, certificate of its common name issued
+// by the Certificate Authority (RFC 8894, section 3.3.1.2)
+func renewedCertificate(ca *goca.CA, message *scep.PKIMessage) (*x509.Certificate, error) {
+	p7, err := pkcs7.Parse(message.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("the RenewalReq message must have one signer")
+	}
+
+	now := time.Now()
+	if signer.CheckSignatureFrom(ca.GoCertificate()) != nil || now.Before(signer.NotBefore) || now.After(signer.NotAfter) {
+		return nil, errors.New("the RenewalReq signer is not valid for the Certificate Authority")
+	}
+
+	record, err := ca.FindBySerial(signer.SerialNumber)
+	if err != nil {
+		return nil, err
+	} else if record.Status == goca.CertificateRevoked {
+		return nil, errors.New("the RenewalReq signer is revoked")
+	}
+
+	commonName := signer.Subject.CommonName
+	if record.Path != filepath.Join(ca.CommonName, "certs", commonName, commonName+".crt") {
+		return nil, errors.New("the RenewalReq signer is not the current certificate of " + commonName)
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,274 @@
+package scep_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/scep"
+	"github.com/smallstep/scep/x509util"
+
+	"github.com/kairoaraujo/goca/v2"
+	goscep "github.com/kairoaraujo/goca/v2/rest-api/scep"
+)
+
+// newRequest returns a PKCSReq message for the common name, signed by a self
+// signed certificate of a new device key
+func newRequest(t *testing.T, caCertificate *x509.Certificate, commonName, challengePassword string) []byte {
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newMessage(t, caCertificate, scep.PKCSReq, deviceKey, commonName, challengePassword, nil, nil)
+}
+
+// newMessage returns a message of the type requesting a certificate of the
+// device key for the common name, signed by the signer or, without signer, by
+// a self signed certificate of the device key
+func newMessage(t *testing.T, caCertificate *x509.Certificate, messageType scep.MessageType, deviceKey *rsa.PrivateKey, commonName, challengePassword string, signer *x509.Certificate, signerKey *rsa.PrivateKey) []byte {
+	der, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: commonName, Organization: []string{"Lab"}},
+			DNSNames: []string{commonName},
+		},
+		ChallengePassword: challengePassword,
+	}, deviceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signer == nil {
+		signerDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: commonName},
+		}, &deviceKey.PublicKey, deviceKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer, err = x509.ParseCertificate(signerDER); err != nil {
+			t.Fatal(err)
+		}
+		signerKey = deviceKey
+	}
+
+	message, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: messageType,
+		Recipients:  []*x509.Certificate{caCertificate},
+		SignerKey:   signerKey,
+		SignerCert:  signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return message.Raw
+}
+
+func scepRequest(t *testing.T, method, url string, body []byte) (int, []byte) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-pki-message")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.StatusCode, data
+}
+
+func TestFunctionalSCEP(t *testing.T) {
+	store := goca.NewMemoryStorage()
+	caIdentity := goca.Identity{
+		Organization:       "GO CA SCEP Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+	}
+	rootCA, err := goca.New("go-scep.ca", caIdentity, goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(&goscep.Server{
+		LoadCA: func(commonName string) (goca.CA, error) {
+			return goca.Load(commonName, goca.WithStorage(store))
+		},
+		VerifyChallenge: func(caCommonName, challengePassword string, csr *x509.CertificateRequest) error {
+			if caCommonName != "go-scep.ca" || challengePassword != "secret" {
+				return errors.New("invalid challenge password")
+			}
+			return nil
+		},
+	})
+	defer server.Close()
+
+	scepURL := server.URL + "/scep/go-scep.ca/pkiclient.exe"
+
+	status, caps := scepRequest(t, http.MethodGet, scepURL+"?operation=GetCACaps", nil)
+	if status != http.StatusOK || !strings.Contains(string(caps), "POSTPKIOperation") {
+		t.Errorf("GetCACaps should return the capabilities, got %d %q", status, caps)
+	}
+
+	status, caCert := scepRequest(t, http.MethodGet, scepURL+"?operation=GetCACert", nil)
+	if status != http.StatusOK || !bytes.Equal(caCert, rootCA.GoCertificate().Raw) {
+		t.Errorf("GetCACert should return the CA certificate, got %d", status)
+	}
+
+	if status, _ := scepRequest(t, http.MethodGet, server.URL+"/scep/unknown.ca?operation=GetCACert", nil); status != http.StatusNotFound {
+		t.Errorf("GetCACert of an unknown CA should return 404, got %d", status)
+	}
+
+	if status, _ := scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", []byte("invalid")); status != http.StatusBadRequest {
+		t.Errorf("PKIOperation with an invalid message should return 400, got %d", status)
+	}
+
+	printerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, reply := scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", newMessage(t, rootCA.GoCertificate(), scep.PKCSReq, printerKey, "printer.lab", "secret", nil, nil))
+	if status != http.StatusOK {
+		t.Fatalf("PKIOperation failed with %d: %s", status, reply)
+	}
+
+	message, err := scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.SUCCESS {
+		t.Fatalf("PKIOperation should succeed, got status %s", message.PKIStatus)
+	}
+
+	ca, err := goca.Load("go-scep.ca", goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	printerCert, err := ca.LoadCertificate("printer.lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := printerCert.GoCert()
+	if issued.Issuer.CommonName != "go-scep.ca" {
+		t.Errorf("The certificate should be issued by the CA, got %v", issued.Issuer)
+	}
+
+	// a new request for the common name does not replace the certificate
+	status, reply = scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", newRequest(t, rootCA.GoCertificate(), "printer.lab", "secret"))
+	if status != http.StatusOK {
+		t.Fatalf("PKIOperation failed with %d: %s", status, reply)
+	}
+	message, err = scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.FAILURE || message.FailInfo != scep.BadRequest {
+		t.Errorf("PKCSReq of an existent common name should fail, got %s %s", message.PKIStatus, message.FailInfo)
+	}
+
+	// the renewal is signed by the current certificate
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, reply = scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", newMessage(t, rootCA.GoCertificate(), scep.RenewalReq, newKey, "printer.lab", "", nil, nil))
+	if status != http.StatusOK {
+		t.Fatalf("PKIOperation failed with %d: %s", status, reply)
+	}
+	message, err = scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.FAILURE || message.FailInfo != scep.BadMessageCheck {
+		t.Errorf("RenewalReq not signed by the current certificate should fail, got %s %s", message.PKIStatus, message.FailInfo)
+	}
+
+	status, reply = scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", newMessage(t, rootCA.GoCertificate(), scep.RenewalReq, newKey, "printer.lab", "", &issued, printerKey))
+	if status != http.StatusOK {
+		t.Fatalf("PKIOperation failed with %d: %s", status, reply)
+	}
+	message, err = scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.SUCCESS {
+		t.Fatalf("RenewalReq should renew the certificate, got status %s", message.PKIStatus)
+	}
+	archived, err := ca.ArchivedCertificates("printer.lab")
+	if err != nil || len(archived) != 1 || !archived[0].Equal(&issued) {
+		t.Errorf("The previous certificate should be archived, got %d certificates: %v", len(archived), err)
+	}
+
+	// the superseded certificate cannot renew again
+	status, reply = scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", newMessage(t, rootCA.GoCertificate(), scep.RenewalReq, newKey, "printer.lab", "", &issued, printerKey))
+	if status != http.StatusOK {
+		t.Fatalf("PKIOperation failed with %d: %s", status, reply)
+	}
+	message, err = scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.FAILURE {
+		t.Errorf("RenewalReq signed by an archived certificate should fail, got status %s", message.PKIStatus)
+	}
+
+	// the challenge password is verified
+	status, reply = scepRequest(t, http.MethodPost, scepURL+"?operation=PKIOperation", newRequest(t, rootCA.GoCertificate(), "scanner.lab", "wrong"))
+	if status != http.StatusOK {
+		t.Fatalf("PKIOperation failed with %d: %s", status, reply)
+	}
+	message, err = scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.FAILURE || message.FailInfo != scep.BadRequest {
+		t.Errorf("PKIOperation with a wrong challenge password should fail, got %s %s", message.PKIStatus, message.FailInfo)
+	}
+	if ca.Storage().Exists("go-scep.ca/certs/scanner.lab") {
+		t.Error("No certificate should be issued with a wrong challenge password")
+	}
+
+	// the GET PKIOperation has the base64 message parameter
+	status, reply = scepRequest(t, http.MethodGet, scepURL+"?operation=PKIOperation&message="+url.QueryEscape(base64.StdEncoding.EncodeToString(newRequest(t, rootCA.GoCertificate(), "scanner.lab", "secret"))), nil)
+	if status != http.StatusOK {
+		t.Fatalf("GET PKIOperation failed with %d: %s", status, reply)
+	}
+	message, err = scep.ParsePKIMessage(reply, scep.WithCACerts([]*x509.Certificate{rootCA.GoCertificate()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.PKIStatus != scep.SUCCESS {
+		t.Errorf("GET PKIOperation should succeed, got status %s", message.PKIStatus)
+	}
+}
@@ -0,0 +1,220 @@
+// Package tlsserver provides the TLS configuration of the GoCA REST API: a
+// server certificate bootstrapped from one of its own Certificate Authorities,
+// issued on the first start and renewed before it expires, and the
+// verification of the client certificates issued by a Certificate Authority.
+package tlsserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/key"
+)
+
+// defaultInterval is the time between the CertificateManager checks
+const defaultInterval = time.Hour
+
+// ErrClientCertificate means that the client certificate is revoked or not
+// issued by the Certificate Authority verifying the clients
+var ErrClientCertificate = errors.New("the client certificate is not valid")
+
+// CertificateManager keeps the server certificate issued by a GoCA
+// Certificate Authority.
+//
+// The certificate is issued when it does not exist and renewed, with a new
+// key and revoking the previous certificate, when it expires within
+// RenewBefore or it was revoked.
+type CertificateManager struct {
+	LoadCA      func(commonName string) (goca.CA, error) // Loads the Certificate Authority issuing the server certificate
+	CA          string                                   // Common name of the Certificate Authority issuing the server certificate
+	CommonName  string                                   // Common name of the server certificate
+	DNSNames    []string                                 // DNS names of the server certificate (default: CommonName)
+	IPAddresses []net.IP                                 // IP addresses of the server certificate
+	Profile     string                                   // Certificate profile of the server certificate (default: tls-server)
+	RenewBefore time.Duration                            // Renews the certificate expiring within (default: a third of its validity)
+	Interval    time.Duration                            // Time between the checks (default: 1 hour)
+	OnError     func(error)                              // Receives the errors of the checks run by Run
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+}
+
+// Refresh issues or renews the server certificate when needed and loads it
+// for GetCertificate.
+func (m *CertificateManager) Refresh() error {
+	ca, err := m.LoadCA(m.CA)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.CA, err)
+	}
+	if ca.GoCertificate() == nil {
+		return fmt.Errorf("%s: %w", m.CA, goca.ErrCertLoadNotFound)
+	}
+
+	profile := m.Profile
+	if profile == "" {
+		profile = cert.TLSServerProfile
+	}
+
+	certificate, err := ca.LoadCertificate(m.CommonName)
+	switch {
+	case errors.Is(err, goca.ErrCertLoadNotFound):
+		dnsNames := m.DNSNames
+		if len(dnsNames) == 0 && len(m.IPAddresses) == 0 {
+			dnsNames = []string{m.CommonName}
+		}
+		certificate, err = ca.IssueCertificate(m.CommonName, goca.Identity{
+			DNSNames:     dnsNames,
+			IPAddresses:  m.IPAddresses,
+			KeyAlgorithm: key.ECDSAP256,
+			Profile:      profile,
+		})
+	case err != nil:
+	default:
+		var renew bool
+		if renew, err = m.needsRenew(ca, certificate.GoCert()); err == nil && renew {
+			certificate, err = ca.RenewCertificate(m.CommonName, goca.RenewOptions{Rekey: true, Profile: profile, Revoke: true})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.CommonName, err)
+	}
+
+	tlsCertificate, err := tlsCertificate(ca, certificate)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.CommonName, err)
+	}
+
+	m.mu.Lock()
+	m.certificate = tlsCertificate
+	m.mu.Unlock()
+
+	return nil
+}
+
+// GetCertificate returns the server certificate loaded by Refresh, it is the
+// tls.Config GetCertificate.
+func (m *CertificateManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.certificate == nil {
+		return nil, errors.New("the server certificate is not loaded")
+	}
+
+	return m.certificate, nil
+}
+
+// Run refreshes the server certificate immediately and every Interval until
+// ctx is done.
+func (m *CertificateManager) Run(ctx context.Context) error {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Refresh(); err != nil && m.OnError != nil {
+			m.OnError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *CertificateManager) needsRenew(ca goca.CA, certificate x509.Certificate) (bool, error) {
+	record, err := ca.FindBySerial(certificate.SerialNumber)
+	if err != nil {
+		return false, err
+	}
+	if record.Status == goca.CertificateRevoked {
+		return true, nil
+	}
+
+	renewBefore := m.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = certificate.NotAfter.Sub(certificate.NotBefore) / 3
+	}
+
+	return time.Until(certificate.NotAfter) <= renewBefore, nil
+}
+
+// tlsCertificate returns the certificate, its private key and the chain of
+// the Certificate Authority without the root.
+func tlsCertificate(ca goca.CA, certificate goca.Certificate) (*tls.Certificate, error) {
+	privateKey := certificate.GoPrivateKey()
+	if privateKey == nil {
+		return nil, goca.ErrKeyNotAvailable
+	}
+
+	chain, err := ca.Chain()
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := certificate.GoCert()
+	tlsCertificate := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  privateKey,
+		Leaf:        &leaf,
+	}
+	for _, parent := range chain {
+		// the clients trust the root CA
+		if bytes.Equal(parent.RawIssuer, parent.RawSubject) {
+			break
+		}
+		tlsCertificate.Certificate = append(tlsCertificate.Certificate, parent.Raw)
+	}
+
+	return tlsCertificate, nil
+}
+
+// ClientAuth configures the verification of the client certificates issued by
+// the Certificate Authority ca, loaded with the caOptions without its private
+// key: the certificates must be valid and not revoked. The clients without
+// certificate are accepted unless required.
+func ClientAuth(config *tls.Config, ca string, required bool, caOptions ...goca.Option) error {
+	clientCA, err := goca.LoadCACertificate(ca, caOptions...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ca, err)
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	config.ClientCAs.AddCert(clientCA)
+
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if required {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	// the revocations are read on each handshake, as the CA can change
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+
+		record, err := goca.LoadCertificateRecord(ca, state.PeerCertificates[0].SerialNumber, caOptions...)
+		if err != nil || record.Status == goca.CertificateRevoked {
+			return ErrClientCertificate
+		}
+
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package tlsserver_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kairoaraujo/goca/v2"
+	"github.com/kairoaraujo/goca/v2/cert"
+	"github.com/kairoaraujo/goca/v2/key"
+	"github.com/kairoaraujo/goca/v2/rest-api/tlsserver"
+)
+
+func TestFunctionalTLSServer(t *testing.T) {
+	store := goca.NewMemoryStorage()
+	loadCA := func(commonName string) (goca.CA, error) {
+		return goca.Load(commonName, goca.WithStorage(store))
+	}
+
+	rootCA, err := goca.New("go-tls.ca", goca.Identity{
+		Organization:       "TLS Company Inc.",
+		OrganizationalUnit: "Certificates Management",
+		Country:            "NL",
+		Locality:           "Noord-Brabant",
+		Province:           "Veldhoven",
+		KeyAlgorithm:       key.ECDSAP256,
+	}, goca.WithStorage(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := &tlsserver.CertificateManager{
+		LoadCA:     loadCA,
+		CA:         "go-tls.ca",
+		CommonName: "127.0.0.1",
+		DNSNames:   []string{"localhost"},
+	}
+	if _, err := manager.GetCertificate(nil); err == nil {
+		t.Error("Expected an error before the certificate is loaded")
+	}
+	if err := manager.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	issued, err := manager.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Leaf.Subject.CommonName != "127.0.0.1" || issued.Leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("Unexpected server certificate %s %v", issued.Leaf.Subject.CommonName, issued.Leaf.ExtKeyUsage)
+	}
+
+	// the valid certificate is kept
+	if err := manager.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := manager.GetCertificate(nil); current.Leaf.SerialNumber.Cmp(issued.Leaf.SerialNumber) != 0 {
+		t.Error("Expected the same server certificate")
+	}
+
+	clientCertificate, err := rootCA.IssueCertificate("client.go-tls.ca", goca.Identity{KeyAlgorithm: key.ECDSAP256, Profile: cert.TLSClientProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	server.TLS = &tls.Config{GetCertificate: manager.GetCertificate}
+	// the client certificates are verified without loading the CA key
+	if err := tlsserver.ClientAuth(server.TLS, "go-tls.ca", true, goca.WithStorage(store), goca.WithObserver(func(event goca.Event) {
+		t.Errorf("Unexpected %s event", event.Operation)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCA.GoCertificate())
+	get := func(certificates ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certificates,
+		}}}
+		defer client.CloseIdleConnections()
+
+		return client.Get(server.URL)
+	}
+
+	clientKeyPair := tls.Certificate{
+		Certificate: [][]byte{clientCertificate.GoCert().Raw},
+		PrivateKey:  clientCertificate.GoPrivateKey(),
+	}
+	response, err := get(clientKeyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	// the client certificate is required
+	if _, err := get(); err == nil {
+		t.Error("Expected the connection without client certificate to fail")
+	}
+
+	// the revoked client certificate is rejected
+	if err := rootCA.RevokeCertificate("client.go-tls.ca"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(clientKeyPair); err == nil {
+		t.Error("Expected the connection with a revoked client certificate to fail")
+	}
+
+	// the certificate expiring within RenewBefore is renewed and the previous
+	// one revoked
+	manager.RenewBefore = 24 * time.Hour * 1000
+	if err := manager.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	renewed, _ := manager.GetCertificate(nil)
+	if renewed.Leaf.SerialNumber.Cmp(issued.Leaf.SerialNumber) == 0 {
+		t.Fatal("Expected a renewed server certificate")
+	}
+
+	ca, err := loadCA("go-tls.ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := ca.FindBySerial(issued.Leaf.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != goca.CertificateRevoked {
+		t.Errorf("Expected the previous server certificate revoked but got %s", record.Status)
+	}
+
+	// a revoked server certificate is renewed
+	manager.RenewBefore = 0
+	if err := ca.RevokeCertificate("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := manager.GetCertificate(nil); current.Leaf.SerialNumber.Cmp(renewed.Leaf.SerialNumber) == 0 {
+		t.Error("Expected the revoked server certificate renewed")
+	}
+}